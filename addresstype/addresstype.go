@@ -0,0 +1,229 @@
+package addresstype
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Type describes an address type that can be published under an alias
+type Type struct {
+	ID   int
+	Name string
+
+	// Validate returns an error describing why the address is invalid
+	Validate func(address string) error
+
+	// Normalize is optional, it returns the canonical form of a valid
+	// address which is what gets stored
+	Normalize func(address string) (string, error)
+
+	// Formats optionally maps output format names to functions converting
+	// a stored address into that format
+	Formats map[string]func(address string) (string, error)
+
+	// Extensions lists the companion fields that may be published with
+	// an address of this type
+	Extensions []Extension
+
+	// Derive is optional, it returns the receive address at index of an
+	// extended public key. Types with it can be published as an extended
+	// key instead of a single address.
+	Derive func(extendedKey string, index uint32) (string, error)
+}
+
+// ErrTestNetwork is returned by validators for addresses that are well formed
+// but belong to a test network. Registries reject them unless test networks
+// are allowed.
+var ErrTestNetwork = errors.New("Address is for a test network")
+
+var (
+	typesMu sync.RWMutex
+	types   = make(map[int]Type)
+)
+
+// Register makes an address type available to every registry built after the
+// call. It is meant to be called from the init function of the file
+// implementing the type and panics if the type is incomplete or registered
+// twice.
+func Register(t Type) {
+	typesMu.Lock()
+	defer typesMu.Unlock()
+
+	if t.Validate == nil {
+		panic("addresstype: Register validator is nil for " + t.Name)
+	}
+	if _, dup := types[t.ID]; dup {
+		panic("addresstype: Register called twice for type " + strconv.Itoa(t.ID))
+	}
+	types[t.ID] = t
+}
+
+// Registered returns every registered address type ordered by ID
+func Registered() []Type {
+	typesMu.RLock()
+	defer typesMu.RUnlock()
+
+	list := make([]Type, 0, len(types))
+	for _, t := range types {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Registry is the set of address types a server accepts. Types that are
+// registered but not enabled are treated as unsupported.
+type Registry struct {
+	types             []Type
+	enabled           map[int]bool
+	allowTestNetworks bool
+}
+
+// NewRegistry builds a registry from the registered address types. If enabled
+// is not empty only those types are accepted, the disabled types are then
+// removed from that set.
+func NewRegistry(enabled, disabled []int) (*Registry, error) {
+	r := &Registry{
+		types:   Registered(),
+		enabled: make(map[int]bool),
+	}
+
+	known := make(map[int]bool)
+	for _, t := range r.types {
+		known[t.ID] = true
+	}
+	for _, ids := range [][]int{enabled, disabled} {
+		for _, id := range ids {
+			if !known[id] {
+				return nil, fmt.Errorf("Unknown address type %v", id)
+			}
+		}
+	}
+
+	if len(enabled) == 0 {
+		for _, t := range r.types {
+			r.enabled[t.ID] = true
+		}
+	}
+	for _, id := range enabled {
+		r.enabled[id] = true
+	}
+	for _, id := range disabled {
+		delete(r.enabled, id)
+	}
+	return r, nil
+}
+
+// AllowTestNetworks makes the registry accept test network addresses
+func (r *Registry) AllowTestNetworks(allow bool) {
+	r.allowTestNetworks = allow
+}
+
+// Types returns every registered address type ordered by ID, including the
+// disabled ones
+func (r *Registry) Types() []Type {
+	return r.types
+}
+
+// IsEnabled returns true if the address type is accepted by this registry
+func (r *Registry) IsEnabled(id int) bool {
+	return r.enabled[id]
+}
+
+// Get returns an enabled address type
+func (r *Registry) Get(id int) (Type, error) {
+	if !r.enabled[id] {
+		return Type{}, errors.New("Unsupported address type")
+	}
+	for _, t := range r.types {
+		if t.ID == id {
+			return t, nil
+		}
+	}
+	return Type{}, errors.New("Unsupported address type")
+}
+
+// Validate checks an address against its type and returns the form that
+// should be stored
+func (r *Registry) Validate(id int, address string) (string, error) {
+	t, err := r.Get(id)
+	if err != nil {
+		return "", err
+	}
+	err = t.Validate(address)
+	if err == ErrTestNetwork && r.allowTestNetworks {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if t.Normalize == nil {
+		return address, nil
+	}
+	return t.Normalize(address)
+}
+
+// ErrUnknownFormat is returned when an address is asked for in a format its
+// type doesn't have
+var ErrUnknownFormat = errors.New("Unknown format")
+
+// HasFormat returns true if an enabled address type can convert its
+// addresses to format, or any enabled type can if id is negative
+func (r *Registry) HasFormat(id int, format string) bool {
+	for _, t := range r.types {
+		if (id < 0 || t.ID == id) && r.enabled[t.ID] && t.Formats[format] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Format converts a stored address into the requested output format. An
+// empty format returns the address as it was stored.
+func (r *Registry) Format(id int, address, format string) (string, error) {
+	if format == "" {
+		return address, nil
+	}
+	t, err := r.Get(id)
+	if err != nil {
+		return "", err
+	}
+	convert, ok := t.Formats[format]
+	if !ok {
+		return "", ErrUnknownFormat
+	}
+	return convert(address)
+}
+
+// Derive returns the receive address at index of an extended public key
+func (r *Registry) Derive(id int, extendedKey string, index uint32) (string, error) {
+	t, err := r.Get(id)
+	if err != nil {
+		return "", err
+	}
+	if t.Derive == nil {
+		return "", errors.New(t.Name + " addresses can't be derived from an extended key")
+	}
+	return t.Derive(extendedKey, index)
+}
+
+// ParseIDs parses a comma separated list of address type IDs
+func ParseIDs(s string) ([]int, error) {
+	ids := make([]int, 0)
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid address type ID %q", field)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,75 @@
+package addresstype
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testBitcoinP2PKHAddress = "1DxBaADfhTSWsevbzDghrhKSqQwsBpuM5A"
+
+func TestRegistryDefaults(t *testing.T) {
+	r, err := NewRegistry(nil, nil)
+	assert.Nil(t, err)
+
+	for _, id := range []int{100, 101, 102, 103, 200, 201, 300} {
+		assert.True(t, r.IsEnabled(id))
+	}
+	assert.False(t, r.IsEnabled(999))
+
+	_, err = r.Get(999)
+	assert.NotNil(t, err)
+}
+
+func TestRegistryEnableDisable(t *testing.T) {
+	r, err := NewRegistry([]int{100, 300}, []int{300})
+	assert.Nil(t, err)
+	assert.True(t, r.IsEnabled(100))
+	assert.False(t, r.IsEnabled(101))
+	assert.False(t, r.IsEnabled(300))
+
+	// Disabled types are still listed
+	assert.Equal(t, len(Registered()), len(r.Types()))
+
+	_, err = NewRegistry([]int{999}, nil)
+	assert.NotNil(t, err)
+	_, err = NewRegistry(nil, []int{999})
+	assert.NotNil(t, err)
+}
+
+func TestRegistryValidate(t *testing.T) {
+	r, err := NewRegistry(nil, []int{101})
+	assert.Nil(t, err)
+
+	address, err := r.Validate(100, testBitcoinP2PKHAddress)
+	assert.Nil(t, err)
+	assert.Equal(t, testBitcoinP2PKHAddress, address)
+
+	_, err = r.Validate(100, "1DxBaADfhTSWsevbzDghrhKSqQwsBpuM5B")
+	assert.NotNil(t, err)
+
+	_, err = r.Validate(101, testBitcoinP2PKHAddress)
+	assert.NotNil(t, err)
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	assert.Panics(t, func() {
+		Register(Type{ID: 100, Name: "Duplicate", Validate: func(string) error { return nil }})
+	})
+	assert.Panics(t, func() {
+		Register(Type{ID: 99999, Name: "No validator"})
+	})
+}
+
+func TestParseIDs(t *testing.T) {
+	ids, err := ParseIDs("")
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+
+	ids, err = ParseIDs("100, 200,300")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{100, 200, 300}, ids)
+
+	_, err = ParseIDs("100,btc")
+	assert.NotNil(t, err)
+}
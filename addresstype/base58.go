@@ -0,0 +1,85 @@
+package addresstype
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+const bitcoinAlphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// decodeBase58 decodes a base58 string, leading zero bytes are encoded as the
+// first character of the alphabet
+func decodeBase58(s, alphabet string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range s {
+		index := strings.IndexRune(alphabet, c)
+		if index < 0 {
+			return nil, errors.New("Invalid base58 character")
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(index)))
+	}
+
+	zeros := 0
+	for zeros < len(s) && s[zeros] == alphabet[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+// encodeBase58 is the inverse of decodeBase58
+func encodeBase58(b []byte, alphabet string) string {
+	n := new(big.Int).SetBytes(b)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+
+	result := make([]byte, 0, len(b)*138/100+1)
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		result = append(result, alphabet[mod.Int64()])
+	}
+	for _, v := range b {
+		if v != 0 {
+			break
+		}
+		result = append(result, alphabet[0])
+	}
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return string(result)
+}
+
+func doubleSHA256(b []byte) []byte {
+	first := sha256.Sum256(b)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+// decodeBase58Check decodes a base58 string and verifies and strips its four
+// byte double SHA256 checksum
+func decodeBase58Check(s, alphabet string) ([]byte, error) {
+	decoded, err := decodeBase58(s, alphabet)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) < 5 {
+		return nil, errors.New("Too short")
+	}
+
+	payload := decoded[:len(decoded)-4]
+	if !bytes.Equal(decoded[len(decoded)-4:], doubleSHA256(payload)[:4]) {
+		return nil, errors.New("Invalid checksum")
+	}
+	return payload, nil
+}
+
+// encodeBase58Check appends the checksum to the payload and encodes it
+func encodeBase58Check(payload []byte, alphabet string) string {
+	b := append(append([]byte{}, payload...), doubleSHA256(payload)[:4]...)
+	return encodeBase58(b, alphabet)
+}
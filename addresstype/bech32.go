@@ -0,0 +1,92 @@
+package addresstype
+
+import (
+	"errors"
+	"strings"
+)
+
+// Bech32 encoding of segwit addresses
+// https://github.com/bitcoin/bips/blob/master/bip-0173.mediawiki
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var bech32Generator = []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+func bech32Polymod(values []byte) uint32 {
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := uint(0); i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= bech32Generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	values := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		values = append(values, hrp[i]>>5)
+	}
+	values = append(values, 0)
+	for i := 0; i < len(hrp); i++ {
+		values = append(values, hrp[i]&31)
+	}
+	return values
+}
+
+// decodeBech32 returns the human readable part of a bech32 string and the 5
+// bit values of its data part, without the checksum
+func decodeBech32(s string) (string, []byte, error) {
+	if len(s) > 90 {
+		return "", nil, errors.New("Too long")
+	}
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("Mixed case")
+	}
+	s = strings.ToLower(s)
+
+	separator := strings.LastIndex(s, "1")
+	if separator < 1 || separator+7 > len(s) {
+		return "", nil, errors.New("Invalid separator position")
+	}
+	hrp := s[:separator]
+	data := make([]byte, 0, len(s)-separator-1)
+	for i := separator + 1; i < len(s); i++ {
+		v := strings.IndexByte(bech32Charset, s[i])
+		if v < 0 {
+			return "", nil, errors.New("Invalid character")
+		}
+		data = append(data, byte(v))
+	}
+
+	if bech32Polymod(append(bech32HRPExpand(hrp), data...)) != 1 {
+		return "", nil, errors.New("Invalid checksum")
+	}
+	return hrp, data[:len(data)-6], nil
+}
+
+// encodeSegwit encodes a witness program as a bech32 address
+func encodeSegwit(hrp string, version byte, program []byte) (string, error) {
+	data, err := convertBits(program, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	data = append([]byte{version}, data...)
+
+	values := append(bech32HRPExpand(hrp), data...)
+	polymod := bech32Polymod(append(values, make([]byte, 6)...)) ^ 1
+	for i := 0; i < 6; i++ {
+		data = append(data, byte(polymod>>uint(5*(5-i))&31))
+	}
+
+	var sb strings.Builder
+	sb.WriteString(hrp + "1")
+	for _, v := range data {
+		sb.WriteByte(bech32Charset[v])
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,56 @@
+package addresstype
+
+import (
+	"errors"
+	"fmt"
+)
+
+// BIP47 payment code layout
+// https://github.com/bitcoin/bips/blob/master/bip-0047.mediawiki
+const (
+	paymentCodeVersionByte = 0x47
+	paymentCodeLength      = 80
+)
+
+// validatePaymentCode parses a base58check payment code and checks its
+// version byte, payment code version, public key sign and length
+func validatePaymentCode(address string) error {
+	decoded, err := decodeBase58Check(address, bitcoinAlphabet)
+	if err != nil {
+		return fmt.Errorf("Invalid payment code encoding: %v", err)
+	}
+
+	if len(decoded) != paymentCodeLength+1 {
+		return fmt.Errorf("Payment code must be %v bytes, got %v", paymentCodeLength, len(decoded)-1)
+	}
+	if decoded[0] != paymentCodeVersionByte {
+		return fmt.Errorf("Payment code version byte must be 0x%x", paymentCodeVersionByte)
+	}
+
+	payload := decoded[1:]
+	switch payload[0] {
+	case 0x01, 0x02:
+	default:
+		return fmt.Errorf("Unsupported payment code version %v", payload[0])
+	}
+
+	// payload[1] is the features bit field, any value is allowed
+	if payload[2] != 0x02 && payload[2] != 0x03 {
+		return errors.New("Payment code public key sign must be 0x02 or 0x03")
+	}
+
+	// bytes 2-34 are the compressed public key, its x value has to be a
+	// point on the curve or nobody could pay to it
+	if _, err := parseCompressed(payload[2:35]); err != nil {
+		return fmt.Errorf("Invalid payment code public key: %v", err)
+	}
+
+	// bytes 35-66 are the chain code, the rest is reserved for future use
+	// and must be zero
+	for _, b := range payload[67:] {
+		if b != 0 {
+			return errors.New("Payment code reserved bytes must be zero")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package addresstype
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Payment codes of Alice and Bob from the BIP47 test vectors
+const (
+	testAlicePaymentCode = "PM8TJTLJbPRGxSbc8EJi42Wrr6QbNSaSSVJ5Y3E4pbCYiTHUskHg13935Ubb7q8tx9GVbh2UuRnBc3WSyJHhUrw8KhprKnn9eDznYGieTzFcwQRya4GA"
+	testBobPaymentCode   = "PM8TJS2JxQ5ztXUpBBRnpTbcUXbUHy2T1abfrb3KkAAtMEGNbey4oumH7Hc578WgQJhPjBxteQ5GHHToTYHE3A1w6p7tU6KSoFmWBVbFGjKPisZDbP97"
+)
+
+func TestPaymentCodeValid(t *testing.T) {
+	assert.Nil(t, validatePaymentCode(testAlicePaymentCode))
+	assert.Nil(t, validatePaymentCode(testBobPaymentCode))
+}
+
+func TestPaymentCodeInvalid(t *testing.T) {
+	decoded, err := decodeBase58Check(testAlicePaymentCode, bitcoinAlphabet)
+	assert.Nil(t, err)
+
+	mutate := func(index int, value byte) string {
+		b := append([]byte{}, decoded...)
+		b[index] = value
+		return encodeBase58Check(b, bitcoinAlphabet)
+	}
+	publicKeyX := func(x byte) string {
+		b := append([]byte{}, decoded...)
+		for i := 4; i < 36; i++ {
+			b[i] = x
+		}
+		if x == 0 {
+			b[35] = 5 // x^3 + 7 has no square root
+		}
+		return encodeBase58Check(b, bitcoinAlphabet)
+	}
+
+	invalid := map[string]string{
+		"empty":           "",
+		"checksum":        testAlicePaymentCode[:len(testAlicePaymentCode)-1] + "B",
+		"bad character":   "0" + testAlicePaymentCode[1:],
+		"version byte":    mutate(0, 0x48),
+		"code version":    mutate(1, 0x05),
+		"sign byte":       mutate(3, 0x04),
+		"x off the curve": publicKeyX(0),
+		"x out of range":  publicKeyX(0xff),
+		"reserved bytes":  mutate(80, 0x01),
+		"too short":       encodeBase58Check(decoded[:80], bitcoinAlphabet),
+		"too long":        encodeBase58Check(append(append([]byte{}, decoded...), 0), bitcoinAlphabet),
+		"bitcoin address": testBitcoinP2PKHAddress,
+	}
+	for name, code := range invalid {
+		assert.NotNil(t, validatePaymentCode(code), name)
+	}
+}
+
+func TestBase58RoundTrip(t *testing.T) {
+	decoded, err := decodeBase58(testBitcoinP2PKHAddress, bitcoinAlphabet)
+	assert.Nil(t, err)
+	assert.Equal(t, 25, len(decoded))
+	assert.Equal(t, testBitcoinP2PKHAddress, encodeBase58(decoded, bitcoinAlphabet))
+
+	payload, err := decodeBase58Check(testBitcoinP2PKHAddress, bitcoinAlphabet)
+	assert.Nil(t, err)
+	assert.Equal(t, testBitcoinP2PKHAddress, encodeBase58Check(payload, bitcoinAlphabet))
+}
@@ -0,0 +1,31 @@
+package addresstype
+
+import (
+	"github.com/opencap/go-opencap/bitcoin"
+)
+
+func init() {
+	Register(Type{
+		ID:       100,
+		Name:     "Bitcoin P2PKH",
+		Validate: bitcoin.ValidateP2PKH,
+		Derive:   deriveP2PKH(xpubVersion),
+	})
+	Register(Type{
+		ID:       101,
+		Name:     "Bitcoin P2SH",
+		Validate: bitcoin.ValidateP2SH,
+		Derive:   deriveP2SHP2WPKH(xpubVersion, ypubVersion),
+	})
+	Register(Type{
+		ID:       102,
+		Name:     "Bitcoin Bech32",
+		Validate: bitcoin.ValidateSegwitBech32,
+		Derive:   deriveP2WPKH(xpubVersion, zpubVersion),
+	})
+	Register(Type{
+		ID:       103,
+		Name:     "Bitcoin Payment Code",
+		Validate: validatePaymentCode,
+	})
+}
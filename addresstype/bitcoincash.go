@@ -0,0 +1,33 @@
+package addresstype
+
+// Output formats supported by the Bitcoin Cash address types
+const (
+	FormatLegacy   = "legacy"
+	FormatCashAddr = "cashaddr"
+)
+
+func init() {
+	p2pkh := bitcoinCash{cashAddrType: cashAddrTypeP2KH, legacyVersion: legacyVersionP2PKH}
+	Register(Type{
+		ID:        200,
+		Name:      "Bitcoin Cash P2PKH",
+		Validate:  p2pkh.validate,
+		Normalize: p2pkh.normalize,
+		Formats: map[string]func(string) (string, error){
+			FormatLegacy:   p2pkh.toLegacy,
+			FormatCashAddr: p2pkh.toCashAddr,
+		},
+	})
+
+	p2sh := bitcoinCash{cashAddrType: cashAddrTypeP2SH, legacyVersion: legacyVersionP2SH}
+	Register(Type{
+		ID:        201,
+		Name:      "Bitcoin Cash P2SH",
+		Validate:  p2sh.validate,
+		Normalize: p2sh.normalize,
+		Formats: map[string]func(string) (string, error){
+			FormatLegacy:   p2sh.toLegacy,
+			FormatCashAddr: p2sh.toCashAddr,
+		},
+	})
+}
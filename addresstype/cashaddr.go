@@ -0,0 +1,220 @@
+package addresstype
+
+import (
+	"errors"
+	"strings"
+)
+
+// CashAddr is the Bitcoin Cash address format
+// https://github.com/bitcoincashorg/bitcoincash.org/blob/master/spec/cashaddr.md
+
+const (
+	cashAddrPrefix  = "bitcoincash"
+	cashAddrCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+	cashAddrTypeP2KH = 0
+	cashAddrTypeP2SH = 1
+
+	legacyVersionP2PKH = 0x00
+	legacyVersionP2SH  = 0x05
+)
+
+func cashAddrPolymod(values []byte) uint64 {
+	c := uint64(1)
+	for _, d := range values {
+		c0 := byte(c >> 35)
+		c = ((c & 0x07ffffffff) << 5) ^ uint64(d)
+		if c0&0x01 != 0 {
+			c ^= 0x98f2bc8e61
+		}
+		if c0&0x02 != 0 {
+			c ^= 0x79b76d99e2
+		}
+		if c0&0x04 != 0 {
+			c ^= 0xf33e5fb3c4
+		}
+		if c0&0x08 != 0 {
+			c ^= 0xae2eabe2a8
+		}
+		if c0&0x10 != 0 {
+			c ^= 0x1e4f43e470
+		}
+	}
+	return c ^ 1
+}
+
+// cashAddrChecksumInput is the lower five bits of each prefix character, a
+// zero separator and the data
+func cashAddrChecksumInput(prefix string, data []byte) []byte {
+	values := make([]byte, 0, len(prefix)+1+len(data))
+	for i := 0; i < len(prefix); i++ {
+		values = append(values, prefix[i]&0x1f)
+	}
+	values = append(values, 0)
+	return append(values, data...)
+}
+
+// convertBits regroups a slice of fromBits sized values into toBits sized
+// values
+func convertBits(data []byte, fromBits, toBits uint, pad bool) ([]byte, error) {
+	acc := 0
+	bits := uint(0)
+	maxv := (1 << toBits) - 1
+	result := make([]byte, 0, len(data)*int(fromBits)/int(toBits)+1)
+	for _, v := range data {
+		if int(v)>>fromBits != 0 {
+			return nil, errors.New("Invalid data range")
+		}
+		acc = acc<<fromBits | int(v)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			result = append(result, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			result = append(result, byte(acc<<(toBits-bits)&maxv))
+		}
+	} else if bits >= fromBits || acc<<(toBits-bits)&maxv != 0 {
+		return nil, errors.New("Invalid padding")
+	}
+	return result, nil
+}
+
+// decodeCashAddr returns the address type and hash of a CashAddr, the
+// bitcoincash: prefix is optional
+func decodeCashAddr(address string) (int, []byte, error) {
+	if address != strings.ToLower(address) && address != strings.ToUpper(address) {
+		return 0, nil, errors.New("Mixed case CashAddr")
+	}
+	address = strings.ToLower(address)
+
+	prefix := cashAddrPrefix
+	payload := address
+	if i := strings.LastIndex(address, ":"); i >= 0 {
+		prefix, payload = address[:i], address[i+1:]
+		if prefix != cashAddrPrefix {
+			return 0, nil, errors.New("Not a mainnet CashAddr")
+		}
+	}
+
+	if len(payload) <= 8 {
+		return 0, nil, errors.New("Too short")
+	}
+	data := make([]byte, len(payload))
+	for i := 0; i < len(payload); i++ {
+		index := strings.IndexByte(cashAddrCharset, payload[i])
+		if index < 0 {
+			return 0, nil, errors.New("Invalid CashAddr character")
+		}
+		data[i] = byte(index)
+	}
+
+	if cashAddrPolymod(cashAddrChecksumInput(prefix, data)) != 0 {
+		return 0, nil, errors.New("Invalid checksum")
+	}
+
+	decoded, err := convertBits(data[:len(data)-8], 5, 8, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(decoded) != 21 {
+		return 0, nil, errors.New("Only 160 bit hashes are supported")
+	}
+
+	version := decoded[0]
+	if version&0x80 != 0 {
+		return 0, nil, errors.New("Reserved version bit set")
+	}
+	if version&0x07 != 0 {
+		return 0, nil, errors.New("Only 160 bit hashes are supported")
+	}
+	return int(version >> 3), decoded[1:], nil
+}
+
+// encodeCashAddr encodes a 160 bit hash with the bitcoincash: prefix
+func encodeCashAddr(addressType int, hash []byte) (string, error) {
+	payload, err := convertBits(append([]byte{byte(addressType << 3)}, hash...), 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+
+	polymod := cashAddrPolymod(cashAddrChecksumInput(cashAddrPrefix, append(payload, make([]byte, 8)...)))
+	for i := 0; i < 8; i++ {
+		payload = append(payload, byte(polymod>>uint(5*(7-i))&0x1f))
+	}
+
+	var sb strings.Builder
+	sb.WriteString(cashAddrPrefix + ":")
+	for _, v := range payload {
+		sb.WriteByte(cashAddrCharset[v])
+	}
+	return sb.String(), nil
+}
+
+func decodeLegacy(address string, version byte) ([]byte, error) {
+	decoded, err := decodeBase58Check(address, bitcoinAlphabet)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != 21 {
+		return nil, errors.New("Invalid length")
+	}
+	if decoded[0] != version {
+		return nil, errors.New("Wrong address version")
+	}
+	return decoded[1:], nil
+}
+
+// bitcoinCash builds the validator and converters for one of the two Bitcoin
+// Cash address types, legacy and CashAddr formats are both accepted
+type bitcoinCash struct {
+	cashAddrType  int
+	legacyVersion byte
+}
+
+func (b bitcoinCash) hash(address string) ([]byte, error) {
+	if hash, err := decodeLegacy(address, b.legacyVersion); err == nil {
+		return hash, nil
+	}
+
+	addressType, hash, err := decodeCashAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	if addressType != b.cashAddrType {
+		return nil, errors.New("Wrong CashAddr type")
+	}
+	return hash, nil
+}
+
+func (b bitcoinCash) validate(address string) error {
+	_, err := b.hash(address)
+	return err
+}
+
+// normalize keeps legacy addresses as they are and lower cases CashAddrs
+// with their prefix
+func (b bitcoinCash) normalize(address string) (string, error) {
+	if _, err := decodeLegacy(address, b.legacyVersion); err == nil {
+		return address, nil
+	}
+	return b.toCashAddr(address)
+}
+
+func (b bitcoinCash) toCashAddr(address string) (string, error) {
+	hash, err := b.hash(address)
+	if err != nil {
+		return "", err
+	}
+	return encodeCashAddr(b.cashAddrType, hash)
+}
+
+func (b bitcoinCash) toLegacy(address string) (string, error) {
+	hash, err := b.hash(address)
+	if err != nil {
+		return "", err
+	}
+	return encodeBase58Check(append([]byte{b.legacyVersion}, hash...), bitcoinAlphabet), nil
+}
@@ -0,0 +1,82 @@
+package addresstype
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Legacy and CashAddr pairs from the CashAddr specification
+var testCashAddrP2PKH = map[string]string{
+	"1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu": "bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a",
+	"1KXrWXciRDZUpQwQmuM1DbwsKDLYAYsVLR": "bitcoincash:qr95sy3j9xwd2ap32xkykttr4cvcu7as4y0qverfuy",
+	"16w1D5WRVKJuZUsSRzdLp9w3YGcgoxDXb":  "bitcoincash:qqq3728yw0y47sqn6l2na30mcw6zm78dzqre909m2r",
+}
+
+var testCashAddrP2SH = map[string]string{
+	"3CWFddi6m4ndiGyKqzYvsFYagqDLPVMTzC": "bitcoincash:ppm2qsznhks23z7629mms6s4cwef74vcwvn0h829pq",
+	"3LDsS579y7sruadqu11beEJoTjdFiFCdX4": "bitcoincash:pr95sy3j9xwd2ap32xkykttr4cvcu7as4yc93ky28e",
+	"31nwvkZwyPdgzjBJZXfDmSWsC4ZLKpYyUw": "bitcoincash:pqq3728yw0y47sqn6l2na30mcw6zm78dzq5ucqzc37",
+}
+
+func TestCashAddrConversion(t *testing.T) {
+	r, err := NewRegistry(nil, nil)
+	assert.Nil(t, err)
+
+	for id, vectors := range map[int]map[string]string{200: testCashAddrP2PKH, 201: testCashAddrP2SH} {
+		for legacy, cashAddr := range vectors {
+			withoutPrefix := strings.TrimPrefix(cashAddr, "bitcoincash:")
+			for _, address := range []string{legacy, cashAddr, withoutPrefix, strings.ToUpper(cashAddr)} {
+				converted, err := r.Format(id, address, FormatCashAddr)
+				assert.Nil(t, err, address)
+				assert.Equal(t, cashAddr, converted)
+
+				converted, err = r.Format(id, address, FormatLegacy)
+				assert.Nil(t, err, address)
+				assert.Equal(t, legacy, converted)
+			}
+
+			normalized, err := r.Validate(id, withoutPrefix)
+			assert.Nil(t, err)
+			assert.Equal(t, cashAddr, normalized)
+
+			normalized, err = r.Validate(id, legacy)
+			assert.Nil(t, err)
+			assert.Equal(t, legacy, normalized)
+		}
+	}
+}
+
+func TestCashAddrInvalid(t *testing.T) {
+	r, err := NewRegistry(nil, nil)
+	assert.Nil(t, err)
+
+	invalid := map[string]string{
+		"checksum":   "bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6b",
+		"mixed case": "bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6A",
+		"prefix":     "bchtest:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a",
+		"character":  "bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6b1",
+		"p2sh":       "bitcoincash:ppm2qsznhks23z7629mms6s4cwef74vcwvn0h829pq",
+		"legacy":     "3CWFddi6m4ndiGyKqzYvsFYagqDLPVMTzC",
+	}
+	for name, address := range invalid {
+		_, err := r.Validate(200, address)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestFormatUnknown(t *testing.T) {
+	r, err := NewRegistry(nil, nil)
+	assert.Nil(t, err)
+
+	_, err = r.Format(100, testBitcoinP2PKHAddress, FormatCashAddr)
+	assert.Equal(t, ErrUnknownFormat, err)
+	_, err = r.Format(200, testBitcoinP2PKHAddress, "base58")
+	assert.Equal(t, ErrUnknownFormat, err)
+
+	assert.True(t, r.HasFormat(200, FormatCashAddr))
+	assert.False(t, r.HasFormat(100, FormatCashAddr))
+	assert.True(t, r.HasFormat(-1, FormatCashAddr))
+	assert.False(t, r.HasFormat(-1, "base58"))
+}
@@ -0,0 +1,39 @@
+package addresstype
+
+import (
+	"errors"
+)
+
+func init() {
+	Register(Type{
+		ID:         900,
+		Name:       "Cosmos",
+		Validate:   validateCosmos,
+		Extensions: []Extension{memo(cosmosMemoLength)},
+	})
+}
+
+const (
+	cosmosPrefix     = "cosmos"
+	cosmosMemoLength = 256
+)
+
+// validateCosmos validates a bech32 Cosmos Hub account address, which holds
+// a 20 byte key hash or a 32 byte module or interchain account hash
+func validateCosmos(address string) error {
+	hrp, data, err := decodeBech32(address)
+	if err != nil {
+		return err
+	}
+	if hrp != cosmosPrefix {
+		return errors.New("Not a Cosmos Hub address")
+	}
+	payload, err := convertBits(data, 5, 8, false)
+	if err != nil {
+		return err
+	}
+	if len(payload) != 20 && len(payload) != 32 {
+		return errors.New("Invalid length")
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package addresstype
+
+import (
+	"errors"
+	"strings"
+)
+
+func init() {
+	Register(Type{
+		ID:         800,
+		Name:       "EOS",
+		Validate:   validateEOS,
+		Extensions: []Extension{memo(eosMemoLength)},
+	})
+}
+
+const (
+	eosNameCharset = ".12345abcdefghijklmnopqrstuvwxyz"
+	eosNameLength  = 12
+	eosMemoLength  = 256
+)
+
+// validateEOS validates an EOS account name: up to 12 of a-z, 1-5 and dots,
+// not ending in a dot
+func validateEOS(address string) error {
+	if len(address) == 0 || len(address) > eosNameLength {
+		return errors.New("Account names are 1 to 12 characters long")
+	}
+	for i := 0; i < len(address); i++ {
+		if strings.IndexByte(eosNameCharset, address[i]) < 0 {
+			return errors.New("Account names can only have a-z, 1-5 and dots")
+		}
+	}
+	if strings.HasSuffix(address, ".") {
+		return errors.New("Account names can't end with a dot")
+	}
+	return nil
+}
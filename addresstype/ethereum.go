@@ -0,0 +1,97 @@
+package addresstype
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+func init() {
+	Register(Type{
+		ID:        400,
+		Name:      "Ethereum",
+		Validate:  validateEthereum,
+		Normalize: checksumEthereum,
+	})
+
+	// EVM compatible chains share Ethereum's address format but are
+	// published as separate types so a payment isn't sent on the wrong chain
+	Register(Type{
+		ID:        401,
+		Name:      "Polygon",
+		Validate:  validateEthereum,
+		Normalize: checksumEthereum,
+	})
+	Register(Type{
+		ID:        402,
+		Name:      "BNB Smart Chain",
+		Validate:  validateEthereum,
+		Normalize: checksumEthereum,
+	})
+	Register(Type{
+		ID:        403,
+		Name:      "Arbitrum One",
+		Validate:  validateEthereum,
+		Normalize: checksumEthereum,
+	})
+}
+
+// validateEthereum validates a hex address. Addresses in a single case carry
+// no checksum, mixed case addresses must match their EIP-55 checksum.
+// https://github.com/ethereum/EIPs/blob/master/EIPS/eip-55.md
+func validateEthereum(address string) error {
+	if !strings.HasPrefix(address, "0x") {
+		return errors.New("Missing 0x prefix")
+	}
+	hexPart := address[2:]
+	if len(hexPart) != 40 {
+		return errors.New("Address must be 20 bytes")
+	}
+	if _, err := hex.DecodeString(hexPart); err != nil {
+		return errors.New("Address must be hexadecimal")
+	}
+
+	if hexPart == strings.ToLower(hexPart) || hexPart == strings.ToUpper(hexPart) {
+		return nil
+	}
+
+	checksummed, err := checksumEthereum(address)
+	if err != nil {
+		return err
+	}
+	if checksummed != address {
+		return errors.New("Invalid EIP-55 checksum")
+	}
+	return nil
+}
+
+// checksumEthereum returns the EIP-55 mixed case form of a hex address
+func checksumEthereum(address string) (string, error) {
+	hexPart := strings.ToLower(strings.TrimPrefix(address, "0x"))
+	if len(hexPart) != 40 {
+		return "", errors.New("Address must be 20 bytes")
+	}
+
+	h := sha3.NewLegacyKeccak256()
+	h.Write([]byte(hexPart))
+	hash := h.Sum(nil)
+
+	result := []byte(hexPart)
+	for i, c := range result {
+		if c < 'a' || c > 'f' {
+			continue
+		}
+		// Each hex character is uppercased if the matching nibble of
+		// the hash is 8 or more
+		nibble := hash[i/2]
+		if i%2 == 0 {
+			nibble >>= 4
+		}
+		if nibble&0x0f >= 8 {
+			result[i] = c - 'a' + 'A'
+		}
+	}
+	return "0x" + string(result), nil
+}
@@ -0,0 +1,59 @@
+package addresstype
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test vectors from EIP-55
+var testEIP55Addresses = []string{
+	// All caps
+	"0x52908400098527886E0F7030069857D2E4169EE7",
+	"0x8617E340B3D01FA5F11F306F4090FD50E238070D",
+	// All lower
+	"0xde709f2102306220921060314715629080e2fb77",
+	"0x27b1fdb04752bbc536007a920d24acb045561c26",
+	// Normal
+	"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+	"0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359",
+	"0xdbF03B407c01E7cD3CBea99509d93f8DDDC8C6FB",
+	"0xD1220A0cf47c7B9Be7A2E6BA89F429762e7b9aDb",
+}
+
+func TestEthereumChecksum(t *testing.T) {
+	for _, address := range testEIP55Addresses {
+		assert.Nil(t, validateEthereum(address), address)
+
+		checksummed, err := checksumEthereum(strings.ToLower(address))
+		assert.Nil(t, err)
+		assert.Equal(t, address, checksummed)
+	}
+}
+
+func TestEthereumInvalid(t *testing.T) {
+	invalid := []string{
+		"",
+		"5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAe",
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAedd",
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeg",
+		// Checksum with the case of one letter flipped
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeD",
+	}
+	for _, address := range invalid {
+		assert.NotNil(t, validateEthereum(address), address)
+	}
+}
+
+func TestEVMChainsNormalize(t *testing.T) {
+	r, err := NewRegistry(nil, nil)
+	assert.Nil(t, err)
+
+	for _, id := range []int{400, 401, 402, 403} {
+		address, err := r.Validate(id, "0xfb6916095ca1df60bb79ce92ce3ea74c37c5d359")
+		assert.Nil(t, err)
+		assert.Equal(t, "0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359", address)
+	}
+}
@@ -0,0 +1,95 @@
+package addresstype
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Extension is a companion field published next to an address, such as the
+// destination tag an exchange needs to credit a deposit
+type Extension struct {
+	Name string
+
+	// Validate checks the raw JSON value of the extension, which is never
+	// null
+	Validate func(value json.RawMessage) error
+}
+
+// Extension names shared by several address types
+const (
+	ExtensionDestinationTag = "destination_tag"
+	ExtensionMemo           = "memo"
+)
+
+// destinationTag is a 32 bit unsigned integer as used by XRP
+var destinationTag = Extension{
+	Name: ExtensionDestinationTag,
+	Validate: func(value json.RawMessage) error {
+		var tag uint32
+		if err := json.Unmarshal(value, &tag); err != nil {
+			return errors.New("destination_tag must be an integer between 0 and 4294967295")
+		}
+		return nil
+	},
+}
+
+// memo returns a text memo extension limited to maxBytes
+func memo(maxBytes int) Extension {
+	return Extension{
+		Name: ExtensionMemo,
+		Validate: func(value json.RawMessage) error {
+			var text string
+			if err := json.Unmarshal(value, &text); err != nil {
+				return errors.New("memo must be a string")
+			}
+			if len(text) > maxBytes {
+				return fmt.Errorf("memo can't be longer than %v bytes", maxBytes)
+			}
+			return nil
+		},
+	}
+}
+
+// ValidateExtensions checks the extensions published with an address of the
+// given type and returns them as a JSON object, or an empty string if there
+// are none
+func (r *Registry) ValidateExtensions(id int, extensions map[string]json.RawMessage) (string, error) {
+	if len(extensions) == 0 {
+		return "", nil
+	}
+	t, err := r.Get(id)
+	if err != nil {
+		return "", err
+	}
+
+	names := make([]string, 0, len(extensions))
+	for name := range extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var extension *Extension
+		for i := range t.Extensions {
+			if t.Extensions[i].Name == name {
+				extension = &t.Extensions[i]
+			}
+		}
+		if extension == nil {
+			return "", fmt.Errorf("%v addresses don't support the %v extension", t.Name, name)
+		}
+		// null unmarshals into anything without an error
+		if bytes.Equal(bytes.TrimSpace(extensions[name]), []byte("null")) {
+			return "", fmt.Errorf("%v can't be null", name)
+		}
+		if err := extension.Validate(extensions[name]); err != nil {
+			return "", err
+		}
+	}
+
+	b, err := json.Marshal(extensions)
+	return string(b), err
+}
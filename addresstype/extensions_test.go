@@ -0,0 +1,114 @@
+package addresstype
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testXRPAddress       = "rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf"
+	testXAddress         = "X7AcgcsBL6XDcUb289X4mJ8djcdyKaB5hJDWMArnXr61cqZ"
+	testXAddressTagged   = "X7AcgcsBL6XDcUb289X4mJ8djcdyKaGZMhc9YTE92ehJ2Fu"
+	testXAddressTestnet  = "T719a5UwUCnEs54UsxG9CJYYDhwmFCqkr7wxCcNcfZ6p5GZ"
+	testStellarAddress   = "GAAZI4TCR3TY5OJHCTJC2A4QSY6CJWJH5IAJTGKIN2ER7LBNVKOCCWN7"
+	testStellarMalformed = "GAAZI4TCR3TY5OJHCTJC2A4QSY6CJWJH5IAJTGKIN2ER7LBNVKOCCWN8"
+	testCosmosAddress    = "cosmos1qypqxpq9qcrsszg2pvxq6rs0zqg3yyc5lzv7xu"
+	testCosmosModule     = "cosmos1grfev6ndrnrtyk0qvrurv7dtsx3rs7zs07fz2872r7wl53kxdt2szpe580"
+	testOsmosisAddress   = "osmo1qypqxpq9qcrsszg2pvxq6rs0zqg3yyc5helwsw"
+)
+
+func extensions(s string) map[string]json.RawMessage {
+	m := make(map[string]json.RawMessage)
+	json.Unmarshal([]byte(s), &m)
+	return m
+}
+
+func TestXRPAddresses(t *testing.T) {
+	assert.Nil(t, validateXRPClassic(testXRPAddress))
+	assert.Nil(t, validateXRPClassic("rHb9CJAWyB4rj91VRWn96DkukG4bwdtyTh"))
+	assert.NotNil(t, validateXRPClassic(testBitcoinP2PKHAddress))
+	assert.NotNil(t, validateXRPClassic(testXAddress))
+
+	assert.Nil(t, validateXRPXAddress(testXAddress))
+	assert.Nil(t, validateXRPXAddress(testXAddressTagged))
+	assert.Equal(t, ErrTestNetwork, validateXRPXAddress(testXAddressTestnet))
+	assert.NotNil(t, validateXRPXAddress(testXRPAddress))
+	assert.NotNil(t, validateXRPXAddress(testXAddress[:len(testXAddress)-1]+"R"))
+}
+
+func TestStellarAddresses(t *testing.T) {
+	assert.Nil(t, validateStellar(testStellarAddress))
+	assert.NotNil(t, validateStellar(testStellarMalformed))
+	assert.NotNil(t, validateStellar(testStellarAddress[1:]))
+	assert.NotNil(t, validateStellar(testXRPAddress))
+}
+
+func TestEOSAddresses(t *testing.T) {
+	for _, v := range []string{"eosio", "eosio.token", "binancecleos", "a1.b2.c3"} {
+		assert.Nil(t, validateEOS(v), v)
+	}
+	for _, v := range []string{"", "EOSIO", "eosio6", "eosio.", "eosio_token", "averylongaccount"} {
+		assert.NotNil(t, validateEOS(v), v)
+	}
+}
+
+func TestCosmosAddresses(t *testing.T) {
+	assert.Nil(t, validateCosmos(testCosmosAddress))
+	assert.Nil(t, validateCosmos(testCosmosModule))
+	assert.NotNil(t, validateCosmos(testOsmosisAddress))
+	assert.NotNil(t, validateCosmos(testCosmosAddress[:len(testCosmosAddress)-1]+"q"))
+	assert.NotNil(t, validateCosmos("Cosmos1qypqxpq9qcrsszg2pvxq6rs0zqg3yyc5lzv7xu"))
+	assert.NotNil(t, validateCosmos(testXRPAddress))
+}
+
+func TestValidateExtensions(t *testing.T) {
+	r, err := NewRegistry(nil, nil)
+	assert.Nil(t, err)
+
+	stored, err := r.ValidateExtensions(600, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", stored)
+
+	stored, err = r.ValidateExtensions(600, extensions(`{"destination_tag": 12345}`))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"destination_tag":12345}`, stored)
+
+	stored, err = r.ValidateExtensions(700, extensions(`{"memo": "exchange deposit"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"memo":"exchange deposit"}`, stored)
+
+	invalid := map[int]string{
+		600: `{"destination_tag": -1}`,
+		601: `{"destination_tag": 1}`,
+		100: `{"memo": "not supported"}`,
+		700: `{"memo": "this memo is much longer than twenty eight bytes"}`,
+		800: `{"memo": "` + strings.Repeat("a", 257) + `"}`,
+		900: `{"memo": "` + strings.Repeat("a", 257) + `"}`,
+	}
+	for id, value := range invalid {
+		_, err := r.ValidateExtensions(id, extensions(value))
+		assert.NotNil(t, err, value)
+	}
+
+	for _, value := range []string{`{"destination_tag": 4294967296}`, `{"destination_tag": 1.5}`, `{"destination_tag": "1"}`, `{"destination_tag": null}`} {
+		_, err := r.ValidateExtensions(600, extensions(value))
+		assert.NotNil(t, err, value)
+	}
+
+	// EOS and Cosmos memos can be up to 256 bytes, Stellar's only 28
+	for _, id := range []int{800, 900} {
+		stored, err = r.ValidateExtensions(id, extensions(`{"memo": "`+strings.Repeat("a", 256)+`"}`))
+		assert.Nil(t, err)
+		assert.Equal(t, `{"memo":"`+strings.Repeat("a", 256)+`"}`, stored)
+
+		for _, value := range []string{`{"memo": null}`, `{"memo": 12345}`, `{"destination_tag": 12345}`} {
+			_, err := r.ValidateExtensions(id, extensions(value))
+			assert.NotNil(t, err, value)
+		}
+	}
+	_, err = r.ValidateExtensions(700, extensions(`{"memo": null}`))
+	assert.NotNil(t, err)
+}
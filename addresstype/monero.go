@@ -0,0 +1,168 @@
+package addresstype
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+func init() {
+	Register(Type{
+		ID:       500,
+		Name:     "Monero",
+		Validate: validateMonero,
+	})
+}
+
+// Monero address kinds, told apart by their network byte
+const (
+	moneroStandard   = "standard"
+	moneroIntegrated = "integrated"
+	moneroSubaddress = "subaddress"
+)
+
+type moneroNetworkByte struct {
+	kind    string
+	testnet bool
+}
+
+// https://github.com/monero-project/monero/blob/master/src/cryptonote_config.h
+var moneroNetworkBytes = map[uint64]moneroNetworkByte{
+	// mainnet
+	18: {moneroStandard, false},
+	19: {moneroIntegrated, false},
+	42: {moneroSubaddress, false},
+	// testnet
+	53: {moneroStandard, true},
+	54: {moneroIntegrated, true},
+	63: {moneroSubaddress, true},
+	// stagenet
+	24: {moneroStandard, true},
+	25: {moneroIntegrated, true},
+	36: {moneroSubaddress, true},
+}
+
+const (
+	moneroKeysLength      = 64 // public spend key and public view key
+	moneroPaymentIDLength = 8
+	moneroChecksumLength  = 4
+)
+
+// validateMonero checks the checksum, network byte and length of a Monero
+// address. Test network addresses return ErrTestNetwork.
+func validateMonero(address string) error {
+	decoded, err := decodeMoneroBase58(address)
+	if err != nil {
+		return err
+	}
+	if len(decoded) < moneroChecksumLength+1 {
+		return errors.New("Too short")
+	}
+
+	data := decoded[:len(decoded)-moneroChecksumLength]
+	h := sha3.NewLegacyKeccak256()
+	h.Write(data)
+	if !bytes.Equal(h.Sum(nil)[:moneroChecksumLength], decoded[len(data):]) {
+		return errors.New("Invalid checksum")
+	}
+
+	tag, n := binary.Uvarint(data)
+	if n <= 0 {
+		return errors.New("Invalid network byte")
+	}
+	network, ok := moneroNetworkBytes[tag]
+	if !ok {
+		return fmt.Errorf("Unknown network byte %v", tag)
+	}
+
+	expected := moneroKeysLength
+	if network.kind == moneroIntegrated {
+		expected += moneroPaymentIDLength
+	}
+	if len(data)-n != expected {
+		return fmt.Errorf("Invalid length for %v address", network.kind)
+	}
+
+	if network.testnet {
+		return ErrTestNetwork
+	}
+	return nil
+}
+
+// Monero's base58 encodes 8 byte blocks into 11 characters, the last block
+// may be shorter
+var moneroEncodedBlockSizes = []int{0, 2, 3, 5, 6, 7, 9, 10, 11}
+
+const (
+	moneroBlockSize        = 8
+	moneroEncodedBlockSize = 11
+)
+
+func decodeMoneroBase58(s string) ([]byte, error) {
+	result := make([]byte, 0, len(s)*moneroBlockSize/moneroEncodedBlockSize)
+	for len(s) > 0 {
+		block := s
+		if len(block) > moneroEncodedBlockSize {
+			block = block[:moneroEncodedBlockSize]
+		}
+		s = s[len(block):]
+
+		size := -1
+		for i, v := range moneroEncodedBlockSizes {
+			if v == len(block) {
+				size = i
+			}
+		}
+		if size < 0 {
+			return nil, errors.New("Invalid length")
+		}
+
+		var n uint64
+		for _, c := range block {
+			index := strings.IndexRune(bitcoinAlphabet, c)
+			if index < 0 {
+				return nil, errors.New("Invalid base58 character")
+			}
+			if n > (math.MaxUint64-uint64(index))/58 {
+				return nil, errors.New("Block overflow")
+			}
+			n = n*58 + uint64(index)
+		}
+		if size < moneroBlockSize && n>>(8*uint(size)) != 0 {
+			return nil, errors.New("Block overflow")
+		}
+
+		buf := make([]byte, moneroBlockSize)
+		binary.BigEndian.PutUint64(buf, n)
+		result = append(result, buf[moneroBlockSize-size:]...)
+	}
+	return result, nil
+}
+
+func encodeMoneroBase58(b []byte) string {
+	var sb strings.Builder
+	for len(b) > 0 {
+		block := b
+		if len(block) > moneroBlockSize {
+			block = block[:moneroBlockSize]
+		}
+		b = b[len(block):]
+
+		buf := make([]byte, moneroBlockSize)
+		copy(buf[moneroBlockSize-len(block):], block)
+		n := binary.BigEndian.Uint64(buf)
+
+		encoded := make([]byte, moneroEncodedBlockSizes[len(block)])
+		for i := len(encoded) - 1; i >= 0; i-- {
+			encoded[i] = bitcoinAlphabet[n%58]
+			n /= 58
+		}
+		sb.Write(encoded)
+	}
+	return sb.String()
+}
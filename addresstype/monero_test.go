@@ -0,0 +1,81 @@
+package addresstype
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/sha3"
+)
+
+// Monero general fund donation address
+const testMoneroAddress = "44AFFq5kSiGBoZ4NMDwYtN18obc8AemS33DBLWs3H7otXft3XjrpDtQGv7SqSsaBYBb98uNbr2VBBEt7f2wfn3RVGQBEP3A"
+
+// makeMoneroAddress re-encodes the keys of the test address with another
+// network byte and optional payment ID
+func makeMoneroAddress(t *testing.T, networkByte byte, paymentID []byte) string {
+	decoded, err := decodeMoneroBase58(testMoneroAddress)
+	assert.Nil(t, err)
+
+	data := append([]byte{networkByte}, decoded[1:1+moneroKeysLength]...)
+	data = append(data, paymentID...)
+	h := sha3.NewLegacyKeccak256()
+	h.Write(data)
+	return encodeMoneroBase58(append(data, h.Sum(nil)[:moneroChecksumLength]...))
+}
+
+func TestMoneroValid(t *testing.T) {
+	assert.Nil(t, validateMonero(testMoneroAddress))
+
+	subaddress := makeMoneroAddress(t, 42, nil)
+	assert.Equal(t, byte('8'), subaddress[0])
+	assert.Nil(t, validateMonero(subaddress))
+
+	integrated := makeMoneroAddress(t, 19, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	assert.Equal(t, 106, len(integrated))
+	assert.Nil(t, validateMonero(integrated))
+}
+
+func TestMoneroInvalid(t *testing.T) {
+	invalid := map[string]string{
+		"empty":              "",
+		"checksum":           testMoneroAddress[:len(testMoneroAddress)-1] + "B",
+		"character":          "0" + testMoneroAddress[1:],
+		"block length":       testMoneroAddress[:len(testMoneroAddress)-1],
+		"network byte":       makeMoneroAddress(t, 99, nil),
+		"standard with id":   makeMoneroAddress(t, 18, []byte{1, 2, 3, 4, 5, 6, 7, 8}),
+		"integrated no id":   makeMoneroAddress(t, 19, nil),
+		"bitcoin address":    testBitcoinP2PKHAddress,
+		"subaddress with id": makeMoneroAddress(t, 42, []byte{1, 2, 3, 4, 5, 6, 7, 8}),
+	}
+	for name, address := range invalid {
+		err := validateMonero(address)
+		assert.NotNil(t, err, name)
+		assert.NotEqual(t, ErrTestNetwork, err, name)
+	}
+}
+
+func TestMoneroTestNetworks(t *testing.T) {
+	r, err := NewRegistry(nil, nil)
+	assert.Nil(t, err)
+
+	for _, networkByte := range []byte{53, 63, 24, 36} {
+		address := makeMoneroAddress(t, networkByte, nil)
+		assert.Equal(t, ErrTestNetwork, validateMonero(address))
+
+		_, err := r.Validate(500, address)
+		assert.NotNil(t, err)
+	}
+
+	r.AllowTestNetworks(true)
+	for _, networkByte := range []byte{53, 63, 24, 36} {
+		_, err := r.Validate(500, makeMoneroAddress(t, networkByte, nil))
+		assert.Nil(t, err)
+	}
+}
+
+func TestMoneroBase58RoundTrip(t *testing.T) {
+	decoded, err := decodeMoneroBase58(testMoneroAddress)
+	assert.Nil(t, err)
+	assert.Equal(t, 69, len(decoded))
+	assert.Equal(t, testMoneroAddress, encodeMoneroBase58(decoded))
+}
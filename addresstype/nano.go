@@ -0,0 +1,13 @@
+package addresstype
+
+import (
+	"github.com/opencap/go-opencap/nano"
+)
+
+func init() {
+	Register(Type{
+		ID:       300,
+		Name:     "Nano",
+		Validate: nano.ValidateAddress,
+	})
+}
@@ -0,0 +1,116 @@
+package addresstype
+
+import (
+	"errors"
+	"math/big"
+)
+
+// Just enough secp256k1 arithmetic for BIP32 public key derivation. Only
+// public data goes through here so constant time isn't a concern.
+
+type secp256k1Point struct {
+	x, y *big.Int // nil x is the point at infinity
+}
+
+var (
+	secp256k1P, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEFFFFFC2F", 16)
+	secp256k1N, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141", 16)
+	secp256k1Gx   = fromHex("79BE667EF9DCBBAC55A06295CE870B07029BFCDB2DCE28D959F2815B16F81798")
+	secp256k1Gy   = fromHex("483ADA7726A3C4655DA4FBFC0E1108A8FD17B448A68554199C47D08FFB10D4B8")
+	secp256k1G    = secp256k1Point{secp256k1Gx, secp256k1Gy}
+)
+
+func fromHex(s string) *big.Int {
+	n, _ := new(big.Int).SetString(s, 16)
+	return n
+}
+
+func (a secp256k1Point) isInfinity() bool {
+	return a.x == nil
+}
+
+func (a secp256k1Point) add(b secp256k1Point) secp256k1Point {
+	if a.isInfinity() {
+		return b
+	}
+	if b.isInfinity() {
+		return a
+	}
+
+	p := secp256k1P
+	var lambda *big.Int
+	if a.x.Cmp(b.x) == 0 {
+		if a.y.Cmp(b.y) != 0 || a.y.Sign() == 0 {
+			return secp256k1Point{}
+		}
+		// lambda = 3x^2 / 2y
+		num := new(big.Int).Mul(a.x, a.x)
+		num.Mul(num, big.NewInt(3))
+		den := new(big.Int).Lsh(a.y, 1)
+		lambda = num.Mul(num, den.ModInverse(den.Mod(den, p), p))
+	} else {
+		// lambda = (y2 - y1) / (x2 - x1)
+		num := new(big.Int).Sub(b.y, a.y)
+		den := new(big.Int).Sub(b.x, a.x)
+		lambda = num.Mul(num, den.ModInverse(den.Mod(den, p), p))
+	}
+	lambda.Mod(lambda, p)
+
+	x := new(big.Int).Mul(lambda, lambda)
+	x.Sub(x, a.x)
+	x.Sub(x, b.x)
+	x.Mod(x, p)
+
+	y := new(big.Int).Sub(a.x, x)
+	y.Mul(y, lambda)
+	y.Sub(y, a.y)
+	y.Mod(y, p)
+	return secp256k1Point{x, y}
+}
+
+func (a secp256k1Point) mul(k *big.Int) secp256k1Point {
+	result := secp256k1Point{}
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		result = result.add(result)
+		if k.Bit(i) == 1 {
+			result = result.add(a)
+		}
+	}
+	return result
+}
+
+// compressed serializes the point as a 33 byte compressed public key
+func (a secp256k1Point) compressed() []byte {
+	b := make([]byte, 33)
+	b[0] = 0x02 + byte(a.y.Bit(0))
+	xBytes := a.x.Bytes()
+	copy(b[33-len(xBytes):], xBytes)
+	return b
+}
+
+// parseCompressed parses a 33 byte compressed public key
+func parseCompressed(b []byte) (secp256k1Point, error) {
+	if len(b) != 33 || (b[0] != 0x02 && b[0] != 0x03) {
+		return secp256k1Point{}, errors.New("Invalid compressed public key")
+	}
+	x := new(big.Int).SetBytes(b[1:])
+	if x.Cmp(secp256k1P) >= 0 {
+		return secp256k1Point{}, errors.New("Public key out of range")
+	}
+
+	// y^2 = x^3 + 7, p = 3 mod 4 so the square root is a power
+	ySquared := new(big.Int).Exp(x, big.NewInt(3), secp256k1P)
+	ySquared.Add(ySquared, big.NewInt(7))
+	ySquared.Mod(ySquared, secp256k1P)
+	exp := new(big.Int).Add(secp256k1P, big.NewInt(1))
+	exp.Rsh(exp, 2)
+	y := new(big.Int).Exp(ySquared, exp, secp256k1P)
+	if new(big.Int).Exp(y, big.NewInt(2), secp256k1P).Cmp(ySquared) != 0 {
+		return secp256k1Point{}, errors.New("Public key not on curve")
+	}
+
+	if y.Bit(0) != uint(b[0]&1) {
+		y.Sub(secp256k1P, y)
+	}
+	return secp256k1Point{x, y}, nil
+}
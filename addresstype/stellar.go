@@ -0,0 +1,58 @@
+package addresstype
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+)
+
+func init() {
+	Register(Type{
+		ID:         700,
+		Name:       "Stellar",
+		Validate:   validateStellar,
+		Extensions: []Extension{memo(stellarMemoTextLength)},
+	})
+}
+
+const (
+	stellarAccountVersion = 6 << 3 // "G..." public keys
+	stellarKeyLength      = 32
+	stellarMemoTextLength = 28
+)
+
+// validateStellar validates a strkey encoded account ID
+// https://github.com/stellar/stellar-protocol/blob/master/ecosystem/sep-0023.md
+func validateStellar(address string) error {
+	decoded, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(address)
+	if err != nil {
+		return errors.New("Invalid base32 encoding")
+	}
+	if len(decoded) != 1+stellarKeyLength+2 {
+		return errors.New("Invalid length")
+	}
+	if decoded[0] != stellarAccountVersion {
+		return errors.New("Not an account ID")
+	}
+
+	payload := decoded[:len(decoded)-2]
+	if crc16XModem(payload) != binary.LittleEndian.Uint16(decoded[len(payload):]) {
+		return errors.New("Invalid checksum")
+	}
+	return nil
+}
+
+func crc16XModem(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
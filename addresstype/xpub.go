@@ -0,0 +1,162 @@
+package addresstype
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math/big"
+
+	"golang.org/x/crypto/ripemd160"
+)
+
+// Extended public keys let a server hand out a fresh receive address on each
+// lookup without holding any private key
+// https://github.com/bitcoin/bips/blob/master/bip-0032.mediawiki
+
+const (
+	extendedKeyLength = 78
+	hardenedIndex     = 0x80000000
+)
+
+// Extended public key versions, ypub and zpub tell wallets which script the
+// derived keys are used with
+// https://github.com/satoshilabs/slips/blob/master/slip-0132.md
+var (
+	xpubVersion = []byte{0x04, 0x88, 0xb2, 0x1e}
+	ypubVersion = []byte{0x04, 0x9d, 0x7c, 0xb2}
+	zpubVersion = []byte{0x04, 0xb2, 0x47, 0x46}
+)
+
+type extendedKey struct {
+	version   []byte
+	depth     byte
+	chainCode []byte
+	key       secp256k1Point
+}
+
+func parseExtendedKey(s string) (extendedKey, error) {
+	decoded, err := decodeBase58Check(s, bitcoinAlphabet)
+	if err != nil {
+		return extendedKey{}, err
+	}
+	if len(decoded) != extendedKeyLength {
+		return extendedKey{}, errors.New("Invalid extended key length")
+	}
+
+	version := decoded[:4]
+	if !bytes.Equal(version, xpubVersion) && !bytes.Equal(version, ypubVersion) && !bytes.Equal(version, zpubVersion) {
+		return extendedKey{}, errors.New("Only mainnet xpub, ypub and zpub extended public keys are supported")
+	}
+
+	key, err := parseCompressed(decoded[45:78])
+	if err != nil {
+		return extendedKey{}, err
+	}
+	return extendedKey{
+		version:   version,
+		depth:     decoded[4],
+		chainCode: decoded[13:45],
+		key:       key,
+	}, nil
+}
+
+// child derives a non-hardened child public key (CKDpub)
+func (k extendedKey) child(index uint32) (extendedKey, error) {
+	if index >= hardenedIndex {
+		return extendedKey{}, errors.New("Hardened keys can't be derived from a public key")
+	}
+
+	data := make([]byte, 37)
+	copy(data, k.key.compressed())
+	binary.BigEndian.PutUint32(data[33:], index)
+
+	mac := hmac.New(sha512.New, k.chainCode)
+	mac.Write(data)
+	I := mac.Sum(nil)
+
+	il := new(big.Int).SetBytes(I[:32])
+	if il.Cmp(secp256k1N) >= 0 {
+		return extendedKey{}, errors.New("Invalid child, try the next index")
+	}
+	key := secp256k1G.mul(il).add(k.key)
+	if key.isInfinity() {
+		return extendedKey{}, errors.New("Invalid child, try the next index")
+	}
+
+	return extendedKey{
+		version:   k.version,
+		depth:     k.depth + 1,
+		chainCode: I[32:],
+		key:       key,
+	}, nil
+}
+
+// receiveKey derives the public key of receive address index, the extended
+// key is expected to be an account key (e.g. m/44'/0'/0')
+func (k extendedKey) receiveKey(index uint32) ([]byte, error) {
+	external, err := k.child(0)
+	if err != nil {
+		return nil, err
+	}
+	child, err := external.child(index)
+	if err != nil {
+		return nil, err
+	}
+	return child.key.compressed(), nil
+}
+
+func hash160(b []byte) []byte {
+	sha := sha256.Sum256(b)
+	h := ripemd160.New()
+	h.Write(sha[:])
+	return h.Sum(nil)
+}
+
+// deriveP2PKH returns a derive function for legacy addresses
+func deriveP2PKH(versions ...[]byte) func(string, uint32) (string, error) {
+	return deriveWith(versions, func(pubKey []byte) (string, error) {
+		return encodeBase58Check(append([]byte{legacyVersionP2PKH}, hash160(pubKey)...), bitcoinAlphabet), nil
+	})
+}
+
+// deriveP2SHP2WPKH returns a derive function for segwit addresses nested in
+// P2SH
+func deriveP2SHP2WPKH(versions ...[]byte) func(string, uint32) (string, error) {
+	return deriveWith(versions, func(pubKey []byte) (string, error) {
+		redeemScript := append([]byte{0x00, 0x14}, hash160(pubKey)...)
+		return encodeBase58Check(append([]byte{legacyVersionP2SH}, hash160(redeemScript)...), bitcoinAlphabet), nil
+	})
+}
+
+// deriveP2WPKH returns a derive function for native segwit addresses
+func deriveP2WPKH(versions ...[]byte) func(string, uint32) (string, error) {
+	return deriveWith(versions, func(pubKey []byte) (string, error) {
+		return encodeSegwit("bc", 0, hash160(pubKey))
+	})
+}
+
+func deriveWith(versions [][]byte, encode func(pubKey []byte) (string, error)) func(string, uint32) (string, error) {
+	return func(s string, index uint32) (string, error) {
+		key, err := parseExtendedKey(s)
+		if err != nil {
+			return "", err
+		}
+
+		accepted := false
+		for _, v := range versions {
+			accepted = accepted || bytes.Equal(key.version, v)
+		}
+		if !accepted {
+			return "", errors.New("Extended key version doesn't match the address type")
+		}
+
+		pubKey, err := key.receiveKey(index)
+		if err != nil {
+			return "", err
+		}
+		return encode(pubKey)
+	}
+}
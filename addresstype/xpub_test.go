@@ -0,0 +1,83 @@
+package addresstype
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Account keys and first receive addresses for the mnemonic "abandon abandon
+// ... about" from the BIP44, BIP49 and BIP84 test vectors
+const (
+	testBIP44Account = "xpub6BosfCnifzxcFwrSzQiqu2DBVTshkCXacvNsWGYJVVhhawA7d4R5WSWGFNbi8Aw6ZRc1brxMyWMzG3DSSSSoekkudhUd9yLb6qx39T9nMdj"
+	testBIP49Account = "ypub6Ww3ibxVfGzLrAH1PNcjyAWenMTbbAosGNB6VvmSEgytSER9azLDWCxoJwW7Ke7icmizBMXrzBx9979FfaHxHcrArf3zbeJJJUZPf663zsP"
+	testBIP84Account = "zpub6rFR7y4Q2AijBEqTUquhVz398htDFrtymD9xYYfG1m4wAcvPhXNfE3EfH1r1ADqtfSdVCToUG868RvUUkgDKf31mGDtKsAYz2oz2AGutZYs"
+)
+
+// BIP32 test vector 1, m/0H and m/0H/1
+const (
+	testBIP32Parent = "xpub68Gmy5EdvgibQVfPdqkBBCHxA5htiqg55crXYuXoQRKfDBFA1WEjWgP6LHhwBZeNK1VTsfTFUHCdrfp1bgwQ9xv5ski8PX9rL2dZXvgGDnw"
+	testBIP32Child  = "xpub6ASuArnXKPbfEwhqN6e3mwBcDTgzisQN1wXN9BJcM47sSikHjJf3UFHKkNAWbWMiGj7Wf5uMash7SyYq527Hqck2AxYysAA7xmALppuCkwQ"
+)
+
+func TestExtendedKeyChild(t *testing.T) {
+	parent, err := parseExtendedKey(testBIP32Parent)
+	assert.Nil(t, err)
+	expected, err := parseExtendedKey(testBIP32Child)
+	assert.Nil(t, err)
+
+	child, err := parent.child(1)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(expected.key.compressed(), child.key.compressed()))
+	assert.True(t, bytes.Equal(expected.chainCode, child.chainCode))
+	assert.Equal(t, expected.depth, child.depth)
+
+	_, err = parent.child(hardenedIndex)
+	assert.NotNil(t, err)
+}
+
+func TestDeriveAddresses(t *testing.T) {
+	r, err := NewRegistry(nil, nil)
+	assert.Nil(t, err)
+
+	vectors := []struct {
+		id      int
+		key     string
+		index   uint32
+		address string
+	}{
+		{100, testBIP44Account, 0, "1LqBGSKuX5yYUonjxT5qGfpUsXKYYWeabA"},
+		{100, testBIP44Account, 1, "1Ak8PffB2meyfYnbXZR9EGfLfFZVpzJvQP"},
+		{101, testBIP49Account, 0, "37VucYSaXLCAsxYyAPfbSi9eh4iEcbShgf"},
+		{102, testBIP84Account, 0, "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu"},
+		{102, testBIP84Account, 1, "bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g"},
+	}
+	for _, v := range vectors {
+		address, err := r.Derive(v.id, v.key, v.index)
+		assert.Nil(t, err)
+		assert.Equal(t, v.address, address)
+
+		_, err = r.Validate(v.id, address)
+		assert.Nil(t, err)
+	}
+}
+
+func TestDeriveInvalid(t *testing.T) {
+	r, err := NewRegistry(nil, nil)
+	assert.Nil(t, err)
+
+	// zpub keys are only used for native segwit
+	_, err = r.Derive(100, testBIP84Account, 0)
+	assert.NotNil(t, err)
+
+	// Nano has no extended keys
+	_, err = r.Derive(300, testBIP44Account, 0)
+	assert.NotNil(t, err)
+
+	_, err = r.Derive(100, testBitcoinP2PKHAddress, 0)
+	assert.NotNil(t, err)
+
+	_, err = r.Derive(100, testBIP44Account[:len(testBIP44Account)-1]+"k", 0)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,98 @@
+package addresstype
+
+import (
+	"bytes"
+	"errors"
+)
+
+func init() {
+	Register(Type{
+		ID:         600,
+		Name:       "XRP",
+		Validate:   validateXRPClassic,
+		Extensions: []Extension{destinationTag},
+	})
+
+	// X-addresses carry the destination tag inside the address
+	Register(Type{
+		ID:       601,
+		Name:     "XRP X-address",
+		Validate: validateXRPXAddress,
+	})
+}
+
+const rippleAlphabet = "rpshnaf39wBUDNEGHJKLM4PQRST7VWXYZ2bcdeCg65jkm8oFqi1tuvAxyz"
+
+const (
+	xrpAccountIDLength = 20
+	xrpAccountVersion  = 0x00
+)
+
+// X-address prefixes
+// https://github.com/XRPLF/XRPL-Standards/tree/master/XLS-0005d-tagged-addresses
+var (
+	xAddressMainnetPrefix = []byte{0x05, 0x44}
+	xAddressTestnetPrefix = []byte{0x04, 0x93}
+)
+
+// validateXRPClassic validates an r... account address
+func validateXRPClassic(address string) error {
+	decoded, err := decodeBase58Check(address, rippleAlphabet)
+	if err != nil {
+		return err
+	}
+	if len(decoded) != xrpAccountIDLength+1 {
+		return errors.New("Invalid length")
+	}
+	if decoded[0] != xrpAccountVersion {
+		return errors.New("Not an account address")
+	}
+	return nil
+}
+
+// validateXRPXAddress validates an X-address, test network addresses return
+// ErrTestNetwork
+func validateXRPXAddress(address string) error {
+	decoded, err := decodeBase58Check(address, rippleAlphabet)
+	if err != nil {
+		return err
+	}
+	// prefix, account ID, tag flag, 64 bit little endian tag
+	if len(decoded) != 2+xrpAccountIDLength+1+8 {
+		return errors.New("Invalid length")
+	}
+
+	testnet := false
+	switch {
+	case bytes.Equal(decoded[:2], xAddressMainnetPrefix):
+	case bytes.Equal(decoded[:2], xAddressTestnetPrefix):
+		testnet = true
+	default:
+		return errors.New("Invalid X-address prefix")
+	}
+
+	flag := decoded[2+xrpAccountIDLength]
+	tag := decoded[2+xrpAccountIDLength+1:]
+	switch flag {
+	case 0:
+		for _, b := range tag {
+			if b != 0 {
+				return errors.New("Tag must be zero when no tag is set")
+			}
+		}
+	case 1:
+		// Only 32 bit tags are valid, the upper bytes are reserved
+		for _, b := range tag[4:] {
+			if b != 0 {
+				return errors.New("Tag must fit in 32 bits")
+			}
+		}
+	default:
+		return errors.New("Invalid tag flag")
+	}
+
+	if testnet {
+		return ErrTestNetwork
+	}
+	return nil
+}
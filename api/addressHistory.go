@@ -0,0 +1,189 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/opencap/go-server/auth"
+	"github.com/opencap/go-server/database"
+)
+
+type addressHistoryResponse struct {
+	Changes []database.AddressChange `json:"changes"`
+	Total   int                      `json:"total"`
+	Page    int                      `json:"page"`
+	PerPage int                      `json:"per_page"`
+}
+
+// actor is who made an address change, as recorded in the history
+func actor(authorization auth.Authorization) string {
+	if authorization.APIKey != nil {
+		return "api_key:" + strconv.FormatUint(uint64(authorization.APIKey.ID), 10)
+	}
+	return "user"
+}
+
+// changeAddresses makes a change to a user's addresses with apply and adds it
+// to their address history, key is the extended key the address was
+// published with if there is one. apply is given a config whose database is
+// the transaction the change is recorded in, so the history only has changes
+// that were made. Its errors are returned as they are.
+func (cfg Config) changeAddresses(req *http.Request, authorization auth.Authorization, user database.User, action string, address database.Address, key database.ExtendedKey, apply func(cfg Config) error) error {
+	change := database.AddressChange{
+		UserID:        user.ID,
+		AddressType:   address.AddressType,
+		Action:        action,
+		Address:       address.Address,
+		Extensions:    address.Extensions,
+		ExtendedKey:   key.PublicKey,
+		RotateEvery:   key.RotateEvery,
+		UserPublicKey: address.UserPublicKey,
+		UserSignature: address.UserSignature,
+		Actor:         actor(authorization),
+		RemoteAddr:    remoteHost(req),
+	}
+	return cfg.db.ChangeAddresses(&change, func(tx database.Database) error {
+		txCfg := cfg
+		txCfg.db = tx
+		return apply(txCfg)
+	})
+}
+
+// validateAddressHistoryParams returns the address type to list the history
+// of, -1 if the history of every type was asked for, and the page
+func validateAddressHistoryParams(req *http.Request) (int, int, int, error) {
+	page, perPage, err := validatePaginationParams(req)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	addressType := -1
+	if v := req.URL.Query().Get("address_type"); v != "" {
+		addressType, err = strconv.Atoi(v)
+		if err != nil || addressType < 0 {
+			return 0, 0, 0, errors.New("Address type must be an ID number")
+		}
+	}
+	return addressType, page, perPage, nil
+}
+
+func (cfg Config) respondWithAddressHistory(w http.ResponseWriter, user database.User, addressType, page, perPage int) {
+	changes, total, err := cfg.db.GetAddressChanges(user, addressType, (page-1)*perPage, perPage)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := addressHistoryResponse{
+		Changes: changes,
+		Total:   total,
+		Page:    page,
+		PerPage: perPage,
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// getAddressHistoryHandler lists the changes to the logged in user's
+// addresses, newest first
+func (cfg Config) getAddressHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	addressType, page, perPage, err := validateAddressHistoryParams(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, _, err := cfg.authorizeScope(req, auth.ScopeReadAddresses, addressType)
+	if err == errAPIKeyNotAllowed {
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid login credentials")
+		return
+	}
+
+	cfg.respondWithAddressHistory(w, user, addressType, page, perPage)
+}
+
+// postRestoreAddressHandler publishes an address again from an earlier
+// change in the logged in user's history
+func (cfg Config) postRestoreAddressHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Address change id must be a number")
+		return
+	}
+
+	user, authorization, err := cfg.authorize(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid login credentials")
+		return
+	}
+
+	change, err := cfg.db.GetAddressChange(user, uint(id))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if !authorization.Allows(auth.ScopeUpdateAddresses, change.AddressType) {
+		respondWithError(w, http.StatusForbidden, errAPIKeyNotAllowed.Error())
+		return
+	}
+	if change.Action != database.AddressChangeUpdate && change.Action != database.AddressChangeRestore {
+		respondWithError(w, http.StatusBadRequest, "Only published addresses can be restored, pools have to be uploaded again")
+		return
+	}
+
+	// The address type may have been disabled since
+	if !cfg.addressTypes.IsEnabled(change.AddressType) {
+		respondWithError(w, http.StatusBadRequest, "Unsupported address type")
+		return
+	}
+
+	reqModel := putAddressRequest{
+		AddressType:   change.AddressType,
+		Address:       change.Address,
+		ExtendedKey:   change.ExtendedKey,
+		RotateEvery:   change.RotateEvery,
+		UserPublicKey: change.UserPublicKey,
+		UserSignature: change.UserSignature,
+	}
+	address := reqToAddress(reqModel, change.Extensions)
+
+	previous, _ := cfg.db.GetAddressByAddressType(user, change.AddressType)
+	key := database.ExtendedKey{PublicKey: change.ExtendedKey, RotateEvery: change.RotateEvery}
+	err = cfg.changeAddresses(req, authorization, user, database.AddressChangeRestore, address, key, func(cfg Config) error {
+		return cfg.publishAddress(&user, reqModel, &address)
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg.auditAddress(req, actor(authorization), "restore_address", user, address.AddressType, addressValue(previous), addressValue(address))
+
+	var empty struct{}
+	respondWithJSON(w, http.StatusOK, empty)
+}
+
+// adminAddressHistoryHandler lists the changes to a user's addresses
+func (cfg Config) adminAddressHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	user, code, err := cfg.adminUserFromRequest(req)
+	if err != nil {
+		respondWithError(w, code, err.Error())
+		return
+	}
+	addressType, page, perPage, err := validateAddressHistoryParams(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := cfg.recordAdminAction(req, "view_address_history", user); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record admin action")
+		return
+	}
+
+	cfg.respondWithAddressHistory(w, user, addressType, page, perPage)
+}
@@ -0,0 +1,258 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/opencap/go-server/auth"
+	"github.com/opencap/go-server/database"
+	"github.com/opencap/go-server/logging"
+)
+
+const maxPoolSize = 1000
+const defaultLowWatermark = 5
+
+type putAddressPoolRequest struct {
+	Addresses    []string `json:"addresses"`
+	Mode         string   `json:"mode"`
+	LowWatermark *int     `json:"low_watermark"`
+}
+
+type addressPoolResponse struct {
+	AddressType  int    `json:"address_type"`
+	Mode         string `json:"mode"`
+	Available    int    `json:"available"`
+	LowWatermark int    `json:"low_watermark"`
+	Low          bool   `json:"low"`
+}
+
+func validatePutAddressPoolParams(req *http.Request, cfg Config) (database.AddressPool, []string, error) {
+	addressType, err := validateDeleteAddressParams(req)
+	if err != nil {
+		return database.AddressPool{}, nil, err
+	}
+
+	params := putAddressPoolRequest{}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return database.AddressPool{}, nil, errors.New("Error parsing request")
+	}
+	err = json.Unmarshal(body, &params)
+	if err != nil {
+		return database.AddressPool{}, nil, errors.New("Error parsing request")
+	}
+
+	if len(params.Addresses) == 0 || len(params.Addresses) > maxPoolSize {
+		return database.AddressPool{}, nil, fmt.Errorf("A pool must have between 1 and %v addresses", maxPoolSize)
+	}
+
+	switch params.Mode {
+	case "":
+		params.Mode = database.PoolModeRoundRobin
+	case database.PoolModeRoundRobin, database.PoolModeUseOnce:
+	default:
+		return database.AddressPool{}, nil, errors.New("mode must be " + database.PoolModeRoundRobin + " or " + database.PoolModeUseOnce)
+	}
+
+	lowWatermark := defaultLowWatermark
+	if params.LowWatermark != nil {
+		lowWatermark = *params.LowWatermark
+	}
+	if lowWatermark < 0 {
+		return database.AddressPool{}, nil, errors.New("low_watermark can't be negative")
+	}
+
+	// A use once address uploaded twice would be served twice
+	addresses := make([]string, 0, len(params.Addresses))
+	seen := make(map[string]int, len(params.Addresses))
+	for i, v := range params.Addresses {
+		address, err := cfg.addressTypes.Validate(addressType, v)
+		if err != nil {
+			return database.AddressPool{}, nil, fmt.Errorf("Invalid address format at index %v: %v", i, err)
+		}
+		if first, ok := seen[address]; ok {
+			return database.AddressPool{}, nil, fmt.Errorf("Address at index %v is the same as the one at index %v", i, first)
+		}
+		seen[address] = i
+		addresses = append(addresses, address)
+	}
+
+	pool := database.AddressPool{
+		AddressType:  addressType,
+		Mode:         params.Mode,
+		LowWatermark: lowWatermark,
+	}
+	return pool, addresses, nil
+}
+
+func (cfg Config) poolToResponse(pool database.AddressPool) (addressPoolResponse, error) {
+	available, err := cfg.db.CountAvailablePooledAddresses(pool)
+	if err != nil {
+		return addressPoolResponse{}, err
+	}
+	return addressPoolResponse{
+		AddressType:  pool.AddressType,
+		Mode:         pool.Mode,
+		Available:    available,
+		LowWatermark: pool.LowWatermark,
+		// Round robin pools never run out
+		Low: pool.Mode == database.PoolModeUseOnce && available <= pool.LowWatermark,
+	}, nil
+}
+
+func (cfg Config) putAddressPoolHandler(w http.ResponseWriter, req *http.Request) {
+	pool, addresses, err := validatePutAddressPoolParams(req, cfg)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, authorization, err := cfg.authorizeScope(req, auth.ScopeUpdateAddresses, pool.AddressType)
+	if err == errAPIKeyNotAllowed {
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid login credentials")
+		return
+	}
+
+	previous, _ := cfg.db.GetAddressByAddressType(user, pool.AddressType)
+	address := database.Address{AddressType: pool.AddressType, Address: addresses[0]}
+	err = cfg.changeAddresses(req, authorization, user, database.AddressChangePool, address, database.ExtendedKey{}, func(cfg Config) error {
+		if err := cfg.db.ReplaceAddressPool(&user, pool, addresses); err != nil {
+			return errors.New("Couldn't update address pool")
+		}
+
+		// A pool replaces an extended key, the address is kept so lookups
+		// of the type find it
+		if key, err := cfg.db.GetExtendedKey(user, pool.AddressType); err == nil {
+			if err := cfg.db.DeleteExtendedKey(key); err != nil {
+				return errors.New("Couldn't delete extended key")
+			}
+		}
+		if err := cfg.db.CreateOrUpdateAddress(&user, address); err != nil {
+			return errors.New("Couldn't update address")
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg.auditAddress(req, actor(authorization), "update_pool", user, pool.AddressType, addressValue(previous), strings.Join(addresses, "\n"))
+
+	pool, err = cfg.db.GetAddressPool(user, pool.AddressType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp, err := cfg.poolToResponse(pool)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg Config) getAddressPoolHandler(w http.ResponseWriter, req *http.Request) {
+	addressType, err := validateDeleteAddressParams(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, _, err := cfg.authorizeScope(req, auth.ScopeReadAddresses, addressType)
+	if err == errAPIKeyNotAllowed {
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid login credentials")
+		return
+	}
+
+	pool, err := cfg.db.GetAddressPool(user, addressType)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Address pool not found")
+		return
+	}
+	resp, err := cfg.poolToResponse(pool)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg Config) deleteAddressPoolHandler(w http.ResponseWriter, req *http.Request) {
+	addressType, err := validateDeleteAddressParams(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, authorization, err := cfg.authorizeScope(req, auth.ScopeDeleteAddresses, addressType)
+	if err == errAPIKeyNotAllowed {
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid login credentials")
+		return
+	}
+
+	pool, err := cfg.db.GetAddressPool(user, addressType)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Address pool not found")
+		return
+	}
+	err = cfg.changeAddresses(req, authorization, user, database.AddressChangeDeletePool, database.Address{AddressType: addressType}, database.ExtendedKey{}, func(cfg Config) error {
+		if err := cfg.db.DeleteAddressPool(pool); err != nil {
+			return errors.New("Couldn't delete address pool")
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg.auditAddress(req, actor(authorization), "delete_pool", user, addressType, "", "")
+
+	var empty struct{}
+	respondWithJSON(w, http.StatusOK, empty)
+}
+
+// servePooledAddress replaces an address published as a pool with the next
+// pooled address. It returns false if the type has no pool.
+func (cfg Config) servePooledAddress(req *http.Request, user database.User, address *database.Address) (bool, error) {
+	pool, err := cfg.db.GetAddressPool(user, address.AddressType)
+	if err != nil {
+		return false, nil // not published as a pool
+	}
+
+	pooled, err := cfg.db.NextPooledAddress(pool)
+	if err != nil {
+		if err == database.ErrPoolEmpty {
+			logging.FromRequest(req).Warn("Address pool is empty", "alias", user.Username+"$"+user.Domain, "address_type", pool.AddressType)
+		}
+		return true, err
+	}
+
+	if pool.Mode == database.PoolModeUseOnce {
+		available, err := cfg.db.CountAvailablePooledAddresses(pool)
+		if err == nil && available <= pool.LowWatermark {
+			logging.FromRequest(req).Warn("Address pool is running low", "alias", user.Username+"$"+user.Domain, "address_type", pool.AddressType, "available", available)
+		}
+	}
+
+	if pooled.Address == address.Address {
+		return true, nil
+	}
+	address.Address = pooled.Address
+	return true, cfg.db.CreateOrUpdateAddress(&user, *address)
+}
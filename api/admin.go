@@ -0,0 +1,318 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/opencap/go-server/auth"
+	"github.com/opencap/go-server/database"
+)
+
+const defaultAdminPageSize = 50
+const maxAdminPageSize = 200
+
+type adminUserResponse struct {
+	ID        uint                   `json:"id"`
+	Alias     string                 `json:"alias"`
+	Disabled  bool                   `json:"disabled"`
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
+	Addresses []getAddressesResponse `json:"addresses,omitempty"`
+}
+
+type adminUsersResponse struct {
+	Users   []adminUserResponse `json:"users"`
+	Total   int                 `json:"total"`
+	Page    int                 `json:"page"`
+	PerPage int                 `json:"per_page"`
+}
+
+type adminActionsResponse struct {
+	Actions []database.AdminAction `json:"actions"`
+	Total   int                    `json:"total"`
+	Page    int                    `json:"page"`
+	PerPage int                    `json:"per_page"`
+}
+
+type adminResetPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+func userToAdminResponse(user database.User) adminUserResponse {
+	return adminUserResponse{
+		ID:        user.ID,
+		Alias:     user.Username + "$" + user.Domain,
+		Disabled:  user.Disabled,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+	}
+}
+
+// requireAdmin only lets requests through that carry the ADMIN_TOKEN as a
+// bearer token
+func (cfg Config) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		splitAuth := strings.Split(req.Header.Get("Authorization"), " ")
+		if len(splitAuth) < 2 || splitAuth[0] != "Bearer" ||
+			subtle.ConstantTimeCompare([]byte(splitAuth[1]), []byte(cfg.adminToken)) != 1 {
+			respondWithError(w, http.StatusUnauthorized, "Invalid admin credentials")
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// recordAdminAction stores an admin action before it is carried out, so
+// nothing happens through the admin API without a record of it
+func (cfg Config) recordAdminAction(req *http.Request, action string, user database.User) error {
+	record := database.AdminAction{
+		Action:     action,
+		UserID:     user.ID,
+		RemoteAddr: req.RemoteAddr,
+	}
+	if user.ID != 0 {
+		record.Alias = user.Username + "$" + user.Domain
+	}
+	if err := cfg.db.CreateAdminAction(&record); err != nil {
+		return err
+	}
+	cfg.audit(req, "admin", action, user)
+	return nil
+}
+
+func validatePaginationParams(req *http.Request) (int, int, error) {
+	params := req.URL.Query()
+
+	page := 1
+	if v := params.Get("page"); v != "" {
+		var err error
+		page, err = strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return 0, 0, errors.New("page must be a number greater than 0")
+		}
+	}
+
+	perPage := defaultAdminPageSize
+	if v := params.Get("per_page"); v != "" {
+		var err error
+		perPage, err = strconv.Atoi(v)
+		if err != nil || perPage < 1 || perPage > maxAdminPageSize {
+			return 0, 0, errors.New("per_page must be a number between 1 and " + strconv.Itoa(maxAdminPageSize))
+		}
+	}
+	return page, perPage, nil
+}
+
+// adminUserFromRequest returns the user identified by the {id} route variable
+func (cfg Config) adminUserFromRequest(req *http.Request) (database.User, int, error) {
+	id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 32)
+	if err != nil {
+		return database.User{}, http.StatusBadRequest, errors.New("User id must be a number")
+	}
+	user, err := cfg.db.GetUser(uint(id))
+	if err != nil {
+		return database.User{}, http.StatusNotFound, errors.New("User not found")
+	}
+	return user, http.StatusOK, nil
+}
+
+func (cfg Config) adminListUsersHandler(w http.ResponseWriter, req *http.Request) {
+	page, perPage, err := validatePaginationParams(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := cfg.recordAdminAction(req, "list_users", database.User{}); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record admin action")
+		return
+	}
+
+	users, total, err := cfg.db.ListUsers(req.URL.Query().Get("search"), (page-1)*perPage, perPage)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := adminUsersResponse{
+		Users:   make([]adminUserResponse, 0, len(users)),
+		Total:   total,
+		Page:    page,
+		PerPage: perPage,
+	}
+	for _, v := range users {
+		resp.Users = append(resp.Users, userToAdminResponse(v))
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg Config) adminGetUserHandler(w http.ResponseWriter, req *http.Request) {
+	user, code, err := cfg.adminUserFromRequest(req)
+	if err != nil {
+		respondWithError(w, code, err.Error())
+		return
+	}
+
+	if err := cfg.recordAdminAction(req, "view_user", user); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record admin action")
+		return
+	}
+
+	addresses, err := cfg.db.GetAddresses(user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := userToAdminResponse(user)
+	resp.Addresses = make([]getAddressesResponse, 0, len(addresses))
+	for _, v := range addresses {
+		resp.Addresses = append(resp.Addresses, toGetAddressesResponse(v))
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg Config) adminDeleteUserHandler(w http.ResponseWriter, req *http.Request) {
+	user, code, err := cfg.adminUserFromRequest(req)
+	if err != nil {
+		respondWithError(w, code, err.Error())
+		return
+	}
+
+	if err := cfg.recordAdminAction(req, "delete_user", user); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record admin action")
+		return
+	}
+
+	err = cfg.db.DeleteUser(user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var empty struct{}
+	respondWithJSON(w, http.StatusOK, empty)
+}
+
+func (cfg Config) adminSetUserDisabled(w http.ResponseWriter, req *http.Request, disabled bool) {
+	user, code, err := cfg.adminUserFromRequest(req)
+	if err != nil {
+		respondWithError(w, code, err.Error())
+		return
+	}
+
+	action := "enable_user"
+	if disabled {
+		action = "disable_user"
+	}
+	if err := cfg.recordAdminAction(req, action, user); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record admin action")
+		return
+	}
+
+	user.Disabled = disabled
+	err = cfg.db.SetUserDisabled(user, disabled)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if disabled {
+		err = cfg.db.RevokeUserSessions(user)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, userToAdminResponse(user))
+}
+
+func (cfg Config) adminDisableUserHandler(w http.ResponseWriter, req *http.Request) {
+	cfg.adminSetUserDisabled(w, req, true)
+}
+
+func (cfg Config) adminEnableUserHandler(w http.ResponseWriter, req *http.Request) {
+	cfg.adminSetUserDisabled(w, req, false)
+}
+
+func (cfg Config) adminResetPasswordHandler(w http.ResponseWriter, req *http.Request) {
+	user, code, err := cfg.adminUserFromRequest(req)
+	if err != nil {
+		respondWithError(w, code, err.Error())
+		return
+	}
+
+	params := adminResetPasswordRequest{}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Error reading request")
+		return
+	}
+	err = json.Unmarshal(body, &params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing request")
+		return
+	}
+	if !auth.ValidatePassword(params.Password) {
+		respondWithError(w, http.StatusBadRequest, "Invalid password format")
+		return
+	}
+
+	if err := cfg.recordAdminAction(req, "reset_password", user); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record admin action")
+		return
+	}
+
+	user.Password, err = auth.HashPassword(params.Password, cfg.passwordHashing)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = cfg.db.SetUserPassword(user, user.Password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = cfg.db.RevokeUserSessions(user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var empty struct{}
+	respondWithJSON(w, http.StatusOK, empty)
+}
+
+func (cfg Config) adminListActionsHandler(w http.ResponseWriter, req *http.Request) {
+	page, perPage, err := validatePaginationParams(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := cfg.recordAdminAction(req, "list_admin_actions", database.User{}); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record admin action")
+		return
+	}
+
+	actions, total, err := cfg.db.GetAdminActions((page-1)*perPage, perPage)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := adminActionsResponse{
+		Actions: actions,
+		Total:   total,
+		Page:    page,
+		PerPage: perPage,
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
@@ -1,18 +1,22 @@
 package api
 
 import (
-	"context"
 	"errors"
-	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	opencap "github.com/opencap/go-opencap"
+	"github.com/opencap/go-server/addresstype"
+	"github.com/opencap/go-server/audit"
+	"github.com/opencap/go-server/auth"
 	"github.com/opencap/go-server/database"
+	"github.com/opencap/go-server/logging"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -20,9 +24,24 @@ import (
 type Config struct {
 	db                 database.Database
 	jwtExpirationTime  time.Duration
-	jwtSecret          string
+	jwtKeys            *auth.KeySet
+	refreshExpiration  time.Duration
+	passwordHashing    auth.PasswordHashing
 	createUserPassword string
-	domainName         string
+	domains            map[string]domainPolicy
+	addressTypes       *addresstype.Registry
+	adminToken         string
+	addressKeys        *auth.KeySet // nil if address responses aren't signed
+	auditLog           *audit.Logger
+	metrics            *apiMetrics
+	certCache          autocert.Cache // nil unless certificates are managed by autocert
+	jwtConfigErr       error          // the API isn't served if the JWT config is invalid
+}
+
+// domainPolicy is how users can be created on a hosted domain
+type domainPolicy struct {
+	closed             bool
+	createUserPassword string // overrides Config.createUserPassword if set
 }
 
 // InitDB get a connection to the database
@@ -72,88 +91,398 @@ func (cfg *Config) intJWTConfig() error {
 	}
 	cfg.jwtExpirationTime = time.Duration(jwtExpirationMinutes) * time.Minute
 
-	cfg.jwtSecret = os.Getenv("JWT_SECRET")
-	if len(cfg.jwtSecret) < 1 {
+	// Tokens are signed with JWT_SIGNING_KEY if it's set and JWT_SECRET
+	// otherwise. Both, and the keys in JWT_VERIFICATION_KEYS, are accepted so
+	// tokens signed before a rotation stay valid until they expire.
+	secret := os.Getenv("JWT_SECRET")
+	verification := make([]auth.Key, 0)
+	if secret != "" {
+		verification = append(verification, auth.HMACKey(secret))
+	}
+	for _, path := range splitList(os.Getenv("JWT_VERIFICATION_KEYS")) {
+		key, err := auth.LoadKeyFile(path)
+		if err != nil {
+			return errors.New("Couldn't load " + path + " in JWT_VERIFICATION_KEYS: " + err.Error())
+		}
+		verification = append(verification, key)
+	}
+
+	signing := auth.HMACKey(secret)
+	if path := os.Getenv("JWT_SIGNING_KEY"); path != "" {
+		signing, err = auth.LoadKeyFile(path)
+		if err != nil {
+			return errors.New("Couldn't load JWT_SIGNING_KEY: " + err.Error())
+		}
+		if !signing.CanSign() {
+			return errors.New("JWT_SIGNING_KEY must be a private key")
+		}
+	} else if len(secret) < 1 {
 		return errors.New("JWT_SECRET must be greater than 0")
 	}
+	cfg.jwtKeys, err = auth.NewKeySet(signing, verification...)
+	if err != nil {
+		return err
+	}
+
+	cfg.refreshExpiration = defaultRefreshExpirationDays * 24 * time.Hour
+	if v := os.Getenv("REFRESH_TOKEN_EXPIRATION_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 {
+			return errors.New("REFRESH_TOKEN_EXPIRATION_DAYS must be greater than 0")
+		}
+		cfg.refreshExpiration = time.Duration(days) * 24 * time.Hour
+	}
+	// A session's access tokens stop working once it expires
+	if cfg.refreshExpiration < cfg.jwtExpirationTime {
+		return errors.New("REFRESH_TOKEN_EXPIRATION_DAYS must be longer than JWT_EXPIRATION_MINUTES")
+	}
 	return nil
 }
 
+// initPasswordHashing loads how new password hashes are made.
+// PASSWORD_HASH_SCHEME is argon2id (the default) or bcrypt, and the
+// parameters of each can be tuned.
+func (cfg *Config) initPasswordHashing() error {
+	cfg.passwordHashing = auth.DefaultPasswordHashing()
+	if v := os.Getenv("PASSWORD_HASH_SCHEME"); v != "" {
+		cfg.passwordHashing.Scheme = v
+	}
+
+	params := []struct {
+		env  string
+		bits int
+		set  func(uint64)
+	}{
+		{"ARGON2_TIME", 32, func(v uint64) { cfg.passwordHashing.Argon2Time = uint32(v) }},
+		{"ARGON2_MEMORY_KIB", 32, func(v uint64) { cfg.passwordHashing.Argon2Memory = uint32(v) }},
+		{"ARGON2_THREADS", 8, func(v uint64) { cfg.passwordHashing.Argon2Threads = uint8(v) }},
+		{"BCRYPT_COST", 8, func(v uint64) { cfg.passwordHashing.BcryptCost = int(v) }},
+	}
+	for _, p := range params {
+		s := os.Getenv(p.env)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(s, 10, p.bits)
+		if err != nil {
+			return errors.New(p.env + " must be a positive number")
+		}
+		p.set(v)
+	}
+	return cfg.passwordHashing.Validate()
+}
+
+const minCreateUserPasswordLength = 8
+
+// initAuthPassword loads the CREATE_USER_PASSWORD shared by every open domain
+// that doesn't have its own. It's optional, without it users can only be
+// created with invite codes.
 func (cfg *Config) initAuthPassword() error {
 	cfg.createUserPassword = os.Getenv("CREATE_USER_PASSWORD")
-	const minLength = 8
-	if len(cfg.createUserPassword) < minLength {
-		return errors.New("CREATE_USER_PASSWORD must be longer than " + string(minLength) + " characters")
+	if cfg.createUserPassword != "" && len(cfg.createUserPassword) < minCreateUserPasswordLength {
+		return errors.New("CREATE_USER_PASSWORD must be longer than " + strconv.Itoa(minCreateUserPasswordLength) + " characters")
 	}
 	return nil
 }
 
-func (cfg *Config) initDomainName() error {
-	cfg.domainName = os.Getenv("DOMAIN_NAME")
-	if !opencap.ValidateDomain(cfg.domainName) {
-		return errors.New("Invalid DOMAIN_NAME in .env")
+// initDomains loads the domains hosted by this server from the comma
+// separated DOMAIN_NAMES, or DOMAIN_NAME for a single domain. Users can't be
+// created on domains listed in CLOSED_DOMAINS, and a domain can have its own
+// create user password in CREATE_USER_PASSWORD_<DOMAIN> where <DOMAIN> is
+// the upper cased domain with dots and dashes replaced by underscores.
+func (cfg *Config) initDomains() error {
+	names := os.Getenv("DOMAIN_NAMES")
+	if names == "" {
+		names = os.Getenv("DOMAIN_NAME")
+	}
+
+	cfg.domains = make(map[string]domainPolicy)
+	for _, name := range splitList(names) {
+		if !opencap.ValidateDomain(name) {
+			return errors.New("Invalid domain " + name + " in DOMAIN_NAMES")
+		}
+		policy := domainPolicy{
+			createUserPassword: os.Getenv("CREATE_USER_PASSWORD_" + domainEnvSuffix(name)),
+		}
+		if policy.createUserPassword != "" && len(policy.createUserPassword) < minCreateUserPasswordLength {
+			return errors.New("CREATE_USER_PASSWORD_" + domainEnvSuffix(name) + " must be longer than " + strconv.Itoa(minCreateUserPasswordLength) + " characters")
+		}
+		cfg.domains[name] = policy
+	}
+	if len(cfg.domains) == 0 {
+		return errors.New("No DOMAIN_NAMES in env")
+	}
+
+	for _, name := range splitList(os.Getenv("CLOSED_DOMAINS")) {
+		policy, ok := cfg.domains[name]
+		if !ok {
+			return errors.New("CLOSED_DOMAINS contains " + name + " which isn't in DOMAIN_NAMES")
+		}
+		policy.closed = true
+		cfg.domains[name] = policy
 	}
 	return nil
 }
 
-// Start begins serving the API
-func Start() *http.Server {
-	cfg := Config{}
-	if err := cfg.InitDB(); err != nil {
-		log.Fatal(err.Error())
+// domainNames returns the hosted domains in alphabetical order
+func (cfg Config) domainNames() []string {
+	names := make([]string, 0, len(cfg.domains))
+	for name := range cfg.domains {
+		names = append(names, name)
 	}
-	if !cfg.db.HasTables() {
-		log.Fatal("Database not setup. Please use the \"--setupdatabase\" option")
+	sort.Strings(names)
+	return names
+}
+
+func domainEnvSuffix(domain string) string {
+	return strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(domain))
+}
+
+// splitList splits a comma separated env value, ignoring empty entries
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
 	}
-	if err := cfg.intJWTConfig(); err != nil {
-		log.Fatal(err.Error())
+	return list
+}
+
+// initAdminToken loads the ADMIN_TOKEN used to authenticate the admin API,
+// the admin API is turned off if it isn't set
+func (cfg *Config) initAdminToken() error {
+	cfg.adminToken = os.Getenv("ADMIN_TOKEN")
+	const minLength = 32
+	if cfg.adminToken != "" && len(cfg.adminToken) < minLength {
+		return errors.New("ADMIN_TOKEN must be at least " + strconv.Itoa(minLength) + " characters")
 	}
-	if err := cfg.initAuthPassword(); err != nil {
-		log.Fatal(err.Error())
+	return nil
+}
+
+// initAuditLog starts the audit log, which is also appended to
+// AUDIT_LOG_FILE as JSON lines if it's set
+func (cfg *Config) initAuditLog() error {
+	var err error
+	cfg.auditLog, err = audit.NewLogger(cfg.db, os.Getenv("AUDIT_LOG_FILE"))
+	if err != nil {
+		return errors.New("Couldn't open AUDIT_LOG_FILE: " + err.Error())
 	}
-	if err := cfg.initDomainName(); err != nil {
-		log.Fatal(err.Error())
+	return nil
+}
+
+// InitAddressSigning loads the key address responses are signed with from
+// ADDRESS_SIGNING_KEY, and the keys of earlier signatures from
+// ADDRESS_VERIFICATION_KEYS. Responses aren't signed if it isn't set.
+func (cfg *Config) InitAddressSigning() error {
+	path := os.Getenv("ADDRESS_SIGNING_KEY")
+	if path == "" {
+		return nil
+	}
+	signing, err := auth.LoadKeyFile(path)
+	if err != nil {
+		return errors.New("Couldn't load ADDRESS_SIGNING_KEY: " + err.Error())
+	}
+	if !signing.CanSign() {
+		return errors.New("ADDRESS_SIGNING_KEY must be a private key")
 	}
 
-	r := mux.NewRouter()
+	// Wallets verify the signatures so only published keys make sense
+	verification := make([]auth.Key, 0)
+	for _, path := range splitList(os.Getenv("ADDRESS_VERIFICATION_KEYS")) {
+		key, err := auth.LoadKeyFile(path)
+		if err != nil {
+			return errors.New("Couldn't load " + path + " in ADDRESS_VERIFICATION_KEYS: " + err.Error())
+		}
+		verification = append(verification, key)
+	}
+	for _, key := range append(verification, signing) {
+		if _, err := key.JWK(); err != nil {
+			return errors.New("Address signing keys must be asymmetric: " + err.Error())
+		}
+	}
+
+	cfg.addressKeys, err = auth.NewKeySet(signing, verification...)
+	return err
+}
+
+// AddressKeyDNSRecords returns the TXT records that pin the address signing
+// keys, see InitAddressSigning
+func (cfg *Config) AddressKeyDNSRecords() []string {
+	if cfg.addressKeys == nil {
+		return nil
+	}
+	return cfg.addressKeys.DNSRecords()
+}
+
+// InitAddressTypes builds the set of accepted address types. Types can be
+// restricted with ADDRESS_TYPES_ENABLED and removed with
+// ADDRESS_TYPES_DISABLED, both comma separated lists of IDs. Test network
+// addresses are only accepted if ALLOW_TEST_NETWORKS is "true".
+func (cfg *Config) InitAddressTypes() error {
+	enabled, err := addresstype.ParseIDs(os.Getenv("ADDRESS_TYPES_ENABLED"))
+	if err != nil {
+		return errors.New("Invalid ADDRESS_TYPES_ENABLED in env: " + err.Error())
+	}
+	disabled, err := addresstype.ParseIDs(os.Getenv("ADDRESS_TYPES_DISABLED"))
+	if err != nil {
+		return errors.New("Invalid ADDRESS_TYPES_DISABLED in env: " + err.Error())
+	}
+
+	cfg.addressTypes, err = addresstype.NewRegistry(enabled, disabled)
+	if err != nil {
+		return err
+	}
+	cfg.addressTypes.AllowTestNetworks(os.Getenv("ALLOW_TEST_NETWORKS") == "true")
+	return nil
+}
+
+// AddressTypes returns the address types configured by InitAddressTypes
+func (cfg *Config) AddressTypes() *addresstype.Registry {
+	return cfg.addressTypes
+}
+
+// handleAPI adds the API's routes to r
+func (cfg Config) handleAPI(r *mux.Router) {
 	r.HandleFunc("/v1/addresses", cfg.getAddressHandler).Methods("GET")
 	r.HandleFunc("/v1/auth", cfg.postAuthHandler).Methods("POST")
+	r.HandleFunc("/v1/auth", cfg.deleteAuthHandler).Methods("DELETE")
+	r.HandleFunc("/v1/auth/refresh", cfg.postAuthRefreshHandler).Methods("POST")
+	r.HandleFunc("/.well-known/jwks.json", cfg.getJWKSHandler).Methods("GET")
+	r.HandleFunc("/.well-known/opencap-keys.json", cfg.getAddressKeysHandler).Methods("GET")
+	r.HandleFunc("/v1/users/password", cfg.putPasswordHandler).Methods("PUT")
+	r.HandleFunc("/v1/users/recover", cfg.postRecoverHandler).Methods("POST")
+	r.HandleFunc("/v1/users/recovery_codes", cfg.postAccountRecoveryCodesHandler).Methods("POST")
+	r.HandleFunc("/v1/users/api_keys", cfg.postAPIKeyHandler).Methods("POST")
+	r.HandleFunc("/v1/users/api_keys", cfg.getAPIKeysHandler).Methods("GET")
+	r.HandleFunc("/v1/users/api_keys/{id}", cfg.deleteAPIKeyHandler).Methods("DELETE")
+	r.HandleFunc("/v1/users/audit", cfg.getAuditHandler).Methods("GET")
+	r.HandleFunc("/v1/users/2fa", cfg.postTwoFactorHandler).Methods("POST")
+	r.HandleFunc("/v1/users/2fa", cfg.deleteTwoFactorHandler).Methods("DELETE")
+	r.HandleFunc("/v1/users/2fa/confirm", cfg.postTwoFactorConfirmHandler).Methods("POST")
+	r.HandleFunc("/v1/users/2fa/recovery_codes", cfg.postRecoveryCodesHandler).Methods("POST")
 	r.HandleFunc("/v1/addresses", cfg.putAddressHandler).Methods("PUT")
+	r.HandleFunc("/v1/addresses/history", cfg.getAddressHistoryHandler).Methods("GET")
+	r.HandleFunc("/v1/addresses/history/{id}/restore", cfg.postRestoreAddressHandler).Methods("POST")
 	r.HandleFunc("/v1/users", cfg.deleteUserHandler).Methods("DELETE")
 	r.HandleFunc("/v1/addresses/{address_type}", cfg.deleteAddressesHandler).Methods("DELETE")
+	r.HandleFunc("/v1/addresses/{address_type}/pool", cfg.putAddressPoolHandler).Methods("PUT")
+	r.HandleFunc("/v1/addresses/{address_type}/pool", cfg.getAddressPoolHandler).Methods("GET")
+	r.HandleFunc("/v1/addresses/{address_type}/pool", cfg.deleteAddressPoolHandler).Methods("DELETE")
+
+	if cfg.adminToken != "" {
+		admin := r.PathPrefix("/v1/admin").Subrouter()
+		admin.Use(cfg.requireAdmin)
+		admin.HandleFunc("/users", cfg.adminListUsersHandler).Methods("GET")
+		admin.HandleFunc("/users/{id}", cfg.adminGetUserHandler).Methods("GET")
+		admin.HandleFunc("/users/{id}", cfg.adminDeleteUserHandler).Methods("DELETE")
+		admin.HandleFunc("/users/{id}/disable", cfg.adminDisableUserHandler).Methods("POST")
+		admin.HandleFunc("/users/{id}/enable", cfg.adminEnableUserHandler).Methods("POST")
+		admin.HandleFunc("/users/{id}/password", cfg.adminResetPasswordHandler).Methods("PUT")
+		admin.HandleFunc("/users/{id}/addresses/history", cfg.adminAddressHistoryHandler).Methods("GET")
+		admin.HandleFunc("/actions", cfg.adminListActionsHandler).Methods("GET")
+		admin.HandleFunc("/audit", cfg.adminExportAuditHandler).Methods("GET")
+		admin.HandleFunc("/invites", cfg.adminPostInviteHandler).Methods("POST")
+		admin.HandleFunc("/invites", cfg.adminListInvitesHandler).Methods("GET")
+		admin.HandleFunc("/invites/{id}", cfg.adminDeleteInviteHandler).Methods("DELETE")
+	}
 	r.HandleFunc("/v1/users", cfg.postUserHandler).Methods("POST")
+}
 
+// Start begins serving the API, it exits if the server isn't configured
+// properly or its ports can't be bound
+func Start() *Server {
+	if err := initLogging(); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	cfg := Config{}
+	if err := cfg.InitDB(); err != nil {
+		logging.Default.Fatal(err.Error())
+	}
+	cfg.initMetrics()
+
+	// Neither of these stop the server, so /readyz can report them
+	if !cfg.db.HasTables() {
+		logging.Default.Error("Database not setup. Please use the \"--setupdatabase\" option")
+	}
+	if err := cfg.intJWTConfig(); err != nil {
+		cfg.jwtConfigErr = err
+		logging.Default.Error("Only serving health checks until the JWT config is fixed", "error", err)
+	}
+	if err := cfg.initDomains(); err != nil {
+		logging.Default.Fatal(err.Error())
+	}
+	if err := cfg.initAuthPassword(); err != nil {
+		logging.Default.Fatal(err.Error())
+	}
+	if err := cfg.InitAddressTypes(); err != nil {
+		logging.Default.Fatal(err.Error())
+	}
+	if err := cfg.initAdminToken(); err != nil {
+		logging.Default.Fatal(err.Error())
+	}
+	if err := cfg.initPasswordHashing(); err != nil {
+		logging.Default.Fatal(err.Error())
+	}
+	if err := cfg.InitAddressSigning(); err != nil {
+		logging.Default.Fatal(err.Error())
+	}
+	if err := cfg.initAuditLog(); err != nil {
+		logging.Default.Fatal(err.Error())
+	}
+	cfg.redactSecrets()
 	if os.Getenv("PLATFORM_ENV") == "prod" {
-		hostPolicy := func(ctx context.Context, host string) error {
-			allowedHost := cfg.domainName
-			if host == allowedHost {
-				return nil
-			}
-			return fmt.Errorf("acme/autocert: only %s host is allowed", allowedHost)
+		cfg.certCache = autocert.DirCache("certs")
+	}
+
+	r := mux.NewRouter()
+	r.Use(cfg.metrics.instrument)
+	r.HandleFunc("/healthz", cfg.getHealthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", cfg.getReadyzHandler).Methods("GET")
+	if cfg.jwtConfigErr == nil {
+		cfg.handleAPI(r)
+	}
+	server := newServer(cfg.db, cfg.auditLog)
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		metricsHandler := http.NewServeMux()
+		metricsHandler.Handle("/metrics", cfg.metrics.registry.Handler())
+		if err := server.listen("metrics", addr, newHTTPServer(metricsHandler)); err != nil {
+			logging.Default.Fatal(err.Error())
 		}
+	} else {
+		r.Handle("/metrics", cfg.metrics.registry.Handler()).Methods("GET")
+	}
+
+	if os.Getenv("PLATFORM_ENV") == "prod" {
+		// autocert gets and renews a separate certificate for each domain
 		certManager := autocert.Manager{
 			Prompt:     autocert.AcceptTOS,
-			HostPolicy: hostPolicy,
-			Cache:      autocert.DirCache("certs"),
+			HostPolicy: autocert.HostWhitelist(cfg.domainNames()...),
+			Cache:      cfg.certCache,
 		}
 
-		http.Handle("/", r)
-		go http.ListenAndServe(":http", certManager.HTTPHandler(nil))
-		go http.Serve(certManager.Listener(), nil)
-		fmt.Println("Production OpenCAP server started successfully")
-		return &http.Server{} // Don't use a server struct for production
+		// Port 80 answers ACME challenges and redirects everything else
+		// to HTTPS
+		if err := server.listen("http", ":http", newHTTPServer(certManager.HTTPHandler(nil))); err != nil {
+			logging.Default.Fatal(err.Error())
+		}
+		https := newHTTPServer(logRequests(r))
+		https.TLSConfig = certManager.TLSConfig()
+		if err := server.listen("https", ":https", https); err != nil {
+			logging.Default.Fatal(err.Error())
+		}
+		logging.Default.Info("Production OpenCAP server started successfully")
+		return server
 	}
 
 	testPort := os.Getenv("TEST_PORT")
 	if testPort == "" {
-		log.Fatal("No PORT specified in the environment")
+		logging.Default.Fatal("No PORT specified in the environment")
 	}
-	server := http.Server{
-		Addr:    ":" + testPort,
-		Handler: r,
+	if err := server.listen("api", ":"+testPort, newHTTPServer(logRequests(r))); err != nil {
+		logging.Default.Fatal(err.Error())
 	}
-	go server.ListenAndServe()
-
-	fmt.Println("Listening for requests on localhost:" + testPort)
-	return &server
+	return server
 }
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/opencap/go-server/auth"
+	"github.com/opencap/go-server/database"
+)
+
+const (
+	apiKeyBytes         = 20
+	apiKeyPrefixLength  = len(auth.APIKeyPrefix) + 6
+	maxAPIKeyNameLength = 100
+)
+
+type postAPIKeyRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	AllowedIPs    []string `json:"allowed_ips"`
+	ExpiresInDays uint     `json:"expires_in_days"`
+}
+
+type apiKeyResponse struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	AllowedIPs []string   `json:"allowed_ips"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	Revoked    bool       `json:"revoked"`
+}
+
+type postAPIKeyResponse struct {
+	Key    string         `json:"key"`
+	APIKey apiKeyResponse `json:"api_key"`
+}
+
+type apiKeysResponse struct {
+	APIKeys []apiKeyResponse `json:"api_keys"`
+}
+
+// apiKeyStore looks up API keys for auth.Authorize
+type apiKeyStore struct {
+	db database.Database
+}
+
+func (s apiKeyStore) GetAPIKey(keyHash string) (auth.APIKey, error) {
+	key, err := s.db.GetAPIKeyByHash(keyHash)
+	if err != nil {
+		return auth.APIKey{}, err
+	}
+	user, err := s.db.GetUser(key.UserID)
+	if err != nil {
+		return auth.APIKey{}, err
+	}
+
+	authKey := auth.APIKey{
+		ID:        key.ID,
+		Domain:    user.Domain,
+		Username:  user.Username,
+		ExpiresAt: key.ExpiresAt,
+		Revoked:   key.Revoked,
+	}
+	for _, v := range strings.Fields(key.Scopes) {
+		scope, err := auth.ParseScope(v)
+		if err != nil {
+			return auth.APIKey{}, err
+		}
+		authKey.Scopes = append(authKey.Scopes, scope)
+	}
+	for _, v := range strings.Fields(key.AllowedIPs) {
+		ipNet, err := auth.ParseAllowedIP(v)
+		if err != nil {
+			return auth.APIKey{}, err
+		}
+		authKey.AllowedIPs = append(authKey.AllowedIPs, ipNet)
+	}
+	return authKey, nil
+}
+
+func validatePostAPIKeyParams(req *http.Request, cfg Config) (database.APIKey, error) {
+	params := postAPIKeyRequest{}
+	if err := readJSON(req, &params); err != nil {
+		return database.APIKey{}, err
+	}
+
+	if params.Name == "" || len(params.Name) > maxAPIKeyNameLength {
+		return database.APIKey{}, errors.New("name must be between 1 and " + strconv.Itoa(maxAPIKeyNameLength) + " characters")
+	}
+	if len(params.Scopes) == 0 {
+		return database.APIKey{}, errors.New("An API key needs at least one scope")
+	}
+
+	scopes := make([]string, 0, len(params.Scopes))
+	for _, v := range params.Scopes {
+		scope, err := auth.ParseScope(v)
+		if err != nil {
+			return database.APIKey{}, err
+		}
+		if scope.AddressType != 0 {
+			if _, err := cfg.addressTypes.Get(scope.AddressType); err != nil {
+				return database.APIKey{}, err
+			}
+		}
+		scopes = append(scopes, scope.String())
+	}
+
+	allowedIPs := make([]string, 0, len(params.AllowedIPs))
+	for _, v := range params.AllowedIPs {
+		ipNet, err := auth.ParseAllowedIP(v)
+		if err != nil {
+			return database.APIKey{}, err
+		}
+		allowedIPs = append(allowedIPs, ipNet.String())
+	}
+
+	key := database.APIKey{
+		Name:       params.Name,
+		Scopes:     strings.Join(scopes, " "),
+		AllowedIPs: strings.Join(allowedIPs, " "),
+	}
+	if params.ExpiresInDays > 0 {
+		expiresAt := time.Now().UTC().Add(time.Duration(params.ExpiresInDays) * 24 * time.Hour)
+		key.ExpiresAt = &expiresAt
+	}
+	return key, nil
+}
+
+func apiKeyToResponse(key database.APIKey) apiKeyResponse {
+	return apiKeyResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     strings.Fields(key.Scopes),
+		AllowedIPs: strings.Fields(key.AllowedIPs),
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		Revoked:    key.Revoked,
+	}
+}
+
+// postAPIKeyHandler creates an API key for the logged in user, the key is
+// only ever shown in the response
+func (cfg Config) postAPIKeyHandler(w http.ResponseWriter, req *http.Request) {
+	user, err := cfg.authorizeUser(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	key, err := validatePostAPIKeyParams(req, cfg)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	b, err := randomBytes(apiKeyBytes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	secret := auth.APIKeyPrefix + strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	key.UserID = user.ID
+	key.KeyHash = auth.HashAPIKey(secret)
+	key.Prefix = secret[:apiKeyPrefixLength]
+
+	if err := cfg.db.CreateAPIKey(&key); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg.audit(req, "user", "create_api_key", user)
+
+	respondWithJSON(w, http.StatusOK, postAPIKeyResponse{Key: secret, APIKey: apiKeyToResponse(key)})
+}
+
+// getAPIKeysHandler lists the API keys of the logged in user
+func (cfg Config) getAPIKeysHandler(w http.ResponseWriter, req *http.Request) {
+	user, err := cfg.authorizeUser(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	keys, err := cfg.db.GetAPIKeys(user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := apiKeysResponse{APIKeys: make([]apiKeyResponse, 0, len(keys))}
+	for _, v := range keys {
+		resp.APIKeys = append(resp.APIKeys, apiKeyToResponse(v))
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// deleteAPIKeyHandler revokes one of the logged in user's API keys
+func (cfg Config) deleteAPIKeyHandler(w http.ResponseWriter, req *http.Request) {
+	user, err := cfg.authorizeUser(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "API key id must be a number")
+		return
+	}
+
+	err = cfg.db.RevokeAPIKey(user, uint(id))
+	if err == database.ErrAPIKeyNotFound {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg.audit(req, "user", "revoke_api_key", user)
+
+	var empty struct{}
+	respondWithJSON(w, http.StatusOK, empty)
+}
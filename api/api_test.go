@@ -2,14 +2,39 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/opencap/go-server/addresstype"
+	"github.com/opencap/go-server/auth"
+	"github.com/opencap/go-server/database"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/ed25519"
 )
 
 const serverStartupMillis = 1000
@@ -20,6 +45,66 @@ const testCreateUserPassword = "examplepassword"
 const testBitcoinP2PKHAddress = "1DxBaADfhTSWsevbzDghrhKSqQwsBpuM5A"
 const testDomain = "example.com"
 const TestNanoAddress = "xrb_3xnpp3eh6fhnfztx46ypubizd5q1fgds3dbbkp5ektwut3tumrykyx6u5qpd"
+const testZpub = "zpub6rFR7y4Q2AijBEqTUquhVz398htDFrtymD9xYYfG1m4wAcvPhXNfE3EfH1r1ADqtfSdVCToUG868RvUUkgDKf31mGDtKsAYz2oz2AGutZYs"
+const testZpubAddress0 = "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu"
+const testZpubAddress1 = "bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g"
+const testPoolAddress0 = "1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu"
+const testPoolAddress1 = "1KXrWXciRDZUpQwQmuM1DbwsKDLYAYsVLR"
+const testAdminToken = "8d1f3c5b7a9e2d4f6b8a0c2e4f6a8b0d"
+
+// decodeAddressResponse decodes a single address returned by GET /v1/addresses
+func decodeAddressResponse(t *testing.T, body []byte) getAddressesResponse {
+	var encoded string
+	err := json.Unmarshal(body, &encoded)
+	assert.Nil(t, err)
+	address := getAddressesResponse{}
+	err = json.Unmarshal([]byte(encoded), &address)
+	assert.Nil(t, err)
+	return address
+}
+
+// writeTestAddressKey writes a new EC private key to a temporary file and
+// returns its path
+func writeTestAddressKey(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	f, err := ioutil.TempFile("", "address-key")
+	assert.Nil(t, err)
+	defer f.Close()
+	err = pem.Encode(f, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	assert.Nil(t, err)
+	return f.Name()
+}
+
+// testTOTPCode returns the TOTP code of a secret at a time
+func testTOTPCode(t *testing.T, secret string, at time.Time) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	assert.Nil(t, err)
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:])&0x7fffffff)%1000000)
+}
+
+// resetTestLoginFailures forgets the failed logins made from the test client
+// so later steps aren't locked out
+func resetTestLoginFailures(t *testing.T) {
+	cfg := Config{}
+	err := cfg.InitDB()
+	assert.Nil(t, err)
+	for _, subject := range []string{"ip:127.0.0.1", aliasThrottleSubject(testUsername + "$" + testDomain)} {
+		err = cfg.db.ResetLoginFailures(subject)
+		assert.Nil(t, err)
+	}
+	err = cfg.db.Close()
+	assert.Nil(t, err)
+}
 
 func TestAPISuccess(t *testing.T) {
 	cfg := Config{}
@@ -30,11 +115,43 @@ func TestAPISuccess(t *testing.T) {
 	err = cfg.db.Close()
 	assert.Nil(t, err)
 
+	os.Setenv("ADMIN_TOKEN", testAdminToken)
+	defer os.Unsetenv("ADMIN_TOKEN")
+
+	addressKeyPath := writeTestAddressKey(t)
+	defer os.Remove(addressKeyPath)
+	os.Setenv("ADDRESS_SIGNING_KEY", addressKeyPath)
+	defer os.Unsetenv("ADDRESS_SIGNING_KEY")
+
+	auditLogFile, err := ioutil.TempFile("", "audit")
+	assert.Nil(t, err)
+	auditLogFile.Close()
+	defer os.Remove(auditLogFile.Name())
+	os.Setenv("AUDIT_LOG_FILE", auditLogFile.Name())
+	defer os.Unsetenv("AUDIT_LOG_FILE")
+
 	server := Start()
-	defer server.Shutdown(nil)
+	defer server.Shutdown(context.Background())
 
 	time.Sleep(serverStartupMillis * time.Millisecond) //wait for server to start
 
+	// The server is healthy and ready before any user exists
+	for _, path := range []string{"/healthz", "/readyz"} {
+		resp, err := http.Get("http://127.0.0.1:" + os.Getenv("TEST_PORT") + path)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode, path)
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		health := healthResponse{}
+		err = json.Unmarshal(body, &health)
+		assert.Nil(t, err)
+		assert.Equal(t, "ok", health.Status)
+		if path == "/readyz" {
+			assert.Equal(t, map[string]healthCheck{"database": {Status: "ok"}, "tables": {Status: "ok"}, "jwt_config": {Status: "ok"}}, health.Checks)
+		}
+	}
+
 	// Create a user
 	url := "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/users"
 	params := []byte(`{
@@ -54,6 +171,10 @@ func TestAPISuccess(t *testing.T) {
 	assert.Equal(t, 200, resp.StatusCode)
 	body, err := ioutil.ReadAll(resp.Body)
 	assert.Nil(t, err)
+	accountRecoveryCodes := recoveryCodesResponse{}
+	err = json.Unmarshal(body, &accountRecoveryCodes)
+	assert.Nil(t, err)
+	assert.Equal(t, recoveryCodeCount, len(accountRecoveryCodes.RecoveryCodes))
 
 	// Login to that user
 	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/auth"
@@ -114,6 +235,179 @@ func TestAPISuccess(t *testing.T) {
 	body, err = ioutil.ReadAll(resp.Body)
 	assert.Nil(t, err)
 
+	// Add an extended public key
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses"
+	params = []byte(`{
+		"address_type": 102,
+		"extended_key": "` + testZpub + `"
+		}`)
+
+	req, err = http.NewRequest("PUT", url, bytes.NewBuffer(params))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Each lookup is served the next derived address
+	for _, expected := range []string{testZpubAddress0, testZpubAddress1} {
+		url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses?alias=" + testUsername + "$" + testDomain + "&address_type=102"
+		req, err = http.NewRequest("GET", url, nil)
+		assert.Nil(t, err)
+		resp, err = client.Do(req)
+
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err = ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, decodeAddressResponse(t, body).Address)
+		assert.NotContains(t, string(body), testZpub)
+	}
+
+	// Delete the extended key
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses/102"
+	req, err = http.NewRequest("DELETE", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Publishing the deleted key again doesn't hand out its addresses twice
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses"
+	params = []byte(`{
+		"address_type": 102,
+		"extended_key": "` + testZpub + `"
+		}`)
+
+	req, err = http.NewRequest("PUT", url, bytes.NewBuffer(params))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses?alias=" + testUsername + "$" + testDomain + "&address_type=102"
+	req, err = http.NewRequest("GET", url, nil)
+	assert.Nil(t, err)
+	resp, err = client.Do(req)
+
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.NotContains(t, []string{testZpubAddress0, testZpubAddress1}, decodeAddressResponse(t, body).Address)
+
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses/102"
+	req, err = http.NewRequest("DELETE", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// A pool can't have the same address twice
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses/200/pool"
+	params = []byte(`{
+		"addresses": ["` + testPoolAddress0 + `", "` + testPoolAddress1 + `", "` + testPoolAddress0 + `"],
+		"mode": "use_once"
+		}`)
+
+	req, err = http.NewRequest("PUT", url, bytes.NewBuffer(params))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 400, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), "index 2 is the same as the one at index 0")
+
+	// Upload a use once address pool
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses/200/pool"
+	params = []byte(`{
+		"addresses": ["` + testPoolAddress0 + `", "` + testPoolAddress1 + `"],
+		"mode": "use_once",
+		"low_watermark": 1
+		}`)
+
+	req, err = http.NewRequest("PUT", url, bytes.NewBuffer(params))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	poolResponse := addressPoolResponse{}
+	err = json.Unmarshal(body, &poolResponse)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, poolResponse.Available)
+	assert.False(t, poolResponse.Low)
+
+	// Each pooled address is served once, then the pool is empty
+	for _, expected := range []string{testPoolAddress0, testPoolAddress1} {
+		url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses?alias=" + testUsername + "$" + testDomain + "&address_type=200"
+		req, err = http.NewRequest("GET", url, nil)
+		assert.Nil(t, err)
+		resp, err = client.Do(req)
+
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err = ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, decodeAddressResponse(t, body).Address)
+	}
+
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses?alias=" + testUsername + "$" + testDomain + "&address_type=200"
+	req, err = http.NewRequest("GET", url, nil)
+	assert.Nil(t, err)
+	resp, err = client.Do(req)
+
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// Delete the address and its pool
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses/200"
+	req, err = http.NewRequest("DELETE", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses/200/pool"
+	req, err = http.NewRequest("GET", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 404, resp.StatusCode)
+
 	// Get an address
 	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses?alias=" + testUsername + "$" + testDomain + "&address_type=100"
 	req, err = http.NewRequest("GET", url, bytes.NewBuffer(params))
@@ -127,6 +421,79 @@ func TestAPISuccess(t *testing.T) {
 	body, err = ioutil.ReadAll(resp.Body)
 	assert.Nil(t, err)
 
+	// Formats the address type doesn't have are rejected
+	for _, query := range []string{"&address_type=100&format=cashaddr", "&format=base58"} {
+		resp, err := client.Get("http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses?alias=" + testUsername + "$" + testDomain + query)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, 400, resp.StatusCode, query)
+	}
+
+	// The domain signed the address
+	addressKey, err := auth.LoadKeyFile(addressKeyPath)
+	assert.Nil(t, err)
+	addressKeys, err := auth.NewKeySet(addressKey)
+	assert.Nil(t, err)
+	claims, err := addressKeys.VerifyAddress(decodeAddressResponse(t, body).Signature)
+	assert.Nil(t, err)
+	assert.Equal(t, testUsername+"$"+testDomain, claims.Alias)
+	assert.Equal(t, testBitcoinP2PKHAddress, claims.Address)
+	assert.Equal(t, "", claims.UserSignature)
+
+	// Counter-sign the address, the signature has to match it
+	userPublic, userPrivate, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	userSignature := ed25519.Sign(userPrivate, auth.AddressMessage(testUsername+"$"+testDomain, 100, testBitcoinP2PKHAddress, ""))
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses"
+	for _, v := range []struct {
+		address string
+		status  int
+	}{
+		{testPoolAddress0, 400},
+		{testBitcoinP2PKHAddress, 200},
+	} {
+		params = []byte(`{
+			"address_type": 100,
+			"address": "` + v.address + `",
+			"user_public_key": "` + base64.RawURLEncoding.EncodeToString(userPublic) + `",
+			"user_signature": "` + base64.RawURLEncoding.EncodeToString(userSignature) + `"
+			}`)
+		req, err = http.NewRequest("PUT", url, bytes.NewBuffer(params))
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+		resp, err = client.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, v.status, resp.StatusCode)
+	}
+
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses?alias=" + testUsername + "$" + testDomain + "&address_type=100"
+	resp, err = client.Get(url)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	signedAddress := decodeAddressResponse(t, body)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(userSignature), signedAddress.UserSignature)
+	claims, err = addressKeys.VerifyAddress(signedAddress.Signature)
+	assert.Nil(t, err)
+	assert.Equal(t, signedAddress.UserSignature, claims.UserSignature)
+
+	// The signing key is published
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/.well-known/opencap-keys.json"
+	resp, err = client.Get(url)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	addressJWKS := auth.JWKS{}
+	err = json.Unmarshal(body, &addressJWKS)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(addressJWKS.Keys))
+	assert.Equal(t, addressKey.ID, addressJWKS.Keys[0].KeyID)
+
 	// Get addresses
 	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses?alias=" + testUsername + "$" + testDomain
 	req, err = http.NewRequest("GET", url, bytes.NewBuffer(params))
@@ -142,24 +509,41 @@ func TestAPISuccess(t *testing.T) {
 	assert.Nil(t, err)
 	assert.True(t, len(body) > 0)
 
-	// Delete an address
-	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses/100"
-	req, err = http.NewRequest("DELETE", url, bytes.NewBuffer(params))
+	// Admin requests need the admin token
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/admin/users?search=" + testUsername
+	req, err = http.NewRequest("GET", url, nil)
 	assert.Nil(t, err)
-	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
 	resp, err = client.Do(req)
 
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 401, resp.StatusCode)
+
+	// Find the user as an admin
+	req, err = http.NewRequest("GET", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err = client.Do(req)
+
 	assert.Nil(t, err)
 	defer resp.Body.Close()
 	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	adminUsers := adminUsersResponse{}
+	err = json.Unmarshal(body, &adminUsers)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, adminUsers.Total)
+	assert.Equal(t, 1, len(adminUsers.Users))
+	assert.Equal(t, testUsername+"$"+testDomain, adminUsers.Users[0].Alias)
+	assert.False(t, strings.Contains(string(body), "password"))
+	adminUserURL := "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/admin/users/" + strconv.FormatUint(uint64(adminUsers.Users[0].ID), 10)
 
-	// Delete an address
-	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses/300"
-	req, err = http.NewRequest("DELETE", url, bytes.NewBuffer(params))
+	// Wildcards in the search match themselves
+	req, err = http.NewRequest("GET", "http://127.0.0.1:"+os.Getenv("TEST_PORT")+"/v1/admin/users?search=%25", nil)
 	assert.Nil(t, err)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
 	resp, err = client.Do(req)
 
 	assert.Nil(t, err)
@@ -167,44 +551,1126 @@ func TestAPISuccess(t *testing.T) {
 	assert.Equal(t, 200, resp.StatusCode)
 	body, err = ioutil.ReadAll(resp.Body)
 	assert.Nil(t, err)
+	err = json.Unmarshal(body, &adminUsers)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, adminUsers.Total)
 
-	// Get address and fail
-	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses?alias=" + testUsername + "$" + testDomain + "&address_type=100"
-	req, err = http.NewRequest("GET", url, bytes.NewBuffer(params))
+	// Disable the user, their addresses and logins stop working
+	req, err = http.NewRequest("POST", adminUserURL+"/disable", nil)
 	assert.Nil(t, err)
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
 	resp, err = client.Do(req)
+
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses?alias=" + testUsername + "$" + testDomain + "&address_type=100"
+	resp, err = client.Get(url)
 	assert.Nil(t, err)
 	defer resp.Body.Close()
 	assert.Equal(t, 404, resp.StatusCode)
 
-	// Delete the user
-	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/users"
-	req, err = http.NewRequest("DELETE", url, bytes.NewBuffer(params))
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/auth"
+	params = []byte(`{
+		"alias": "` + testUsername + "$" + testDomain + `",
+		"password": "` + testPassword + `"
+		}`)
+	resp, err = client.Post(url, "application/json", bytes.NewBuffer(params))
 	assert.Nil(t, err)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	defer resp.Body.Close()
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// Enable the user again
+	req, err = http.NewRequest("POST", adminUserURL+"/enable", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
 	resp, err = client.Do(req)
 
 	assert.Nil(t, err)
 	defer resp.Body.Close()
 	assert.Equal(t, 200, resp.StatusCode)
-	body, err = ioutil.ReadAll(resp.Body)
+
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses?alias=" + testUsername + "$" + testDomain + "&address_type=100"
+	resp, err = client.Get(url)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Disabling the user revoked their session
+	refreshURL := "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/auth/refresh"
+	params = []byte(`{"refresh_token": "` + authResponse.RefreshToken + `"}`)
+	resp, err = client.Post(refreshURL, "application/json", bytes.NewBuffer(params))
 	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 401, resp.StatusCode)
 
-	// Fail the login
+	// Login again and refresh the session, the refresh token only works once
 	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/auth"
 	params = []byte(`{
 		"alias": "` + testUsername + "$" + testDomain + `",
 		"password": "` + testPassword + `"
 		}`)
+	resp, err = client.Post(url, "application/json", bytes.NewBuffer(params))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	err = json.Unmarshal(body, &authResponse)
+	assert.Nil(t, err)
+
+	params = []byte(`{"refresh_token": "` + authResponse.RefreshToken + `"}`)
+	resp, err = client.Post(refreshURL, "application/json", bytes.NewBuffer(params))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	refreshed := postAuthResponse{}
+	err = json.Unmarshal(body, &refreshed)
+	assert.Nil(t, err)
+	assert.NotEqual(t, authResponse.RefreshToken, refreshed.RefreshToken)
+
+	resp, err = client.Post(refreshURL, "application/json", bytes.NewBuffer(params))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 401, resp.StatusCode)
+	authResponse = refreshed
+
+	// Logging out of another session leaves this one alone
+	resp, err = client.Post(url, "application/json", bytes.NewBuffer([]byte(`{
+		"alias": "`+testUsername+"$"+testDomain+`",
+		"password": "`+testPassword+`"
+		}`)))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	otherSession := postAuthResponse{}
+	err = json.Unmarshal(body, &otherSession)
+	assert.Nil(t, err)
+
+	for _, status := range []int{200, 400} {
+		req, err = http.NewRequest("DELETE", url, nil)
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer "+otherSession.Token)
+		resp, err = client.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode)
+	}
+
+	// The admin actions were recorded
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/admin/actions"
+	req, err = http.NewRequest("GET", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err = client.Do(req)
 
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	adminActions := adminActionsResponse{}
+	err = json.Unmarshal(body, &adminActions)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, adminActions.Total)
+	assert.Equal(t, "list_admin_actions", adminActions.Actions[0].Action)
+
+	// Create an invite code for a single user
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/admin/invites"
+	params = []byte(`{"username": "invited", "max_uses": 1, "expires_in_hours": 24}`)
 	req, err = http.NewRequest("POST", url, bytes.NewBuffer(params))
 	assert.Nil(t, err)
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
 	resp, err = client.Do(req)
 
 	assert.Nil(t, err)
 	defer resp.Body.Close()
-	assert.Equal(t, 400, resp.StatusCode)
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	invite := postInviteResponse{}
+	err = json.Unmarshal(body, &invite)
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", invite.Code)
+
+	// The invite code only works for its username, and only once
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/users"
+	for _, v := range []struct {
+		username string
+		status   int
+	}{{"someoneelse", 400}, {"invited", 200}, {"invited", 400}} {
+		params = []byte(`{
+			"alias": "` + v.username + `$` + testDomain + `",
+			"password": "` + testPassword + `",
+			"invite_code": "` + invite.Code + `"
+			}`)
+		resp, err = client.Post(url, "application/json", bytes.NewBuffer(params))
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, v.status, resp.StatusCode)
+	}
+
+	// Create API keys, one for Bitcoin addresses only and one that can
+	// only be used from another IP address
+	apiKeys := make([]postAPIKeyResponse, 0)
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/users/api_keys"
+	for _, v := range []string{
+		`{"name": "processor", "scopes": ["addresses:update:100"], "expires_in_days": 30}`,
+		`{"name": "elsewhere", "scopes": ["addresses:update"], "allowed_ips": ["10.0.0.1"]}`,
+	} {
+		req, err = http.NewRequest("POST", url, bytes.NewBufferString(v))
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+		resp, err = client.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err = ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		apiKey := postAPIKeyResponse{}
+		err = json.Unmarshal(body, &apiKey)
+		assert.Nil(t, err)
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	// API keys can only do what their scopes allow, from their IP addresses
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses"
+	for _, v := range []struct {
+		key    string
+		params string
+		status int
+	}{
+		{apiKeys[0].Key, `{"address_type": 100, "address": "` + testBitcoinP2PKHAddress + `"}`, 200},
+		{apiKeys[0].Key, `{"address_type": 300, "address": "` + TestNanoAddress + `"}`, 403},
+		{apiKeys[1].Key, `{"address_type": 100, "address": "` + testBitcoinP2PKHAddress + `"}`, 400},
+	} {
+		req, err = http.NewRequest("PUT", url, bytes.NewBufferString(v.params))
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer "+v.key)
+		resp, err = client.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, v.status, resp.StatusCode)
+	}
+
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses/100"
+	req, err = http.NewRequest("DELETE", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+apiKeys[0].Key)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// API keys can't manage the account
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/users/api_keys"
+	req, err = http.NewRequest("GET", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+apiKeys[0].Key)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// List the API keys
+	req, err = http.NewRequest("GET", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	listedAPIKeys := apiKeysResponse{}
+	err = json.Unmarshal(body, &listedAPIKeys)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(listedAPIKeys.APIKeys))
+	assert.Equal(t, []string{"addresses:update:100"}, listedAPIKeys.APIKeys[0].Scopes)
+	assert.Equal(t, []string{"10.0.0.1/32"}, listedAPIKeys.APIKeys[1].AllowedIPs)
+	assert.True(t, strings.HasPrefix(apiKeys[0].Key, listedAPIKeys.APIKeys[0].Prefix))
+
+	// Revoke an API key, it stops working
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/users/api_keys/" + strconv.FormatUint(uint64(apiKeys[0].APIKey.ID), 10)
+	req, err = http.NewRequest("DELETE", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses"
+	req, err = http.NewRequest("PUT", url, bytes.NewBufferString(`{"address_type": 100, "address": "`+testBitcoinP2PKHAddress+`"}`))
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+apiKeys[0].Key)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// Delete an address
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses/100"
+	req, err = http.NewRequest("DELETE", url, bytes.NewBuffer(params))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Delete an address
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses/300"
+	req, err = http.NewRequest("DELETE", url, bytes.NewBuffer(params))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	// Get address and fail
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses?alias=" + testUsername + "$" + testDomain + "&address_type=100"
+	req, err = http.NewRequest("GET", url, bytes.NewBuffer(params))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// The address history kept every change, including the delete
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses/history?address_type=100"
+	req, err = http.NewRequest("GET", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	history := addressHistoryResponse{}
+	err = json.Unmarshal(body, &history)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, history.Total)
+	assert.Equal(t, 4, len(history.Changes))
+	assert.Equal(t, "delete", history.Changes[0].Action)
+	assert.Equal(t, "api_key:"+strconv.FormatUint(uint64(apiKeys[0].APIKey.ID), 10), history.Changes[1].Actor)
+	assert.Equal(t, "user", history.Changes[2].Actor)
+	assert.Equal(t, testBitcoinP2PKHAddress, history.Changes[2].Address)
+	assert.Equal(t, "127.0.0.1", history.Changes[2].RemoteAddr)
+
+	// The history shows which extended key was published
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses/history?address_type=102"
+	req, err = http.NewRequest("GET", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	keyHistory := addressHistoryResponse{}
+	err = json.Unmarshal(body, &keyHistory)
+	assert.Nil(t, err)
+	assert.Equal(t, testZpub, keyHistory.Changes[len(keyHistory.Changes)-1].ExtendedKey)
+
+	// Restore the counter-signed address, deletes can't be restored
+	for _, v := range []struct {
+		id     uint
+		status int
+	}{
+		{history.Changes[0].ID, 400},
+		{history.Changes[2].ID, 200},
+	} {
+		url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses/history/" + strconv.FormatUint(uint64(v.id), 10) + "/restore"
+		req, err = http.NewRequest("POST", url, nil)
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+		resp, err = client.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, v.status, resp.StatusCode)
+	}
+
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses?alias=" + testUsername + "$" + testDomain + "&address_type=100"
+	resp, err = client.Get(url)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	restoredAddress := decodeAddressResponse(t, body)
+	assert.Equal(t, testBitcoinP2PKHAddress, restoredAddress.Address)
+	assert.Equal(t, history.Changes[2].UserSignature, restoredAddress.UserSignature)
+
+	// Admins can read the history too
+	req, err = http.NewRequest("GET", adminUserURL+"/addresses/history", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	history = addressHistoryResponse{}
+	err = json.Unmarshal(body, &history)
+	assert.Nil(t, err)
+	assert.Equal(t, "restore", history.Changes[0].Action)
+
+	// Both the restore and the admin reading the history were audited
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/users/audit"
+	req, err = http.NewRequest("GET", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	auditEvents := auditEventsResponse{}
+	err = json.Unmarshal(body, &auditEvents)
+	assert.Nil(t, err)
+	assert.Equal(t, "view_address_history", auditEvents.Events[0].Action)
+	assert.Equal(t, "admin", auditEvents.Events[0].Actor)
+	assert.Equal(t, "restore_address", auditEvents.Events[1].Action)
+	assert.Equal(t, 100, auditEvents.Events[1].AddressType)
+	assert.NotEqual(t, "", auditEvents.Events[1].NewValueHash)
+	assert.NotEqual(t, auditEvents.Events[1].OldValueHash, auditEvents.Events[1].NewValueHash)
+	assert.Equal(t, testUsername+"$"+testDomain, auditEvents.Events[1].Alias)
+
+	// Admins can export the whole log as JSON lines
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/admin/audit?user_id=" + strconv.FormatUint(uint64(auditEvents.Events[0].UserID), 10)
+	req, err = http.NewRequest("GET", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	assert.True(t, len(lines) >= auditEvents.Total)
+	firstEvent := database.AuditEvent{}
+	err = json.Unmarshal([]byte(lines[0]), &firstEvent)
+	assert.Nil(t, err)
+	assert.Equal(t, "create_user", firstEvent.Action)
+
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/admin/audit?since=yesterday"
+	req, err = http.NewRequest("GET", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// and every event was appended to AUDIT_LOG_FILE
+	auditLog, err := ioutil.ReadFile(auditLogFile.Name())
+	assert.Nil(t, err)
+	assert.True(t, strings.Count(string(auditLog), "\n") >= len(lines))
+
+	// Metrics were collected for everything so far
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/metrics"
+	resp, err = http.Get(url)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	for _, v := range []string{
+		`opencap_http_requests_total{route="/v1/addresses",method="GET",code="200"} `,
+		`opencap_http_request_duration_seconds_count{route="/v1/admin/users/{id}/addresses/history",method="GET"} `,
+		`opencap_address_lookups_total{address_type="100",result="hit"} `,
+		`opencap_logins_total{result="success"} `,
+		`opencap_database_call_duration_seconds_count{method="GetUserByDomainUsername"} `,
+		"\ngo_goroutines ",
+	} {
+		assert.True(t, strings.Contains(string(body), v), v)
+	}
+
+	// Requests keep the ID they were sent with, it's returned in errors too
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/addresses?alias=nobody$" + testDomain
+	for _, v := range []struct {
+		sent      string
+		preserved bool
+	}{
+		{"trace-1234", true},
+		{"", false},
+		{"not a valid id", false},
+	} {
+		req, err = http.NewRequest("GET", url, nil)
+		assert.Nil(t, err)
+		if v.sent != "" {
+			req.Header.Set("X-Request-ID", v.sent)
+		}
+		resp, err = client.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, 404, resp.StatusCode)
+		id := resp.Header.Get("X-Request-ID")
+		if v.preserved {
+			assert.Equal(t, v.sent, id)
+		} else {
+			assert.Equal(t, 32, len(id))
+		}
+		body, err = ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		errorResponse := map[string]string{}
+		err = json.Unmarshal(body, &errorResponse)
+		assert.Nil(t, err)
+		assert.Equal(t, id, errorResponse["request_id"])
+	}
+
+	// Start 2FA enrollment
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/users/2fa"
+	req, err = http.NewRequest("POST", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	enrollment := postTwoFactorResponse{}
+	err = json.Unmarshal(body, &enrollment)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(enrollment.URI, "otpauth://totp/"))
+
+	// Confirm it with a code, codes of the neighbouring time steps are
+	// accepted so later steps can each use a fresh code
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/users/2fa/confirm"
+	params = []byte(`{"code": "` + testTOTPCode(t, enrollment.Secret, time.Now().Add(-30*time.Second)) + `"}`)
+	req, err = http.NewRequest("POST", url, bytes.NewBuffer(params))
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	recoveryCodes := recoveryCodesResponse{}
+	err = json.Unmarshal(body, &recoveryCodes)
+	assert.Nil(t, err)
+	assert.Equal(t, recoveryCodeCount, len(recoveryCodes.RecoveryCodes))
+
+	// Logging in now needs a code, and each code only works once
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/auth"
+	for _, v := range []struct {
+		otp    string
+		status int
+	}{
+		{"", 401},
+		{"000000", 401},
+		{testTOTPCode(t, enrollment.Secret, time.Now()), 200},
+		{recoveryCodes.RecoveryCodes[0], 200},
+		{recoveryCodes.RecoveryCodes[0], 401},
+	} {
+		params = []byte(`{
+			"alias": "` + testUsername + "$" + testDomain + `",
+			"password": "` + testPassword + `",
+			"otp": "` + v.otp + `"
+			}`)
+		resp, err = client.Post(url, "application/json", bytes.NewBuffer(params))
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, v.status, resp.StatusCode)
+	}
+
+	// Disabling 2FA needs a code too
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/users/2fa"
+	for _, v := range []struct {
+		code   string
+		status int
+	}{
+		{"000000", 401},
+		{testTOTPCode(t, enrollment.Secret, time.Now().Add(30*time.Second)), 200},
+	} {
+		params = []byte(`{"code": "` + v.code + `"}`)
+		req, err = http.NewRequest("DELETE", url, bytes.NewBuffer(params))
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+		resp, err = client.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, v.status, resp.StatusCode)
+	}
+
+	resetTestLoginFailures(t)
+
+	// Changing the password needs the old one
+	const newPassword = "Even@36MoreSecure"
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/users/password"
+	for _, v := range []struct {
+		oldPassword string
+		status      int
+	}{{newPassword, 400}, {testPassword, 200}} {
+		params = []byte(`{"old_password": "` + v.oldPassword + `", "new_password": "` + newPassword + `"}`)
+		req, err = http.NewRequest("PUT", url, bytes.NewBuffer(params))
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+		resp, err = client.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, v.status, resp.StatusCode)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	oldSession := authResponse
+	authResponse = postAuthResponse{}
+	err = json.Unmarshal(body, &authResponse)
+	assert.Nil(t, err)
+
+	// It logged out the old session
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/auth"
+	req, err = http.NewRequest("DELETE", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+oldSession.Token)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// Recover the account with a code from sign up, each code works once
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/users/recover"
+	for _, v := range []struct {
+		code   string
+		status int
+	}{
+		{"aaaa-aaaa-aaaa-aaaa", 400},
+		{accountRecoveryCodes.RecoveryCodes[0], 200},
+		{accountRecoveryCodes.RecoveryCodes[0], 400},
+	} {
+		params = []byte(`{
+			"alias": "` + testUsername + "$" + testDomain + `",
+			"recovery_code": "` + v.code + `",
+			"new_password": "` + testPassword + `"
+			}`)
+		resp, err = client.Post(url, "application/json", bytes.NewBuffer(params))
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, v.status, resp.StatusCode)
+		if v.status == 200 {
+			body, err = ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+			err = json.Unmarshal(body, &authResponse)
+			assert.Nil(t, err)
+		}
+	}
+	resetTestLoginFailures(t)
+
+	// Delete the user
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/users"
+	req, err = http.NewRequest("DELETE", url, bytes.NewBuffer(params))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+authResponse.Token)
+	resp, err = client.Do(req)
+
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	// Fail the login
+	url = "http://127.0.0.1:" + os.Getenv("TEST_PORT") + "/v1/auth"
+	params = []byte(`{
+		"alias": "` + testUsername + "$" + testDomain + `",
+		"password": "` + testPassword + `"
+		}`)
+
+	req, err = http.NewRequest("POST", url, bytes.NewBuffer(params))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = client.Do(req)
+
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestInitDomains(t *testing.T) {
+	env := map[string]string{
+		"DOMAIN_NAMES":                     "example.com, example.org,example.net",
+		"CLOSED_DOMAINS":                   "example.net",
+		"CREATE_USER_PASSWORD_EXAMPLE_ORG": "orgpassword",
+	}
+	for k, v := range env {
+		previous, ok := os.LookupEnv(k)
+		os.Setenv(k, v)
+		if ok {
+			defer os.Setenv(k, previous)
+		} else {
+			defer os.Unsetenv(k)
+		}
+	}
+
+	cfg := Config{}
+	err := cfg.initDomains()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"example.com", "example.net", "example.org"}, cfg.domainNames())
+	assert.False(t, cfg.domains["example.com"].closed)
+	assert.True(t, cfg.domains["example.net"].closed)
+	assert.Equal(t, "orgpassword", cfg.domains["example.org"].createUserPassword)
+	assert.Equal(t, "", cfg.domains["example.com"].createUserPassword)
+
+	os.Setenv("CLOSED_DOMAINS", "example.io")
+	err = cfg.initDomains()
+	assert.NotNil(t, err)
+
+	os.Setenv("CLOSED_DOMAINS", "")
+	os.Setenv("DOMAIN_NAMES", "example.com,not a domain")
+	err = cfg.initDomains()
+	assert.NotNil(t, err)
+}
+
+func TestLoginDelay(t *testing.T) {
+	assert.Equal(t, time.Duration(0), loginDelay(loginFreeFailures))
+	assert.Equal(t, loginBaseDelay, loginDelay(loginFreeFailures+1))
+	assert.Equal(t, 2*loginBaseDelay, loginDelay(loginFreeFailures+2))
+	assert.Equal(t, 4*loginBaseDelay, loginDelay(loginFreeFailures+3))
+	assert.Equal(t, loginMaxDelay, loginDelay(loginFreeFailures+50))
+}
+
+func TestConcurrentLoginAttempts(t *testing.T) {
+	dbFile, err := ioutil.TempFile("", "throttle")
+	assert.Nil(t, err)
+	dbFile.Close()
+	defer os.Remove(dbFile.Name())
+	db, err := database.GetGormConnection(dbFile.Name(), "sqlite3")
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Nil(t, db.CreateTables(true))
+
+	// Attempts are counted before they're made, so concurrent guesses can't
+	// all get in before the lockout
+	cfg := Config{db: db}
+	allowed := make(chan bool, 20)
+	wg := sync.WaitGroup{}
+	for i := 0; i < cap(allowed); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/v1/auth", nil)
+			attempt, wait, err := cfg.beginLoginAttempt(req, "ip:192.0.2.1")
+			if err != nil || wait > 0 {
+				allowed <- false
+				return
+			}
+			defer attempt.end()
+			attempt.fail("wrong password")
+			allowed <- true
+		}()
+	}
+	wg.Wait()
+	close(allowed)
+	count := 0
+	for v := range allowed {
+		if v {
+			count++
+		}
+	}
+	assert.True(t, count >= 1 && count <= loginFreeFailures+1, strconv.Itoa(count))
+
+	// Attempts that don't fail aren't counted
+	for i := 0; i < 2*loginFreeFailures; i++ {
+		attempt, wait, err := cfg.beginLoginAttempt(httptest.NewRequest("POST", "/v1/auth", nil), "ip:192.0.2.2")
+		assert.Nil(t, err)
+		assert.Equal(t, time.Duration(0), wait)
+		attempt.end()
+	}
+}
+
+type testCertCache map[string][]byte
+
+func (c testCertCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if data, ok := c[key]; ok {
+		return data, nil
+	}
+	return nil, autocert.ErrCacheMiss
+}
+
+func (c testCertCache) Put(ctx context.Context, key string, data []byte) error {
+	c[key] = data
+	return nil
+}
+
+func (c testCertCache) Delete(ctx context.Context, key string) error {
+	delete(c, key)
+	return nil
+}
+
+// testCertCacheEntry is a self-signed certificate stored the way autocert
+// stores them
+func testCertCacheEntry(t *testing.T, notAfter time.Time) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{testDomain},
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+}
+
+func TestCheckCertificates(t *testing.T) {
+	cache := testCertCache{}
+	cfg := Config{certCache: cache, domains: map[string]domainPolicy{testDomain: {}, "other.com": {}}}
+	_, err := cfg.checkCertificates(context.Background())
+	assert.NotNil(t, err)
+
+	cache[testDomain] = testCertCacheEntry(t, time.Now().Add(-time.Hour))
+	_, err = cfg.checkCertificates(context.Background())
+	assert.NotNil(t, err)
+
+	// One domain with a certificate is enough, the others are reported
+	cache[testDomain+"+rsa"] = testCertCacheEntry(t, time.Now().Add(time.Hour))
+	missing, err := cfg.checkCertificates(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "No certificate for other.com yet", missing.Error())
+
+	cache["other.com"] = testCertCacheEntry(t, time.Now().Add(time.Hour))
+	missing, err = cfg.checkCertificates(context.Background())
+	assert.Nil(t, err)
+	assert.Nil(t, missing)
+}
+
+func TestReadyzFailures(t *testing.T) {
+	dbFile, err := ioutil.TempFile("", "readyz")
+	assert.Nil(t, err)
+	dbFile.Close()
+	defer os.Remove(dbFile.Name())
+	db, err := database.GetGormConnection(dbFile.Name(), "sqlite3")
+	assert.Nil(t, err)
+	defer db.Close()
+
+	// A database that hasn't been set up and a missing JWT secret are
+	// reported, not fatal
+	cfg := Config{db: db, jwtConfigErr: errors.New("No JWT_SECRET found in env")}
+	w := httptest.NewRecorder()
+	cfg.getReadyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	health := healthResponse{}
+	err = json.Unmarshal(w.Body.Bytes(), &health)
+	assert.Nil(t, err)
+	assert.Equal(t, "unavailable", health.Status)
+	assert.Equal(t, "ok", health.Checks["database"].Status)
+	assert.Equal(t, "failed", health.Checks["tables"].Status)
+	assert.Equal(t, "warning", health.Checks["jwt_config"].Status)
+	assert.Equal(t, "No JWT_SECRET found in env", health.Checks["jwt_config"].Error)
+
+	// Warnings alone don't make the server unavailable
+	assert.Nil(t, db.CreateTables(true))
+	w = httptest.NewRecorder()
+	cfg.getReadyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	health = healthResponse{}
+	err = json.Unmarshal(w.Body.Bytes(), &health)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", health.Status)
+	assert.Equal(t, "warning", health.Checks["jwt_config"].Status)
+}
+
+func TestPoolLow(t *testing.T) {
+	dbFile, err := ioutil.TempFile("", "pool")
+	assert.Nil(t, err)
+	dbFile.Close()
+	defer os.Remove(dbFile.Name())
+	db, err := database.GetGormConnection(dbFile.Name(), "sqlite3")
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Nil(t, db.CreateTables(true))
+
+	// Only use once pools run low, round robin pools are served forever
+	cfg := Config{db: db}
+	user := database.User{Model: database.Model{ID: 1}}
+	for mode, low := range map[string]bool{database.PoolModeUseOnce: true, database.PoolModeRoundRobin: false} {
+		pool := database.AddressPool{AddressType: 200, Mode: mode, LowWatermark: 5}
+		assert.Nil(t, db.ReplaceAddressPool(&user, pool, []string{testPoolAddress0, testPoolAddress1}))
+		pool, err = db.GetAddressPool(user, 200)
+		assert.Nil(t, err)
+
+		resp, err := cfg.poolToResponse(pool)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, resp.Available)
+		assert.Equal(t, low, resp.Low, mode)
+	}
+}
+
+func TestDeleteAddressPool(t *testing.T) {
+	dbFile, err := ioutil.TempFile("", "pool")
+	assert.Nil(t, err)
+	dbFile.Close()
+	defer os.Remove(dbFile.Name())
+	db, err := database.GetGormConnection(dbFile.Name(), "sqlite3")
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Nil(t, db.CreateTables(true))
+
+	user := database.User{Model: database.Model{ID: 1}}
+	pool := database.AddressPool{AddressType: 200, Mode: database.PoolModeRoundRobin}
+	assert.Nil(t, db.ReplaceAddressPool(&user, pool, []string{testPoolAddress0, testPoolAddress1}))
+	assert.Nil(t, db.CreateOrUpdateAddress(&user, database.Address{AddressType: 200, Address: testPoolAddress1}))
+	pool, err = db.GetAddressPool(user, 200)
+	assert.Nil(t, err)
+
+	// The last served address goes with the pool
+	assert.Nil(t, db.DeleteAddressPool(pool))
+	_, err = db.GetAddressPool(user, 200)
+	assert.NotNil(t, err)
+	_, err = db.GetAddressByAddressType(user, 200)
+	assert.NotNil(t, err)
+}
+
+func TestUserUpdatesDontOverwriteEachOther(t *testing.T) {
+	dbFile, err := ioutil.TempFile("", "user")
+	assert.Nil(t, err)
+	dbFile.Close()
+	defer os.Remove(dbFile.Name())
+	db, err := database.GetGormConnection(dbFile.Name(), "sqlite3")
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Nil(t, db.CreateTables(true))
+
+	user := database.User{Username: testUsername, Domain: testDomain, Password: "old"}
+	assert.Nil(t, db.CreateUser(&user))
+
+	// Each request loaded the user before the others wrote theirs
+	stale := user
+	stale.TOTPSecret = "secret"
+	assert.Nil(t, db.SetUserPassword(user, "rehashed"))
+	assert.Nil(t, db.SetUserDisabled(user, true))
+	assert.Nil(t, db.UpdateUserTOTP(stale))
+
+	updated, err := db.GetUser(user.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "rehashed", updated.Password)
+	assert.True(t, updated.Disabled)
+	assert.Equal(t, "secret", updated.TOTPSecret)
+}
+
+func TestDeleteUserKeepsHistory(t *testing.T) {
+	dbFile, err := ioutil.TempFile("", "delete")
+	assert.Nil(t, err)
+	dbFile.Close()
+	defer os.Remove(dbFile.Name())
+	db, err := database.GetGormConnection(dbFile.Name(), "sqlite3")
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Nil(t, db.CreateTables(true))
+
+	user := database.User{Username: testUsername, Domain: testDomain, Password: "x"}
+	assert.Nil(t, db.CreateUser(&user))
+	change := database.AddressChange{UserID: user.ID, AddressType: 100, Action: database.AddressChangeUpdate, Address: testBitcoinP2PKHAddress, Actor: "user"}
+	assert.Nil(t, db.ChangeAddresses(&change, func(tx database.Database) error {
+		return tx.CreateOrUpdateAddress(&user, database.Address{AddressType: 100, Address: testBitcoinP2PKHAddress})
+	}))
+
+	// The history is hidden with the user but stays in the database
+	assert.Nil(t, db.DeleteUser(user))
+	_, err = db.GetUser(user.ID)
+	assert.NotNil(t, err)
+	_, err = db.GetAddressChange(user, change.ID)
+	assert.NotNil(t, err)
+
+	conn, err := sql.Open("sqlite3", dbFile.Name())
+	assert.Nil(t, err)
+	defer conn.Close()
+	var address string
+	assert.Nil(t, conn.QueryRow("SELECT address FROM address_changes WHERE user_id = ? AND deleted_at IS NOT NULL", user.ID).Scan(&address))
+	assert.Equal(t, testBitcoinP2PKHAddress, address)
+}
+
+func TestListAddressesDoesntServePools(t *testing.T) {
+	dbFile, err := ioutil.TempFile("", "list")
+	assert.Nil(t, err)
+	dbFile.Close()
+	defer os.Remove(dbFile.Name())
+	db, err := database.GetGormConnection(dbFile.Name(), "sqlite3")
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Nil(t, db.CreateTables(true))
+	addressTypes, err := addresstype.NewRegistry(nil, nil)
+	assert.Nil(t, err)
+
+	user := database.User{Username: testUsername, Domain: testDomain, Password: "x"}
+	assert.Nil(t, db.CreateUser(&user))
+	assert.Nil(t, db.CreateOrUpdateAddress(&user, database.Address{AddressType: 100, Address: testBitcoinP2PKHAddress}))
+	pool := database.AddressPool{AddressType: 200, Mode: database.PoolModeUseOnce}
+	assert.Nil(t, db.ReplaceAddressPool(&user, pool, []string{testPoolAddress0}))
+	assert.Nil(t, db.CreateOrUpdateAddress(&user, database.Address{AddressType: 200, Address: testPoolAddress0}))
+	assert.Nil(t, db.CreateOrUpdateExtendedKey(&user, database.ExtendedKey{AddressType: 102, PublicKey: testZpub, RotateEvery: 1}))
+	assert.Nil(t, db.CreateOrUpdateAddress(&user, database.Address{AddressType: 102, Address: testZpubAddress0}))
+
+	// Only the plain address is listed, the pool and the key aren't used
+	cfg := Config{db: db, addressTypes: addressTypes, domains: map[string]domainPolicy{testDomain: {}}}
+	w := httptest.NewRecorder()
+	cfg.getAddressHandler(w, httptest.NewRequest("GET", "/v1/addresses?alias="+testUsername+"$"+testDomain, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var encoded string
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &encoded))
+	listed := []getAddressesResponse{}
+	assert.Nil(t, json.Unmarshal([]byte(encoded), &listed))
+	assert.Equal(t, 1, len(listed))
+	assert.Equal(t, testBitcoinP2PKHAddress, listed[0].Address)
+
+	pool, err = db.GetAddressPool(user, 200)
+	assert.Nil(t, err)
+	available, err := db.CountAvailablePooledAddresses(pool)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, available)
+	key, err := db.GetExtendedKey(user, 102)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), key.DerivationIndex)
+}
+
+func TestAuditExportTime(t *testing.T) {
+	dbFile, err := ioutil.TempFile("", "audit")
+	assert.Nil(t, err)
+	dbFile.Close()
+	defer os.Remove(dbFile.Name())
+	db, err := database.GetGormConnection(dbFile.Name(), "sqlite3")
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Nil(t, db.CreateTables(true))
+	for _, action := range []string{"create_user", "login", "logout"} {
+		assert.Nil(t, db.CreateAuditEvent(&database.AuditEvent{Actor: "user", Action: action}))
+	}
+
+	// Out of time an export still writes one event, and can be carried on
+	// from it
+	defer func(d time.Duration) { auditExportTime = d }(auditExportTime)
+	auditExportTime = 0
+	cfg := Config{db: db}
+	afterID := uint(0)
+	for _, action := range []string{"create_user", "login", "logout", ""} {
+		w := httptest.NewRecorder()
+		cfg.adminExportAuditHandler(w, httptest.NewRequest("GET", "/v1/admin/audit?after_id="+strconv.FormatUint(uint64(afterID), 10), nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		if action == "" {
+			assert.Equal(t, "", w.Body.String())
+			break
+		}
+		assert.Equal(t, 1, strings.Count(w.Body.String(), "\n"), action)
+		event := database.AuditEvent{}
+		err = json.Unmarshal(w.Body.Bytes(), &event)
+		assert.Nil(t, err)
+		assert.Equal(t, action, event.Action)
+		afterID = event.ID
+	}
+
+	w := httptest.NewRecorder()
+	cfg.adminExportAuditHandler(w, httptest.NewRequest("GET", "/v1/admin/audit?after_id=first", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestCreateTablesUpgrade(t *testing.T) {
+	dbFile, err := ioutil.TempFile("", "upgrade")
+	assert.Nil(t, err)
+	dbFile.Close()
+	defer os.Remove(dbFile.Name())
+	db, err := database.GetGormConnection(dbFile.Name(), "sqlite3")
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Nil(t, db.CreateTables(true))
+
+	// A database from an older version, with a column that's gone since
+	conn, err := sql.Open("sqlite3", dbFile.Name())
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Exec("ALTER TABLE extended_keys ADD COLUMN lookups integer NOT NULL DEFAULT 0")
+	assert.Nil(t, err)
+	_, err = conn.Exec("CREATE UNIQUE INDEX idx_extended_key_userid_type ON extended_keys(user_id, address_type)")
+	assert.Nil(t, err)
+	_, err = conn.Exec("INSERT INTO users (username, domain, password, created_at, updated_at) VALUES ('old', 'example.com', 'x', CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)")
+	assert.Nil(t, err)
+
+	// Upgrading keeps the data and drops the column
+	assert.Nil(t, db.CreateTables(false))
+	assert.True(t, db.HasTables())
+	user, err := db.GetUserByDomainUsername("example.com", "old")
+	assert.Nil(t, err)
+	var schema string
+	assert.Nil(t, conn.QueryRow("SELECT sql FROM sqlite_master WHERE name = 'extended_keys'").Scan(&schema))
+	assert.NotContains(t, schema, "lookups")
+	assert.Nil(t, db.CreateOrUpdateExtendedKey(&user, database.ExtendedKey{AddressType: 102, PublicKey: testZpub, RotateEvery: 1}))
+	assert.Nil(t, db.CreateOrUpdateExtendedKey(&user, database.ExtendedKey{AddressType: 102, PublicKey: "replacement", RotateEvery: 1}))
+}
+
+func TestServerShutdown(t *testing.T) {
+	dbFile, err := ioutil.TempFile("", "shutdown")
+	assert.Nil(t, err)
+	dbFile.Close()
+	defer os.Remove(dbFile.Name())
+	db, err := database.GetGormConnection(dbFile.Name(), "sqlite3")
+	assert.Nil(t, err)
+
+	started := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := newServer(db, nil)
+	err = server.listen("api", "127.0.0.1:0", newHTTPServer(slow))
+	assert.Nil(t, err)
+	addr := server.servers[0].Addr
+
+	// A port that's taken is reported straight away
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	err = server.listen("metrics", ln.Addr().String(), newHTTPServer(slow))
+	assert.NotNil(t, err)
+
+	// Requests in flight when shutting down still get their response
+	status := make(chan int)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, server.Shutdown(ctx))
+	assert.Equal(t, http.StatusNoContent, <-status)
+
+	select {
+	case err := <-server.Errors():
+		t.Errorf("Listener error after shutdown: %v", err)
+	default:
+	}
 }
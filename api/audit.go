@@ -0,0 +1,195 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/opencap/go-server/database"
+	"github.com/opencap/go-server/logging"
+)
+
+const auditExportBatchSize = 500
+
+// auditExportTime is how long an audit log export writes for. The server's
+// write timeout would cut a longer export off mid line, so it stops early at
+// the end of an event instead and the rest can be fetched with after_id.
+var auditExportTime = writeTimeout - 10*time.Second
+
+type auditEventsResponse struct {
+	Events  []database.AuditEvent `json:"events"`
+	Total   int                   `json:"total"`
+	Page    int                   `json:"page"`
+	PerPage int                   `json:"per_page"`
+}
+
+// auditValueHash is how changed values are stored in the audit log, empty
+// values stay empty
+func auditValueHash(value string) string {
+	if value == "" {
+		return ""
+	}
+	return sha256Hex(value)
+}
+
+// addressValue is the value of an address in the audit log
+func addressValue(address database.Address) string {
+	if address.Address == "" {
+		return ""
+	}
+	return address.Address + "\n" + address.Extensions
+}
+
+func newAuditEvent(req *http.Request, actor, action string, user database.User) database.AuditEvent {
+	event := database.AuditEvent{
+		Actor:      actor,
+		Action:     action,
+		UserID:     user.ID,
+		RemoteAddr: req.RemoteAddr,
+		UserAgent:  req.UserAgent(),
+	}
+	if user.Username != "" {
+		event.Alias = user.Username + "$" + user.Domain
+	}
+	return event
+}
+
+// recordAudit adds an event to the audit log. The request has already
+// succeeded or failed by then, so failing to record it is only logged.
+func (cfg Config) recordAudit(req *http.Request, event database.AuditEvent) {
+	if cfg.auditLog == nil {
+		return
+	}
+	if err := cfg.auditLog.Record(event); err != nil {
+		logging.FromRequest(req).Error("Couldn't record audit event", "action", event.Action, "alias", event.Alias, "error", err)
+	}
+}
+
+// audit records an action on a user's account
+func (cfg Config) audit(req *http.Request, actor, action string, user database.User) {
+	cfg.recordAudit(req, newAuditEvent(req, actor, action, user))
+}
+
+// auditAddress records a change to one of a user's address types
+func (cfg Config) auditAddress(req *http.Request, actor, action string, user database.User, addressType int, oldValue, newValue string) {
+	event := newAuditEvent(req, actor, action, user)
+	event.AddressType = addressType
+	event.OldValueHash = auditValueHash(oldValue)
+	event.NewValueHash = auditValueHash(newValue)
+	cfg.recordAudit(req, event)
+}
+
+// getAuditHandler lists the logged in user's audit trail, newest first
+func (cfg Config) getAuditHandler(w http.ResponseWriter, req *http.Request) {
+	page, perPage, err := validatePaginationParams(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, err := cfg.authorizeUser(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	events, total, err := cfg.db.GetUserAuditEvents(user, (page-1)*perPage, perPage)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := auditEventsResponse{
+		Events:  events,
+		Total:   total,
+		Page:    page,
+		PerPage: perPage,
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// validateAuditExportParams returns the events to export and the ID of the
+// event to start after
+func validateAuditExportParams(req *http.Request) (database.AuditFilter, uint, error) {
+	params := req.URL.Query()
+	filter := database.AuditFilter{}
+
+	if v := params.Get("user_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return filter, 0, errors.New("user_id must be a number")
+		}
+		filter.UserID = uint(id)
+	}
+
+	afterID := uint64(0)
+	if v := params.Get("after_id"); v != "" {
+		var err error
+		afterID, err = strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return filter, 0, errors.New("after_id must be a number")
+		}
+	}
+
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		v := params.Get(name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, 0, errors.New(name + " must be an RFC 3339 time, e.g. 2006-01-02T15:04:05Z")
+		}
+		*t = parsed
+	}
+	return filter, uint(afterID), nil
+}
+
+// adminExportAuditHandler writes the audit log as JSON lines, oldest first.
+// It writes for at most auditExportTime, but always at least one event so
+// exports continued with after_id make progress.
+func (cfg Config) adminExportAuditHandler(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	filter, afterID, err := validateAuditExportParams(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := cfg.recordAdminAction(req, "export_audit_log", database.User{}); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record admin action")
+		return
+	}
+
+	events, err := cfg.db.ExportAuditEvents(filter, afterID, auditExportBatchSize)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// The status is sent with the first batch, a later database error can
+	// only cut the export short
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	written, lastID := 0, afterID
+	for len(events) > 0 {
+		for _, v := range events {
+			if written > 0 && time.Since(start) > auditExportTime {
+				logging.FromRequest(req).Info("Audit log export stopped before the write timeout", "events", written, "last_id", lastID)
+				return
+			}
+			if err := encoder.Encode(v); err != nil {
+				return
+			}
+			written, lastID = written+1, v.ID
+		}
+		events, err = cfg.db.ExportAuditEvents(filter, events[len(events)-1].ID, auditExportBatchSize)
+		if err != nil {
+			logging.FromRequest(req).Error("Audit log export stopped early", "error", err)
+			return
+		}
+	}
+}
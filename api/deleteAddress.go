@@ -7,6 +7,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/opencap/go-server/auth"
+	"github.com/opencap/go-server/database"
 )
 
 func validateDeleteAddressParams(req *http.Request) (int, error) {
@@ -31,14 +32,13 @@ func (cfg Config) deleteAddressesHandler(w http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	domain, username, err := auth.Authorize(req.Header, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid authentication")
+	user, authorization, err := cfg.authorizeScope(req, auth.ScopeDeleteAddresses, addressType)
+	if err == errAPIKeyNotAllowed {
+		respondWithError(w, http.StatusForbidden, err.Error())
 		return
 	}
-	user, err := cfg.db.GetUserByDomainUsername(domain, username)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "User not found")
+		respondWithError(w, http.StatusBadRequest, "Invalid authentication")
 		return
 	}
 
@@ -48,11 +48,27 @@ func (cfg Config) deleteAddressesHandler(w http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	err = cfg.db.DeleteAddress(address)
+	err = cfg.changeAddresses(req, authorization, user, database.AddressChangeDelete, database.Address{AddressType: addressType}, database.ExtendedKey{}, func(cfg Config) error {
+		if err := cfg.db.DeleteAddress(address); err != nil {
+			return errors.New("Couldn't delete address")
+		}
+		if key, err := cfg.db.GetExtendedKey(user, addressType); err == nil {
+			if err := cfg.db.DeleteExtendedKey(key); err != nil {
+				return errors.New("Couldn't delete extended key")
+			}
+		}
+		if pool, err := cfg.db.GetAddressPool(user, addressType); err == nil {
+			if err := cfg.db.DeleteAddressPool(pool); err != nil {
+				return errors.New("Couldn't delete address pool")
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't delete address")
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	cfg.auditAddress(req, actor(authorization), "delete_address", user, addressType, addressValue(address), "")
 
 	var empty struct{}
 	respondWithJSON(w, http.StatusOK, empty)
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/opencap/go-server/database"
+)
+
+// publishAddress stores an address and the extended key it was published
+// with, if any, replacing what was published for its address type before
+func (cfg Config) publishAddress(user *database.User, req putAddressRequest, address *database.Address) error {
+	if err := cfg.updateExtendedKey(user, req, address); err != nil {
+		return errors.New("Couldn't update extended key")
+	}
+	if err := cfg.db.CreateOrUpdateAddress(user, *address); err != nil {
+		return errors.New("Couldn't update address")
+	}
+	return nil
+}
+
+// updateExtendedKey stores or removes the extended key of an address type
+// when it is published. A key that was published before goes on from the
+// derivation index it reached so addresses that were already handed out
+// aren't reused. Publishing either replaces an address pool.
+func (cfg Config) updateExtendedKey(user *database.User, req putAddressRequest, address *database.Address) error {
+	if pool, err := cfg.db.GetAddressPool(*user, req.AddressType); err == nil {
+		if err := cfg.db.DeleteAddressPool(pool); err != nil {
+			return err
+		}
+	}
+
+	if req.ExtendedKey == "" {
+		if existing, err := cfg.db.GetExtendedKey(*user, req.AddressType); err == nil {
+			return cfg.db.DeleteExtendedKey(existing)
+		}
+		return nil
+	}
+
+	key := database.ExtendedKey{
+		AddressType: req.AddressType,
+		PublicKey:   req.ExtendedKey,
+		RotateEvery: req.RotateEvery,
+	}
+	if err := cfg.db.CreateOrUpdateExtendedKey(user, key); err != nil {
+		return err
+	}
+
+	key, err := cfg.db.GetExtendedKey(*user, req.AddressType)
+	if err != nil {
+		return err
+	}
+	address.Address, err = cfg.addressTypes.Derive(key.AddressType, key.PublicKey, key.DerivationIndex)
+	return err
+}
+
+// rotateAddress replaces an address published as an extended key with the
+// receive address this lookup should be served. The stored address is kept
+// up to date with the last one handed out.
+func (cfg Config) rotateAddress(user database.User, address *database.Address) error {
+	key, err := cfg.db.GetExtendedKey(user, address.AddressType)
+	if err != nil {
+		return nil // published as a plain address
+	}
+
+	key, err = cfg.db.UseExtendedKey(key)
+	if err != nil {
+		return err
+	}
+
+	derived, err := cfg.addressTypes.Derive(key.AddressType, key.PublicKey, key.DerivationIndex)
+	if err != nil {
+		return err
+	}
+	if derived == address.Address {
+		return nil
+	}
+
+	address.Address = derived
+	return cfg.db.CreateOrUpdateAddress(&user, *address)
+}
@@ -5,42 +5,89 @@ import (
 	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	opencap "github.com/opencap/go-opencap"
+	"github.com/opencap/go-server/auth"
 	"github.com/opencap/go-server/database"
 )
 
 type getAddressesResponse struct {
-	Address     string `json:"address"`
-	AddressType int    `json:"address_type"`
+	Address       string          `json:"address"`
+	AddressType   int             `json:"address_type"`
+	Extensions    json.RawMessage `json:"extensions,omitempty"`
+	UserPublicKey string          `json:"user_public_key,omitempty"`
+	UserSignature string          `json:"user_signature,omitempty"`
+
+	// Signature is a JWS of the fields above signed with the domain's
+	// address key, if the server has one
+	Signature string `json:"signature,omitempty"`
 }
 
-func addressesToResponse(addresses []database.Address) (string, error) {
+func toGetAddressesResponse(address database.Address) getAddressesResponse {
+	resp := getAddressesResponse{
+		Address:       address.Address,
+		AddressType:   address.AddressType,
+		UserPublicKey: address.UserPublicKey,
+		UserSignature: address.UserSignature,
+	}
+	if address.Extensions != "" {
+		resp.Extensions = json.RawMessage(address.Extensions)
+	}
+	return resp
+}
+
+// signAddressResponse signs an address served for a user with the address
+// key, if the server has one
+func (cfg Config) signAddressResponse(user database.User, resp *getAddressesResponse) error {
+	if cfg.addressKeys == nil {
+		return nil
+	}
+
+	var err error
+	resp.Signature, err = cfg.addressKeys.SignAddress(auth.AddressClaims{
+		Alias:         user.Username + "$" + user.Domain,
+		AddressType:   resp.AddressType,
+		Address:       resp.Address,
+		Extensions:    resp.Extensions,
+		UserPublicKey: resp.UserPublicKey,
+		UserSignature: resp.UserSignature,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:   user.Domain,
+			IssuedAt: time.Now().UTC().Unix(),
+		},
+	})
+	return err
+}
+
+func (cfg Config) addressesToResponse(user database.User, addresses []database.Address) (string, error) {
 	respBody := make([]getAddressesResponse, 0)
 	for _, v := range addresses {
-		respBody = append(respBody, getAddressesResponse{
-			Address:     v.Address,
-			AddressType: v.AddressType,
-		})
+		resp := toGetAddressesResponse(v)
+		if err := cfg.signAddressResponse(user, &resp); err != nil {
+			return "", err
+		}
+		respBody = append(respBody, resp)
 	}
 	respBodyBytes, err := json.Marshal(respBody)
 	return string(respBodyBytes), err
 }
 
-func addressToResponse(address database.Address) (string, error) {
-	respBody := getAddressesResponse{
-		Address:     address.Address,
-		AddressType: address.AddressType,
+func (cfg Config) addressToResponse(user database.User, address database.Address) (string, error) {
+	respBody := toGetAddressesResponse(address)
+	if err := cfg.signAddressResponse(user, &respBody); err != nil {
+		return "", err
 	}
 	respBodyBytes, err := json.Marshal(respBody)
 	return string(respBodyBytes), err
 }
 
-func validateGetAddressParams(req *http.Request) (string, string, int, error) {
+func validateGetAddressParams(req *http.Request) (string, string, int, string, error) {
 	params := req.URL.Query()
 	aliasSlice, ok := params["alias"]
 	if !ok || len(aliasSlice) < 1 {
-		return "", "", 0, errors.New("No alias was included in the request")
+		return "", "", 0, "", errors.New("No alias was included in the request")
 	}
 
 	addressTypeSlice, ok := params["address_type"]
@@ -50,54 +97,158 @@ func validateGetAddressParams(req *http.Request) (string, string, int, error) {
 
 	addressTypeInt, err := strconv.Atoi(addressTypeSlice[0])
 	if err != nil {
-		return "", "", 0, errors.New("Address type must be an ID number")
+		return "", "", 0, "", errors.New("Address type must be an ID number")
 	}
 
 	username, domain, err := opencap.ValidateAlias(aliasSlice[0])
 	if err != nil {
-		return "", "", 0, err
+		return "", "", 0, "", err
+	}
+
+	// format is optional, e.g. "legacy" or "cashaddr" for Bitcoin Cash
+	format := params.Get("format")
+
+	return username, domain, addressTypeInt, format, nil
+}
+
+// resolveAddress replaces an address published as a pool or an extended key
+// with the one this lookup should be served
+func (cfg Config) resolveAddress(req *http.Request, user database.User, address *database.Address) error {
+	pooled, err := cfg.servePooledAddress(req, user, address)
+	if pooled || err != nil {
+		return err
 	}
+	return cfg.rotateAddress(user, address)
+}
 
-	return username, domain, addressTypeInt, nil
+// servedPerLookup is whether an address type is published as a pool or an
+// extended key, so each lookup of it uses up an address
+func (cfg Config) servedPerLookup(user database.User, addressType int) bool {
+	if _, err := cfg.db.GetAddressPool(user, addressType); err == nil {
+		return true
+	}
+	_, err := cfg.db.GetExtendedKey(user, addressType)
+	return err == nil
+}
+
+// formatAddress converts an address to the requested format, if its type
+// has it. The user's signature only covers the address as they published it,
+// so it's left out if the address changed.
+func (cfg Config) formatAddress(address *database.Address, format string) error {
+	if format == "" || !cfg.addressTypes.HasFormat(address.AddressType, format) {
+		return nil
+	}
+	formatted, err := cfg.addressTypes.Format(address.AddressType, address.Address, format)
+	if err != nil {
+		return err
+	}
+	if formatted != address.Address {
+		address.Address = formatted
+		address.UserPublicKey = ""
+		address.UserSignature = ""
+	}
+	return nil
 }
 
 func (cfg Config) getAddressHandler(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	username, domain, addressType, err := validateGetAddressParams(req)
+	username, domain, addressType, format, err := validateGetAddressParams(req)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	if _, ok := cfg.domains[domain]; !ok {
+		respondWithError(w, http.StatusNotFound, "Domain "+domain+" isn't hosted here")
+		return
+	}
+
 	user, err := cfg.db.GetUserByDomainUsername(domain, username)
-	if err != nil {
-		respondWithError(w, http.StatusNotFound, err.Error())
+	if err != nil || user.Disabled {
+		cfg.countLookup(addressType, false)
+		respondWithError(w, http.StatusNotFound, "User not found")
 		return
 	}
 
 	// Address type was requested
 	if addressType >= 0 {
+		if !cfg.addressTypes.IsEnabled(addressType) {
+			cfg.countLookup(addressType, false)
+			respondWithError(w, http.StatusBadRequest, "Unsupported address type")
+			return
+		}
+		// Checked before the address is resolved so a bad request doesn't
+		// use up a pooled or derived address
+		if format != "" && !cfg.addressTypes.HasFormat(addressType, format) {
+			respondWithError(w, http.StatusBadRequest, "Unknown format "+format)
+			return
+		}
+
 		address, err := cfg.db.GetAddressByAddressType(user, addressType)
 		if err != nil || len(address.Address) == 0 {
+			cfg.countLookup(addressType, false)
 			respondWithError(w, http.StatusNotFound, "Address not found")
+			return
+		}
+
+		err = cfg.resolveAddress(req, user, &address)
+		if err == database.ErrPoolEmpty {
+			cfg.countLookup(addressType, false)
+			respondWithError(w, http.StatusNotFound, "Address not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't resolve address")
+			return
+		}
+
+		err = cfg.formatAddress(&address, format)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't convert address to "+format)
+			return
 		}
 
-		body, err := addressToResponse(address)
+		body, err := cfg.addressToResponse(user, address)
 		if err != nil || len(address.Address) == 0 {
 			respondWithError(w, http.StatusInternalServerError, "Address not found")
 			return
 		}
 
+		cfg.countLookup(addressType, true)
 		respondWithJSON(w, http.StatusOK, body)
 		return
 	}
 
-	// return all addresses
+	// return all addresses, skipping types that have been disabled. Types
+	// published as a pool or an extended key are left out too, a lookup of
+	// every type shouldn't use up an address of each. Types without the
+	// format are returned as they were published.
+	if format != "" && !cfg.addressTypes.HasFormat(-1, format) {
+		respondWithError(w, http.StatusBadRequest, "Unknown format "+format)
+		return
+	}
 	addresses, err := cfg.db.GetAddresses(user)
-	body, err := addressesToResponse(addresses)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	enabled := make([]database.Address, 0, len(addresses))
+	for _, v := range addresses {
+		if !cfg.addressTypes.IsEnabled(v.AddressType) || cfg.servedPerLookup(user, v.AddressType) {
+			continue
+		}
+		err = cfg.formatAddress(&v, format)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't convert address to "+format)
+			return
+		}
+		enabled = append(enabled, v)
+	}
+	body, err := cfg.addressesToResponse(user, enabled)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg.countLookup(addressType, len(enabled) > 0)
 	respondWithJSON(w, http.StatusOK, body)
 }
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// healthCheckTimeout is how long the readiness checks that could hang, like
+// reading the certificate cache, get
+const healthCheckTimeout = 5 * time.Second
+
+// healthCheck is the result of a readiness check. Its status is "ok",
+// "failed", or "warning" for problems that don't stop the server handling
+// requests.
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// getHealthzHandler reports that the process is up and serving requests
+func (cfg Config) getHealthzHandler(w http.ResponseWriter, req *http.Request) {
+	respondWithJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// getReadyzHandler reports whether the server can handle requests: the
+// database is reachable and set up and in production a certificate is ready
+// for at least one domain. An invalid JWT config and domains still waiting
+// for a certificate are reported as warnings, they don't make the server
+// unavailable. The handler itself doesn't need a user or the JWT config.
+func (cfg Config) getReadyzHandler(w http.ResponseWriter, req *http.Request) {
+	resp := healthResponse{Status: "ok", Checks: map[string]healthCheck{}}
+	check := func(name string, err error) {
+		if err != nil {
+			resp.Status = "unavailable"
+			resp.Checks[name] = healthCheck{Status: "failed", Error: err.Error()}
+			return
+		}
+		resp.Checks[name] = healthCheck{Status: "ok"}
+	}
+	warn := func(name string, err error) {
+		if err != nil {
+			resp.Checks[name] = healthCheck{Status: "warning", Error: err.Error()}
+			return
+		}
+		resp.Checks[name] = healthCheck{Status: "ok"}
+	}
+
+	err := cfg.db.Ping()
+	check("database", err)
+	if err == nil {
+		if !cfg.db.HasTables() {
+			err = errors.New("Database not setup, run the server with --setupdatabase")
+		}
+		check("tables", err)
+	}
+	warn("jwt_config", cfg.jwtConfigErr)
+	if cfg.certCache != nil {
+		missing, err := cfg.checkCertificates(req.Context())
+		check("tls_certificate", err)
+		if err == nil {
+			warn("tls_certificate", missing)
+		}
+	}
+
+	code := http.StatusOK
+	if resp.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	respondWithJSON(w, code, resp)
+}
+
+// checkCertificates returns an error unless at least one domain has an
+// unexpired certificate in the autocert cache, and missing lists the domains
+// that don't have one yet. The first one for a domain is only requested when
+// someone connects to it over HTTPS, so a domain nobody has used yet
+// shouldn't make the server unavailable.
+func (cfg Config) checkCertificates(ctx context.Context) (missing error, err error) {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	domains := cfg.domainNames()
+	without := make([]string, 0)
+	for _, domain := range domains {
+		if !hasCertificate(ctx, cfg.certCache, domain) && !hasCertificate(ctx, cfg.certCache, domain+"+rsa") {
+			without = append(without, domain)
+		}
+	}
+	if len(without) == len(domains) {
+		return nil, errors.New("No certificate for any domain yet")
+	}
+	if len(without) > 0 {
+		return errors.New("No certificate for " + strings.Join(without, ", ") + " yet"), nil
+	}
+	return nil, nil
+}
+
+// hasCertificate is whether the autocert cache has an unexpired certificate
+// under key. Entries are the private key followed by the certificate chain,
+// leaf first, all PEM encoded.
+func hasCertificate(ctx context.Context, cache autocert.Cache, key string) bool {
+	data, err := cache.Get(ctx, key)
+	if err != nil {
+		return false
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return false
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		return err == nil && time.Now().Before(leaf.NotAfter)
+	}
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	opencap "github.com/opencap/go-opencap"
+	"github.com/opencap/go-server/database"
+)
+
+const inviteCodeBytes = 20
+
+type postInviteRequest struct {
+	Username       string `json:"username"`
+	Domain         string `json:"domain"`
+	MaxUses        uint   `json:"max_uses"`
+	ExpiresInHours uint   `json:"expires_in_hours"`
+}
+
+type postInviteResponse struct {
+	Code   string              `json:"code"`
+	Invite database.InviteCode `json:"invite"`
+}
+
+type invitesResponse struct {
+	Invites []database.InviteCode `json:"invites"`
+	Total   int                   `json:"total"`
+	Page    int                   `json:"page"`
+	PerPage int                   `json:"per_page"`
+}
+
+// hashInviteCode is how invite codes are stored, they are base32 so case
+// doesn't matter
+func hashInviteCode(code string) string {
+	return sha256Hex(strings.ToLower(code))
+}
+
+// CreateInviteCode creates an invite code that can be used maxUses times to
+// create a user, and returns the code. The code is only ever shown here.
+// username and domain restrict which user can be created if they aren't
+// empty, an expiresIn of 0 means the code never expires.
+func (cfg Config) CreateInviteCode(username, domain string, maxUses uint, expiresIn time.Duration) (string, database.InviteCode, error) {
+	username = strings.ToLower(username)
+	domain = strings.ToLower(domain)
+	if username != "" && !opencap.ValidateUsername(username) {
+		return "", database.InviteCode{}, errors.New("Invalid username")
+	}
+	if domain != "" && !opencap.ValidateDomain(domain) {
+		return "", database.InviteCode{}, errors.New("Invalid domain")
+	}
+	if maxUses == 0 {
+		maxUses = 1
+	}
+
+	b, err := randomBytes(inviteCodeBytes)
+	if err != nil {
+		return "", database.InviteCode{}, err
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+
+	invite := database.InviteCode{
+		CodeHash: hashInviteCode(code),
+		Username: username,
+		Domain:   domain,
+		MaxUses:  maxUses,
+	}
+	if expiresIn > 0 {
+		expiresAt := time.Now().Add(expiresIn)
+		invite.ExpiresAt = &expiresAt
+	}
+	if err := cfg.db.CreateInviteCode(&invite); err != nil {
+		return "", database.InviteCode{}, err
+	}
+	return code, invite, nil
+}
+
+// RevokeInviteCode stops an invite code from being used again
+func (cfg Config) RevokeInviteCode(id uint) error {
+	return cfg.db.RevokeInviteCode(id)
+}
+
+func (cfg Config) adminPostInviteHandler(w http.ResponseWriter, req *http.Request) {
+	params := postInviteRequest{}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Error reading request")
+		return
+	}
+	err = json.Unmarshal(body, &params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing request")
+		return
+	}
+	if params.Domain != "" {
+		if _, ok := cfg.domains[strings.ToLower(params.Domain)]; !ok {
+			respondWithError(w, http.StatusBadRequest, "domain must be one of "+strings.Join(cfg.domainNames(), ", "))
+			return
+		}
+	}
+
+	if err := cfg.recordAdminAction(req, "create_invite", database.User{}); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record admin action")
+		return
+	}
+
+	code, invite, err := cfg.CreateInviteCode(params.Username, params.Domain, params.MaxUses, time.Duration(params.ExpiresInHours)*time.Hour)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, postInviteResponse{Code: code, Invite: invite})
+}
+
+func (cfg Config) adminListInvitesHandler(w http.ResponseWriter, req *http.Request) {
+	page, perPage, err := validatePaginationParams(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := cfg.recordAdminAction(req, "list_invites", database.User{}); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record admin action")
+		return
+	}
+
+	invites, total, err := cfg.db.GetInviteCodes((page-1)*perPage, perPage)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := invitesResponse{
+		Invites: invites,
+		Total:   total,
+		Page:    page,
+		PerPage: perPage,
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg Config) adminDeleteInviteHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invite id must be a number")
+		return
+	}
+
+	if err := cfg.recordAdminAction(req, "revoke_invite", database.User{}); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record admin action")
+		return
+	}
+
+	err = cfg.RevokeInviteCode(uint(id))
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	var empty struct{}
+	respondWithJSON(w, http.StatusOK, empty)
+}
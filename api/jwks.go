@@ -0,0 +1,23 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/opencap/go-server/auth"
+)
+
+// getJWKSHandler publishes the public keys tokens can be verified with, it's
+// empty unless tokens are signed with an asymmetric key
+func (cfg Config) getJWKSHandler(w http.ResponseWriter, req *http.Request) {
+	respondWithJSON(w, http.StatusOK, cfg.jwtKeys.JWKS())
+}
+
+// getAddressKeysHandler publishes the public keys address responses can be
+// verified with, it's empty unless they are signed
+func (cfg Config) getAddressKeysHandler(w http.ResponseWriter, req *http.Request) {
+	if cfg.addressKeys == nil {
+		respondWithJSON(w, http.StatusOK, auth.JWKS{Keys: []auth.JWK{}})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, cfg.addressKeys.JWKS())
+}
@@ -1,12 +1,79 @@
 package api
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"net/http"
+
+	"github.com/opencap/go-server/auth"
+	"github.com/opencap/go-server/database"
 )
 
+// errAPIKeyNotAllowed is returned when an API key is used for something its
+// scopes don't cover
+var errAPIKeyNotAllowed = errors.New("API key isn't allowed to do this")
+
+// authorize returns the user the request's token or API key belongs to,
+// disabled users are rejected even if their token hasn't expired
+func (cfg Config) authorize(req *http.Request) (database.User, auth.Authorization, error) {
+	authorization, err := auth.Authorize(req, cfg.jwtKeys, cfg.db, apiKeyStore{cfg.db})
+	if err != nil {
+		return database.User{}, auth.Authorization{}, err
+	}
+
+	user, err := cfg.db.GetUserByDomainUsername(authorization.Domain, authorization.Username)
+	if err != nil {
+		return database.User{}, auth.Authorization{}, errors.New("User not found")
+	}
+	if user.Disabled {
+		return database.User{}, auth.Authorization{}, errors.New("User is disabled")
+	}
+	return user, authorization, nil
+}
+
+// authorizeUser returns the user the request's token was issued to. API keys
+// are refused, managing the account needs a login.
+func (cfg Config) authorizeUser(req *http.Request) (database.User, error) {
+	user, authorization, err := cfg.authorize(req)
+	if err != nil {
+		return database.User{}, err
+	}
+	if authorization.APIKey != nil {
+		return database.User{}, errAPIKeyNotAllowed
+	}
+	return user, nil
+}
+
+// authorizeScope returns the user the request's token or API key belongs to
+// if it allows the operation on the address type
+func (cfg Config) authorizeScope(req *http.Request, operation string, addressType int) (database.User, auth.Authorization, error) {
+	user, authorization, err := cfg.authorize(req)
+	if err != nil {
+		return database.User{}, auth.Authorization{}, err
+	}
+	if !authorization.Allows(operation, addressType) {
+		return database.User{}, auth.Authorization{}, errAPIKeyNotAllowed
+	}
+	return user, authorization, nil
+}
+
+// sha256Hex is how random tokens are stored, they are long enough that a fast
+// hash is fine
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// respondWithError responds with an error message, and the request's ID so
+// it can be found in the logs
 func respondWithError(w http.ResponseWriter, code int, msg string) {
-	respondWithJSON(w, code, map[string]string{"message": msg})
+	resp := map[string]string{"message": msg}
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		resp["request_id"] = id
+	}
+	respondWithJSON(w, code, resp)
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
@@ -14,7 +81,8 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Request-ID")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
 	w.WriteHeader(code)
 	w.Write(response)
 }
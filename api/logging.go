@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/opencap/go-server/logging"
+)
+
+// requestIDHeader carries a request's ID in and out of the server
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID is what an X-Request-ID header must look like to be used,
+// anything else could be used to forge log lines
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// initLogging sets up the server's logger from LOG_LEVEL (debug, info, warn
+// or error, info by default) and LOG_FORMAT (json or logfmt, json by
+// default). Everything logged with the standard log package goes through it
+// too.
+func initLogging() error {
+	level := logging.LevelInfo
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		var err error
+		level, err = logging.ParseLevel(v)
+		if err != nil {
+			return err
+		}
+	}
+	format := os.Getenv("LOG_FORMAT")
+	if format == "" {
+		format = logging.FormatJSON
+	}
+
+	logger, err := logging.New(os.Stderr, level, format)
+	if err != nil {
+		return err
+	}
+	logging.Default = logger
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logging.LevelInfo))
+	return nil
+}
+
+// redactSecrets keeps the server's configured secrets out of the logs
+func (cfg Config) redactSecrets() {
+	secrets := []string{cfg.createUserPassword, cfg.adminToken, os.Getenv("JWT_SECRET")}
+	for _, v := range cfg.domains {
+		secrets = append(secrets, v.createUserPassword)
+	}
+	logging.Default.RedactValues(secrets...)
+}
+
+func newRequestID() (string, error) {
+	b, err := randomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// logRequests gives each request an ID, taken from its X-Request-ID header
+// if it has a usable one, returns it in the response and logs the request
+// once it's been handled. Handlers get a logger that includes the ID from
+// logging.FromRequest.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			var err error
+			id, err = newRequestID()
+			if err != nil {
+				logging.Default.Error("Couldn't generate a request ID", "error", err)
+				respondWithError(w, http.StatusInternalServerError, "Couldn't generate a request ID")
+				return
+			}
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		logger := logging.Default.With("request_id", id)
+		req = req.WithContext(logging.NewContext(req.Context(), logger))
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+
+		logger.Info("request",
+			"method", req.Method,
+			"path", req.URL.Path,
+			"status", recorder.status,
+			"bytes", recorder.bytes,
+			"duration_ms", float64(time.Since(start))/float64(time.Millisecond),
+			"remote_addr", req.RemoteAddr,
+			"user_agent", req.UserAgent(),
+		)
+	})
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/opencap/go-server/logging"
+)
+
+// Failed logins are counted per alias and per IP address. After a few free
+// attempts each failure locks the alias or address out for twice as long as
+// the one before, up to loginMaxDelay.
+const (
+	loginFreeFailures = 3
+	loginBaseDelay    = time.Second
+	loginMaxDelay     = 15 * time.Minute
+	loginFailureReset = time.Hour // failures older than this are forgotten
+)
+
+// loginFailedMessage is returned for unknown aliases and wrong passwords alike
+// so aliases can't be enumerated
+const loginFailedMessage = "Incorrect alias or password"
+
+func aliasThrottleSubject(alias string) string {
+	return "alias:" + alias
+}
+
+// remoteHost is the IP address a request came from, without its port
+func remoteHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func ipThrottleSubject(req *http.Request) string {
+	return "ip:" + remoteHost(req)
+}
+
+// loginDelay returns how long logins are locked out after failures
+func loginDelay(failures int) time.Duration {
+	if failures <= loginFreeFailures {
+		return 0
+	}
+	delay := loginBaseDelay
+	for i := loginFreeFailures + 1; i < failures && delay < loginMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > loginMaxDelay {
+		delay = loginMaxDelay
+	}
+	return delay
+}
+
+// loginAttempt is a check of someone's credentials. It's counted as a failed
+// login against its subjects before it's made, so concurrent attempts can't
+// all get past the lockout.
+type loginAttempt struct {
+	cfg      Config
+	req      *http.Request
+	subjects []string
+	failures []int
+	failed   bool
+}
+
+// beginLoginAttempt counts an attempt against the subjects. If any of them is
+// locked out it returns how long until they may try again instead. end must
+// be deferred as soon as the attempt has begun.
+func (cfg Config) beginLoginAttempt(req *http.Request, subjects ...string) (*loginAttempt, time.Duration, error) {
+	attempt := &loginAttempt{cfg: cfg, req: req}
+	for _, v := range subjects {
+		throttle, wait, err := cfg.db.CountLoginAttempt(v, loginFailureReset, loginDelay)
+		if err != nil || wait > 0 {
+			attempt.end()
+			return nil, wait, err
+		}
+		attempt.subjects = append(attempt.subjects, v)
+		attempt.failures = append(attempt.failures, throttle.Failures)
+	}
+	return attempt, 0, nil
+}
+
+// respondThrottled rejects a login attempt made while locked out
+func respondThrottled(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+	respondWithError(w, http.StatusTooManyRequests, "Too many failed login attempts, try again later")
+}
+
+// fail logs a failed attempt, which is already counted
+func (a *loginAttempt) fail(reason string) {
+	a.failed = true
+	logger := logging.FromRequest(a.req)
+	logger.Warn("Failed login", "reason", reason, "subject", a.subjects[0], "remote_addr", a.req.RemoteAddr)
+	for i, v := range a.subjects {
+		if a.failures[i] == loginFreeFailures+1 {
+			logger.Warn("Logins locked out", "subject", v, "failures", a.failures[i])
+		}
+	}
+}
+
+// end takes back the failure counted for an attempt that didn't fail
+func (a *loginAttempt) end() {
+	if a.failed {
+		return
+	}
+	for _, v := range a.subjects {
+		if err := a.cfg.db.UncountLoginAttempt(v); err != nil {
+			logging.FromRequest(a.req).Error("Couldn't uncount login attempt", "subject", v, "error", err)
+		}
+	}
+	a.subjects = nil
+}
+
+// resetLoginFailures forgets an alias's failed logins after it logs in. The
+// IP address's failures are kept, otherwise an attacker could reset them by
+// logging in to their own account between guesses.
+func (cfg Config) resetLoginFailures(req *http.Request, alias string) {
+	if err := cfg.db.ResetLoginFailures(aliasThrottleSubject(alias)); err != nil {
+		logging.FromRequest(req).Error("Couldn't reset failed logins", "alias", alias, "error", err)
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/opencap/go-server/database"
+	"github.com/opencap/go-server/metrics"
+)
+
+// apiMetrics are the metrics served at /metrics
+type apiMetrics struct {
+	registry        *metrics.Registry
+	requests        *metrics.CounterVec
+	requestDuration *metrics.HistogramVec
+	lookups         *metrics.CounterVec
+	logins          *metrics.CounterVec
+	dbCalls         *metrics.HistogramVec
+}
+
+func newAPIMetrics() *apiMetrics {
+	r := metrics.NewRegistry()
+	return &apiMetrics{
+		registry:        r,
+		requests:        r.NewCounterVec("opencap_http_requests_total", "Requests handled, by route, method and status code.", "route", "method", "code"),
+		requestDuration: r.NewHistogramVec("opencap_http_request_duration_seconds", "How long requests took to handle, by route and method.", metrics.DefaultBuckets, "route", "method"),
+		lookups:         r.NewCounterVec("opencap_address_lookups_total", "Address lookups, by address type and whether an address was found.", "address_type", "result"),
+		logins:          r.NewCounterVec("opencap_logins_total", "Logins, by whether they succeeded.", "result"),
+		dbCalls:         r.NewHistogramVec("opencap_database_call_duration_seconds", "How long database calls took, by method.", metrics.DefaultBuckets, "method"),
+	}
+}
+
+// initMetrics starts collecting metrics and times every database call. They
+// are served at /metrics on the API's port, or on METRICS_ADDR (e.g.
+// 127.0.0.1:9090) if it's set so they can be kept off the internet.
+func (cfg *Config) initMetrics() {
+	cfg.metrics = newAPIMetrics()
+	cfg.db = database.Instrument(cfg.db, cfg.metrics.observeDBCall)
+}
+
+// statusRecorder remembers the status code a handler responded with and
+// how long the body was
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// instrument is middleware that counts and times the requests to each route
+func (m *apiMetrics) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+
+		// Routes are labelled by their template so ids in the path don't
+		// make a new time series each
+		route := req.URL.Path
+		if current := mux.CurrentRoute(req); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		m.requests.Inc(route, req.Method, strconv.Itoa(recorder.status))
+		m.requestDuration.ObserveSince(start, route, req.Method)
+	})
+}
+
+func (m *apiMetrics) observeDBCall(method string, start time.Time) {
+	m.dbCalls.ObserveSince(start, method)
+}
+
+// countLookup counts an address lookup, addressType is -1 if every address
+// was asked for. Types that aren't enabled share a label so requests can't
+// make up new time series.
+func (cfg Config) countLookup(addressType int, found bool) {
+	if cfg.metrics == nil {
+		return
+	}
+	label := "all"
+	if addressType >= 0 {
+		label = "unsupported"
+		if cfg.addressTypes.IsEnabled(addressType) {
+			label = strconv.Itoa(addressType)
+		}
+	}
+	result := "miss"
+	if found {
+		result = "hit"
+	}
+	cfg.metrics.lookups.Inc(label, result)
+}
+
+func (cfg Config) countLogin(succeeded bool) {
+	if cfg.metrics == nil {
+		return
+	}
+	result := "failure"
+	if succeeded {
+		result = "success"
+	}
+	cfg.metrics.logins.Inc(result)
+}
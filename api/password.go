@@ -0,0 +1,230 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	opencap "github.com/opencap/go-opencap"
+	"github.com/opencap/go-server/auth"
+	"github.com/opencap/go-server/database"
+)
+
+// recoverFailedMessage is returned for unknown aliases and wrong recovery
+// codes alike so aliases can't be enumerated
+const recoverFailedMessage = "Incorrect alias or recovery code"
+
+type putPasswordRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+type postRecoverRequest struct {
+	Alias        string `json:"alias"`
+	RecoveryCode string `json:"recovery_code"`
+	NewPassword  string `json:"new_password"`
+	OTP          string `json:"otp"` // TOTP or 2FA recovery code, if 2FA is enabled
+}
+
+type postAccountRecoveryCodesRequest struct {
+	Password string `json:"password"`
+}
+
+func readJSON(req *http.Request, v interface{}) error {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return errors.New("Error reading request")
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return errors.New("Error parsing request")
+	}
+	return nil
+}
+
+// setPassword changes a user's password, logs out all of their sessions and
+// starts a new one
+func (cfg Config) setPassword(req *http.Request, user database.User, password string) (postAuthResponse, error) {
+	var err error
+	user.Password, err = auth.HashPassword(password, cfg.passwordHashing)
+	if err != nil {
+		return postAuthResponse{}, err
+	}
+	if err := cfg.db.SetUserPassword(user, user.Password); err != nil {
+		return postAuthResponse{}, err
+	}
+	if err := cfg.db.RevokeUserSessions(user); err != nil {
+		return postAuthResponse{}, err
+	}
+	return cfg.createSession(req, user)
+}
+
+// checkPassword checks the password of a logged in user, with the same
+// lockout as logins
+func (cfg Config) checkPassword(w http.ResponseWriter, req *http.Request, user database.User, password string) bool {
+	subjects := []string{aliasThrottleSubject(user.Username + "$" + user.Domain), ipThrottleSubject(req)}
+	attempt, wait, err := cfg.beginLoginAttempt(req, subjects...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	if wait > 0 {
+		respondThrottled(w, wait)
+		return false
+	}
+	defer attempt.end()
+
+	if !auth.CheckPasswordHash(password, user.Password) {
+		attempt.fail("wrong password")
+		respondWithError(w, http.StatusBadRequest, "Incorrect password")
+		return false
+	}
+	return true
+}
+
+// putPasswordHandler changes the password of the logged in user
+func (cfg Config) putPasswordHandler(w http.ResponseWriter, req *http.Request) {
+	user, err := cfg.authorizeUser(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	params := putPasswordRequest{}
+	if err := readJSON(req, &params); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !auth.ValidatePassword(params.NewPassword) {
+		respondWithError(w, http.StatusBadRequest, "Invalid password format")
+		return
+	}
+
+	if !cfg.checkPassword(w, req, user, params.OldPassword) {
+		return
+	}
+
+	resp, err := cfg.setPassword(req, user, params.NewPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg.audit(req, "user", "change_password", user)
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// postRecoverHandler sets a new password for a user who lost theirs, using
+// one of the account recovery codes they were given at sign up
+func (cfg Config) postRecoverHandler(w http.ResponseWriter, req *http.Request) {
+	params := postRecoverRequest{}
+	if err := readJSON(req, &params); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	username, domain, err := opencap.ValidateAlias(params.Alias)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !auth.ValidatePassword(params.NewPassword) {
+		respondWithError(w, http.StatusBadRequest, "Invalid password format")
+		return
+	}
+
+	alias := username + "$" + domain
+	subjects := []string{aliasThrottleSubject(alias), ipThrottleSubject(req)}
+	attempt, wait, err := cfg.beginLoginAttempt(req, subjects...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if wait > 0 {
+		respondThrottled(w, wait)
+		return
+	}
+	defer attempt.end()
+
+	user, err := cfg.db.GetUserByDomainUsername(domain, username)
+	if err != nil {
+		attempt.fail("recovery for unknown alias")
+		respondWithError(w, http.StatusBadRequest, recoverFailedMessage)
+		return
+	}
+	// Every check that can fail comes before the recovery code is used up,
+	// and they all fail the same way so the response doesn't say whether
+	// the code was right
+	if user.Disabled {
+		attempt.fail("recovery for disabled user")
+		respondWithError(w, http.StatusBadRequest, recoverFailedMessage)
+		return
+	}
+
+	// A recovery code replaces the password, not the second factor
+	if user.TOTPEnabled {
+		ok, err := cfg.checkSecondFactor(&user, params.OTP)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !ok {
+			attempt.fail("invalid 2FA code")
+			respondWithError(w, http.StatusBadRequest, recoverFailedMessage)
+			return
+		}
+	}
+
+	user.Password, err = auth.HashPassword(params.NewPassword, cfg.passwordHashing)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ok, err := cfg.db.RecoverUser(user, sha256Hex(normalizeRecoveryCode(params.RecoveryCode)))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		attempt.fail("wrong recovery code")
+		respondWithError(w, http.StatusBadRequest, recoverFailedMessage)
+		return
+	}
+	cfg.resetLoginFailures(req, alias)
+
+	resp, err := cfg.createSession(req, user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg.audit(req, "user", "recover_account", user)
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// postAccountRecoveryCodesHandler replaces the account recovery codes of the
+// logged in user, which needs their password
+func (cfg Config) postAccountRecoveryCodesHandler(w http.ResponseWriter, req *http.Request) {
+	user, err := cfg.authorizeUser(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	params := postAccountRecoveryCodesRequest{}
+	if err := readJSON(req, &params); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !cfg.checkPassword(w, req, user, params.Password) {
+		return
+	}
+
+	codes, err := cfg.newRecoveryCodes(user, database.RecoveryCodeAccount, accountRecoveryCodeBytes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg.audit(req, "user", "new_recovery_codes", user)
+
+	respondWithJSON(w, http.StatusOK, recoveryCodesResponse{RecoveryCodes: codes})
+}
@@ -5,65 +5,127 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/http"
-	"time"
 
 	opencap "github.com/opencap/go-opencap"
 	"github.com/opencap/go-server/auth"
+	"github.com/opencap/go-server/database"
+	"github.com/opencap/go-server/logging"
 )
 
 type postAuthResponse struct {
-	Token string `json:"jwt"`
+	Token        string `json:"jwt"`
+	RefreshToken string `json:"refresh_token"`
 }
 
 type postAuthRequest struct {
 	Alias    string `json:"alias"`
 	Password string `json:"password"`
+	OTP      string `json:"otp"` // TOTP or recovery code, if 2FA is enabled
 }
 
-func validatePostAuthParams(req *http.Request) (string, string, string, error) {
+// validatePostAuthParams returns the request with Alias replaced by the
+// username, and the domain
+func validatePostAuthParams(req *http.Request) (postAuthRequest, string, error) {
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		return "", "", "", errors.New("Error parsing request")
+		return postAuthRequest{}, "", errors.New("Error parsing request")
 	}
 
 	params := postAuthRequest{}
 	err = json.Unmarshal(body, &params)
 	if err != nil {
-		return "", "", "", errors.New("Error parsing request")
+		return postAuthRequest{}, "", errors.New("Error parsing request")
 	}
 
 	username, domain, err := opencap.ValidateAlias(params.Alias)
-	return username, domain, params.Password, err
+	params.Alias = username
+	return params, domain, err
 }
 
 // Handler for postAuth
 func (cfg Config) postAuthHandler(w http.ResponseWriter, req *http.Request) {
-	username, domain, password, err := validatePostAuthParams(req)
+	params, domain, err := validatePostAuthParams(req)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	dbUser, err := cfg.db.GetUserByDomainUsername(domain, username)
+	alias := params.Alias + "$" + domain
+	subjects := []string{aliasThrottleSubject(alias), ipThrottleSubject(req)}
+	attempt, wait, err := cfg.beginLoginAttempt(req, subjects...)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "User not found")
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-
-	if !auth.CheckPasswordHash(password, dbUser.Password) {
-		respondWithError(w, http.StatusBadRequest, "Incorrect username password combination")
+	if wait > 0 {
+		respondThrottled(w, wait)
 		return
 	}
+	defer attempt.end()
 
-	token, err := auth.MakeToken(dbUser.Domain, dbUser.Username, cfg.jwtSecret, time.Now().UTC(), cfg.jwtExpirationTime)
+	// Unknown users go through a password check too so they take as long
+	dbUser, err := cfg.db.GetUserByDomainUsername(domain, params.Alias)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		auth.SimulatePasswordCheck(params.Password, cfg.passwordHashing)
+		attempt.fail("unknown alias")
+		cfg.audit(req, "anonymous", "login_failed", database.User{Username: params.Alias, Domain: domain})
+		cfg.countLogin(false)
+		respondWithError(w, http.StatusBadRequest, loginFailedMessage)
+		return
+	}
+	if !auth.CheckPasswordHash(params.Password, dbUser.Password) {
+		attempt.fail("wrong password")
+		cfg.audit(req, "anonymous", "login_failed", dbUser)
+		cfg.countLogin(false)
+		respondWithError(w, http.StatusBadRequest, loginFailedMessage)
+		return
+	}
+
+	if dbUser.Disabled {
+		respondWithError(w, http.StatusForbidden, "User is disabled")
 		return
 	}
 
-	resp := postAuthResponse{
-		Token: token,
+	if dbUser.TOTPEnabled {
+		if params.OTP == "" {
+			respondWithError(w, http.StatusUnauthorized, "2FA code required")
+			return
+		}
+		ok, err := cfg.checkSecondFactor(&dbUser, params.OTP)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !ok {
+			attempt.fail("invalid 2FA code")
+			cfg.audit(req, "anonymous", "login_failed", dbUser)
+			cfg.countLogin(false)
+			respondWithError(w, http.StatusUnauthorized, "Invalid 2FA code")
+			return
+		}
+	}
+	cfg.resetLoginFailures(req, alias)
+
+	// The password is only known now, so this is when old hashes get
+	// upgraded to the current scheme and parameters
+	if auth.NeedsRehash(dbUser.Password, cfg.passwordHashing) {
+		hash, err := auth.HashPassword(params.Password, cfg.passwordHashing)
+		if err == nil {
+			dbUser.Password = hash
+			err = cfg.db.SetUserPassword(dbUser, hash)
+		}
+		if err != nil {
+			logging.FromRequest(req).Error("Couldn't rehash password", "alias", alias, "error", err)
+		}
+	}
+
+	resp, err := cfg.createSession(req, dbUser)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
+	cfg.audit(req, "user", "login", dbUser)
+	cfg.countLogin(true)
 
 	respondWithJSON(w, http.StatusOK, resp)
 }
@@ -1,10 +1,12 @@
 package api
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	opencap "github.com/opencap/go-opencap"
 	"github.com/opencap/go-server/auth"
@@ -15,68 +17,105 @@ type postUserRequest struct {
 	Alias              string `json:"alias"`
 	Password           string `json:"password"`
 	CreateUserPassword string `json:"create_user_password"`
+	InviteCode         string `json:"invite_code"`
 }
 
-func validatePostUserParams(req *http.Request) (string, string, string, string, error) {
+// validatePostUserParams returns the request with Alias replaced by the
+// username, and the domain
+func validatePostUserParams(req *http.Request) (postUserRequest, string, error) {
 	params := postUserRequest{}
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		return "", "", "", "", errors.New("Error reading request")
+		return postUserRequest{}, "", errors.New("Error reading request")
 	}
 
 	err = json.Unmarshal(body, &params)
 	if err != nil {
-		return "", "", "", "", errors.New("Error parsing request")
+		return postUserRequest{}, "", errors.New("Error parsing request")
 	}
 
 	if !auth.ValidatePassword(params.Password) {
-		return "", "", "", "", errors.New("Invalid password format, should")
+		return postUserRequest{}, "", errors.New("Invalid password format, should")
 	}
 
 	username, domain, err := opencap.ValidateAlias(params.Alias)
 	if err != nil {
-		return "", "", "", "", err
+		return postUserRequest{}, "", err
 	}
 	params.Alias = username
 
-	return username, domain, params.Password, params.CreateUserPassword, nil
+	return params, domain, nil
 }
 
 func (cfg Config) postUserHandler(w http.ResponseWriter, req *http.Request) {
-	username, domain, password, createUserPassword, err := validatePostUserParams(req)
+	params, domain, err := validatePostUserParams(req)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	if domain != cfg.domainName {
-		respondWithError(w, http.StatusBadRequest, "Alias must use $"+cfg.domainName)
+	policy, ok := cfg.domains[domain]
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Alias must use one of $"+strings.Join(cfg.domainNames(), ", $"))
 		return
 	}
 
-	if createUserPassword != cfg.createUserPassword {
-		respondWithError(w, http.StatusBadRequest, "invalid create_user_password")
-		return
+	// Invite codes are checked when the user is created, the create user
+	// password is only accepted on open domains
+	if params.InviteCode == "" {
+		if policy.closed {
+			respondWithError(w, http.StatusForbidden, "Users can't be created on "+domain+" without an invite_code")
+			return
+		}
+
+		expectedPassword := cfg.createUserPassword
+		if policy.createUserPassword != "" {
+			expectedPassword = policy.createUserPassword
+		}
+		if expectedPassword == "" {
+			respondWithError(w, http.StatusBadRequest, "An invite_code is required")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(params.CreateUserPassword), []byte(expectedPassword)) != 1 {
+			respondWithError(w, http.StatusBadRequest, "invalid create_user_password")
+			return
+		}
 	}
 
 	user := database.User{
-		Username: username,
+		Username: params.Alias,
 		Domain:   domain,
-		Password: password,
+		Password: params.Password,
 	}
 
-	user.Password, err = auth.HashPassword(user.Password)
+	user.Password, err = auth.HashPassword(user.Password, cfg.passwordHashing)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	err = cfg.db.CreateUser(&user)
+	if params.InviteCode != "" {
+		err = cfg.db.CreateUserWithInviteCode(&user, hashInviteCode(params.InviteCode))
+		if err == database.ErrInviteCodeInvalid {
+			respondWithError(w, http.StatusBadRequest, "invalid invite_code")
+			return
+		}
+	} else {
+		err = cfg.db.CreateUser(&user)
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Username already taken")
 		return
 	}
+	cfg.audit(req, "user", "create_user", user)
+
+	// The server doesn't know any way to reach the user, so these are the
+	// only way back in if they forget their password
+	codes, err := cfg.newRecoveryCodes(user, database.RecoveryCodeAccount, accountRecoveryCodeBytes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "User created but recovery codes couldn't be: "+err.Error())
+		return
+	}
 
-	var empty struct{}
-	respondWithJSON(w, http.StatusOK, empty)
+	respondWithJSON(w, http.StatusOK, recoveryCodesResponse{RecoveryCodes: codes})
 }
@@ -7,89 +7,126 @@ import (
 	"io/ioutil"
 	"net/http"
 
-	"github.com/opencap/go-opencap/bitcoin"
-	"github.com/opencap/go-opencap/nano"
+	"github.com/opencap/go-server/addresstype"
 	"github.com/opencap/go-server/auth"
 	"github.com/opencap/go-server/database"
 )
 
 type putAddressRequest struct {
-	AddressType int    `json:"address_type"`
-	Address     string `json:"address"`
+	AddressType int                        `json:"address_type"`
+	Address     string                     `json:"address"`
+	Extensions  map[string]json.RawMessage `json:"extensions"`
+
+	// ExtendedKey can be sent instead of Address for types that support
+	// it, lookups then rotate through its receive addresses
+	ExtendedKey string `json:"extended_key"`
+	RotateEvery uint   `json:"rotate_every"`
+
+	// UserSignature optionally counter-signs the address with a key only
+	// the user holds, see auth.AddressMessage
+	UserPublicKey string `json:"user_public_key"`
+	UserSignature string `json:"user_signature"`
 }
 
-func validatePutAddressParams(req *http.Request) (putAddressRequest, error) {
+func validatePutAddressParams(req *http.Request, addressTypes *addresstype.Registry) (putAddressRequest, string, error) {
 	params := putAddressRequest{}
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		return params, errors.New("Error parsing request")
+		return params, "", errors.New("Error parsing request")
 	}
 
 	err = json.Unmarshal(body, &params)
 	if err != nil {
-		return params, errors.New("Error parsing request")
+		return params, "", errors.New("Error parsing request")
+	}
+
+	if _, err := addressTypes.Get(params.AddressType); err != nil {
+		return putAddressRequest{}, "", err
 	}
 
-	valid := false
-	switch params.AddressType {
-	case 100: // Bitcoin P2PKH
-		valid = bitcoin.ValidateP2PKH(params.Address) == nil
-	case 101: // Bitcoin P2SH
-		valid = bitcoin.ValidateP2SH(params.Address) == nil
-	case 102: // Bitcoin Bech32
-		valid = bitcoin.ValidateSegwitBech32(params.Address) == nil
-	case 103: // Bitcoin Payment Code
-		valid = true
-	case 200: // Bitcoin Cash P2PKH
-		valid = bitcoin.ValidateP2PKH(params.Address) == nil
-	case 201: // Bitcoin Cash P2SH
-		valid = bitcoin.ValidateP2SH(params.Address) == nil
-	case 300: // Nano
-		valid = nano.ValidateAddress(params.Address) == nil
-	default:
-		valid = false
+	if (params.UserPublicKey == "") != (params.UserSignature == "") {
+		return putAddressRequest{}, "", errors.New("Send both user_public_key and user_signature, or neither")
 	}
-	if !valid {
-		return putAddressRequest{}, fmt.Errorf(
-			"Invalid address format")
+
+	if params.ExtendedKey != "" {
+		if params.UserSignature != "" {
+			return putAddressRequest{}, "", errors.New("Addresses derived from an extended key can't be counter-signed")
+		}
+		if params.Address != "" {
+			return putAddressRequest{}, "", errors.New("Send either address or extended_key, not both")
+		}
+		params.Address, err = addressTypes.Derive(params.AddressType, params.ExtendedKey, 0)
+		if err != nil {
+			return putAddressRequest{}, "", fmt.Errorf(
+				"Invalid extended key: %v", err)
+		}
+		if params.RotateEvery == 0 {
+			params.RotateEvery = 1
+		}
+	}
+
+	params.Address, err = addressTypes.Validate(params.AddressType, params.Address)
+	if err != nil {
+		return putAddressRequest{}, "", fmt.Errorf(
+			"Invalid address format: %v", err)
 	}
 
-	return params, nil
+	extensions, err := addressTypes.ValidateExtensions(params.AddressType, params.Extensions)
+	if err != nil {
+		return putAddressRequest{}, "", fmt.Errorf(
+			"Invalid extensions: %v", err)
+	}
+
+	return params, extensions, nil
 }
 
-func reqToAddress(req putAddressRequest) database.Address {
+func reqToAddress(req putAddressRequest, extensions string) database.Address {
 	address := database.Address{}
 	address.Address = req.Address
 	address.AddressType = req.AddressType
+	address.Extensions = extensions
+	address.UserPublicKey = req.UserPublicKey
+	address.UserSignature = req.UserSignature
 	return address
 }
 
 func (cfg Config) putAddressHandler(w http.ResponseWriter, req *http.Request) {
-	reqModel, err := validatePutAddressParams(req)
+	reqModel, extensions, err := validatePutAddressParams(req, cfg.addressTypes)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	domain, username, err := auth.Authorize(req.Header, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid login credentials")
+	user, authorization, err := cfg.authorizeScope(req, auth.ScopeUpdateAddresses, reqModel.AddressType)
+	if err == errAPIKeyNotAllowed {
+		respondWithError(w, http.StatusForbidden, err.Error())
 		return
 	}
-
-	user, err := cfg.db.GetUserByDomainUsername(domain, username)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid login credentials")
 		return
 	}
 
-	address := reqToAddress(reqModel)
+	address := reqToAddress(reqModel, extensions)
+	if address.UserSignature != "" {
+		message := auth.AddressMessage(user.Username+"$"+user.Domain, address.AddressType, address.Address, address.Extensions)
+		err = auth.VerifyUserSignature(address.UserPublicKey, address.UserSignature, message)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
 
-	err = cfg.db.CreateOrUpdateAddress(&user, address)
+	previous, _ := cfg.db.GetAddressByAddressType(user, address.AddressType)
+	key := database.ExtendedKey{PublicKey: reqModel.ExtendedKey, RotateEvery: reqModel.RotateEvery}
+	err = cfg.changeAddresses(req, authorization, user, database.AddressChangeUpdate, address, key, func(cfg Config) error {
+		return cfg.publishAddress(&user, reqModel, &address)
+	})
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't update address")
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	cfg.auditAddress(req, actor(authorization), "update_address", user, address.AddressType, addressValue(previous), addressValue(address))
 
 	var empty struct{}
 	respondWithJSON(w, http.StatusOK, empty)
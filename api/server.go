@@ -0,0 +1,123 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/opencap/go-server/audit"
+	"github.com/opencap/go-server/database"
+	"github.com/opencap/go-server/logging"
+)
+
+// Limits on each connection, so slow or malicious clients can't hold on to
+// connections or memory forever
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 30 * time.Second
+	writeTimeout      = 60 * time.Second
+	idleTimeout       = 120 * time.Second
+	maxHeaderBytes    = 64 << 10
+)
+
+// ShutdownTimeout is how long Server.Shutdown should be given to let
+// in-flight requests finish
+const ShutdownTimeout = 30 * time.Second
+
+// Server is the running API: its HTTP and HTTPS listeners and the metrics
+// listener if it has its own
+type Server struct {
+	servers  []*http.Server
+	names    []string
+	errs     chan error
+	db       database.Database
+	auditLog *audit.Logger
+}
+
+func newServer(db database.Database, auditLog *audit.Logger) *Server {
+	return &Server{errs: make(chan error, 4), db: db, auditLog: auditLog}
+}
+
+// newHTTPServer returns a server for handler with the connection limits set.
+// Errors the server can't return, like failed TLS handshakes, are logged.
+func newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+		ErrorLog:          log.New(logging.Default.Writer(logging.LevelWarn), "", 0),
+	}
+}
+
+// listen binds addr for srv and serves it in the background, with TLS if
+// srv has a TLS config. Binding happens straight away so a port that's in
+// use is reported by Start, errors after that are sent to Errors.
+func (s *Server) listen(name, addr string, srv *http.Server) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.New("Couldn't listen for " + name + " on " + addr + ": " + err.Error())
+	}
+	srv.Addr = ln.Addr().String()
+	s.servers = append(s.servers, srv)
+	s.names = append(s.names, name)
+
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != http.ErrServerClosed {
+			s.errs <- errors.New(name + " listener on " + srv.Addr + " stopped: " + err.Error())
+		}
+	}()
+	logging.Default.Info("Listening for requests", "listener", name, "addr", srv.Addr)
+	return nil
+}
+
+// Errors receives an error if a listener stops without being shut down
+func (s *Server) Errors() <-chan error {
+	return s.errs
+}
+
+// Shutdown stops accepting connections, waits for in-flight requests to
+// finish until ctx is done and then closes the audit log and the database
+func (s *Server) Shutdown(ctx context.Context) error {
+	errs := make([]error, len(s.servers))
+	wg := sync.WaitGroup{}
+	for i, srv := range s.servers {
+		wg.Add(1)
+		go func(i int, srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				errs[i] = errors.New("Couldn't shut down the " + s.names[i] + " listener: " + err.Error())
+				srv.Close()
+			}
+		}(i, srv)
+	}
+	wg.Wait()
+
+	if s.auditLog != nil {
+		if err := s.auditLog.Close(); err != nil {
+			errs = append(errs, errors.New("Couldn't close the audit log: "+err.Error()))
+		}
+	}
+	if err := s.db.Close(); err != nil {
+		errs = append(errs, errors.New("Couldn't close the database: "+err.Error()))
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/opencap/go-server/auth"
+	"github.com/opencap/go-server/database"
+	"github.com/opencap/go-server/logging"
+)
+
+const defaultRefreshExpirationDays = 30
+
+type postAuthRefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+func newRefreshToken() (string, error) {
+	b, err := randomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// createSession starts a session for a user and returns its first access
+// token and its refresh token
+func (cfg Config) createSession(req *http.Request, user database.User) (postAuthResponse, error) {
+	// Sessions are cleaned up here instead of in the background
+	if err := cfg.db.DeleteExpiredSessions(); err != nil {
+		logging.FromRequest(req).Error("Couldn't delete expired sessions", "error", err)
+	}
+
+	id, err := randomBytes(16)
+	if err != nil {
+		return postAuthResponse{}, err
+	}
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		return postAuthResponse{}, err
+	}
+
+	now := time.Now().UTC()
+	session := database.Session{
+		UserID:           user.ID,
+		TokenID:          hex.EncodeToString(id),
+		RefreshTokenHash: sha256Hex(refreshToken),
+		ExpiresAt:        now.Add(cfg.refreshExpiration),
+	}
+	if err := cfg.db.CreateSession(&session); err != nil {
+		return postAuthResponse{}, err
+	}
+
+	token, err := auth.MakeToken(user.Domain, user.Username, session.TokenID, cfg.jwtKeys, now, cfg.jwtExpirationTime)
+	if err != nil {
+		return postAuthResponse{}, err
+	}
+	return postAuthResponse{Token: token, RefreshToken: refreshToken}, nil
+}
+
+func validatePostAuthRefreshParams(req *http.Request) (string, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return "", errors.New("Error parsing request")
+	}
+
+	params := postAuthRefreshRequest{}
+	err = json.Unmarshal(body, &params)
+	if err != nil {
+		return "", errors.New("Error parsing request")
+	}
+	if params.RefreshToken == "" {
+		return "", errors.New("refresh_token is required")
+	}
+	return params.RefreshToken, nil
+}
+
+// postAuthRefreshHandler trades a refresh token for a new access token and a
+// new refresh token, the old refresh token stops working
+func (cfg Config) postAuthRefreshHandler(w http.ResponseWriter, req *http.Request) {
+	refreshToken, err := validatePostAuthRefreshParams(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	newRefreshToken, err := newRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	now := time.Now().UTC()
+	session, err := cfg.db.RotateRefreshToken(sha256Hex(refreshToken), sha256Hex(newRefreshToken), now.Add(cfg.refreshExpiration))
+	if err == database.ErrSessionNotFound {
+		respondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	user, err := cfg.db.GetUser(session.UserID)
+	if err != nil || user.Disabled {
+		respondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+
+	token, err := auth.MakeToken(user.Domain, user.Username, session.TokenID, cfg.jwtKeys, now, cfg.jwtExpirationTime)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, postAuthResponse{Token: token, RefreshToken: newRefreshToken})
+}
+
+// deleteAuthHandler logs out, revoking the session of the token used
+func (cfg Config) deleteAuthHandler(w http.ResponseWriter, req *http.Request) {
+	authorization, err := auth.Authorize(req, cfg.jwtKeys, cfg.db, apiKeyStore{cfg.db})
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if authorization.APIKey != nil {
+		respondWithError(w, http.StatusBadRequest, "API keys can't log out, revoke them instead")
+		return
+	}
+
+	err = cfg.db.RevokeSession(authorization.TokenID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if user, err := cfg.db.GetUserByDomainUsername(authorization.Domain, authorization.Username); err == nil {
+		cfg.audit(req, "user", "logout", user)
+	}
+
+	var empty struct{}
+	respondWithJSON(w, http.StatusOK, empty)
+}
@@ -0,0 +1,263 @@
+package api
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/opencap/go-server/auth"
+	"github.com/opencap/go-server/database"
+)
+
+const (
+	recoveryCodeCount = 10
+	// 2FA recovery codes are only any use with the password so they can be
+	// shorter than account recovery codes
+	twoFactorRecoveryCodeBytes = 5  // 8 base32 characters
+	accountRecoveryCodeBytes   = 10 // 16 base32 characters
+)
+
+type postTwoFactorResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// newRecoveryCodes replaces a user's recovery codes for a purpose and returns
+// the new ones, written in groups of four characters
+func (cfg Config) newRecoveryCodes(user database.User, purpose string, size int) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b, err := randomBytes(size)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		groups := make([]string, 0, len(code)/4)
+		for j := 0; j < len(code); j += 4 {
+			groups = append(groups, code[j:j+4])
+		}
+		codes = append(codes, strings.Join(groups, "-"))
+		hashes = append(hashes, sha256Hex(code))
+	}
+
+	if err := cfg.db.ReplaceRecoveryCodes(user, purpose, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// checkSecondFactor returns true if the code is a TOTP code for the user's
+// secret that hasn't been used yet, or one of their unused recovery codes.
+// Either kind of code only works once.
+func (cfg Config) checkSecondFactor(user *database.User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" || user.TOTPSecret == "" {
+		return false, nil
+	}
+
+	if counter, ok := auth.ValidateTOTP(user.TOTPSecret, code, time.Now().UTC()); ok {
+		ok, err := cfg.db.UseTOTPCounter(*user, counter)
+		if err != nil || !ok {
+			return false, err
+		}
+		user.TOTPLastCounter = counter
+		return true, nil
+	}
+
+	return cfg.db.UseRecoveryCode(*user, database.RecoveryCodeTwoFactor, sha256Hex(normalizeRecoveryCode(code)))
+}
+
+func validateTwoFactorCodeParams(req *http.Request) (string, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return "", errors.New("Error reading request")
+	}
+
+	params := twoFactorCodeRequest{}
+	err = json.Unmarshal(body, &params)
+	if err != nil {
+		return "", errors.New("Error parsing request")
+	}
+	if params.Code == "" {
+		return "", errors.New("code is required")
+	}
+	return params.Code, nil
+}
+
+// postTwoFactorHandler starts 2FA enrollment, it isn't required until a code
+// for the new secret is confirmed
+func (cfg Config) postTwoFactorHandler(w http.ResponseWriter, req *http.Request) {
+	user, err := cfg.authorizeUser(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if user.TOTPEnabled {
+		respondWithError(w, http.StatusBadRequest, "2FA is already enabled")
+		return
+	}
+
+	user.TOTPSecret, err = auth.GenerateTOTPSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = cfg.db.UpdateUserTOTP(user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := postTwoFactorResponse{
+		Secret: user.TOTPSecret,
+		URI:    auth.TOTPURI(user.Domain, user.Username+"$"+user.Domain, user.TOTPSecret),
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// postTwoFactorConfirmHandler enables 2FA once the user proves their
+// authenticator app has the secret, and returns their recovery codes
+func (cfg Config) postTwoFactorConfirmHandler(w http.ResponseWriter, req *http.Request) {
+	user, err := cfg.authorizeUser(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	code, err := validateTwoFactorCodeParams(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if user.TOTPEnabled {
+		respondWithError(w, http.StatusBadRequest, "2FA is already enabled")
+		return
+	}
+	if user.TOTPSecret == "" {
+		respondWithError(w, http.StatusBadRequest, "2FA enrollment hasn't been started")
+		return
+	}
+
+	counter, ok := auth.ValidateTOTP(user.TOTPSecret, code, time.Now().UTC())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Invalid 2FA code")
+		return
+	}
+
+	codes, err := cfg.newRecoveryCodes(user, database.RecoveryCodeTwoFactor, twoFactorRecoveryCodeBytes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	user.TOTPEnabled = true
+	user.TOTPLastCounter = counter
+	err = cfg.db.UpdateUserTOTP(user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg.audit(req, "user", "enable_2fa", user)
+
+	respondWithJSON(w, http.StatusOK, recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// authorizeTwoFactorChange returns the user if 2FA is enabled and the request
+// has a valid code
+func (cfg Config) authorizeTwoFactorChange(w http.ResponseWriter, req *http.Request) (database.User, bool) {
+	user, err := cfg.authorizeUser(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return database.User{}, false
+	}
+	code, err := validateTwoFactorCodeParams(req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return database.User{}, false
+	}
+	if !user.TOTPEnabled {
+		respondWithError(w, http.StatusBadRequest, "2FA isn't enabled")
+		return database.User{}, false
+	}
+
+	// Codes are guessable without limits otherwise, so failures count
+	// towards the same lockout as failed logins
+	subjects := []string{aliasThrottleSubject(user.Username + "$" + user.Domain), ipThrottleSubject(req)}
+	attempt, wait, err := cfg.beginLoginAttempt(req, subjects...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return database.User{}, false
+	}
+	if wait > 0 {
+		respondThrottled(w, wait)
+		return database.User{}, false
+	}
+	defer attempt.end()
+
+	ok, err := cfg.checkSecondFactor(&user, code)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return database.User{}, false
+	}
+	if !ok {
+		attempt.fail("invalid 2FA code")
+		respondWithError(w, http.StatusUnauthorized, "Invalid 2FA code")
+		return database.User{}, false
+	}
+	return user, true
+}
+
+func (cfg Config) deleteTwoFactorHandler(w http.ResponseWriter, req *http.Request) {
+	user, ok := cfg.authorizeTwoFactorChange(w, req)
+	if !ok {
+		return
+	}
+
+	err := cfg.db.ReplaceRecoveryCodes(user, database.RecoveryCodeTwoFactor, nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	err = cfg.db.UpdateUserTOTP(user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg.audit(req, "user", "disable_2fa", user)
+
+	var empty struct{}
+	respondWithJSON(w, http.StatusOK, empty)
+}
+
+func (cfg Config) postRecoveryCodesHandler(w http.ResponseWriter, req *http.Request) {
+	user, ok := cfg.authorizeTwoFactorChange(w, req)
+	if !ok {
+		return
+	}
+
+	codes, err := cfg.newRecoveryCodes(user, database.RecoveryCodeTwoFactor, twoFactorRecoveryCodeBytes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg.audit(req, "user", "new_2fa_recovery_codes", user)
+
+	respondWithJSON(w, http.StatusOK, recoveryCodesResponse{RecoveryCodes: codes})
+}
@@ -0,0 +1,65 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/opencap/go-server/database"
+)
+
+// Logger records audit events in the database and, if it was given a file,
+// appends each one to it as a line of JSON
+type Logger struct {
+	db   database.Database
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewLogger returns a logger that records events in the database, and in
+// the file at path unless it is empty
+func NewLogger(db database.Database, path string) (*Logger, error) {
+	l := &Logger{db: db}
+	if path == "" {
+		return l, nil
+	}
+
+	var err error
+	l.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Record adds an event to the audit log. The event is written to the file
+// even if the database couldn't store it, so it isn't lost.
+func (l *Logger) Record(event database.AuditEvent) error {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	dbErr := l.db.CreateAuditEvent(&event)
+	if l.file == nil {
+		return dbErr
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return dbErr
+}
+
+// Close closes the file events are written to
+func (l *Logger) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
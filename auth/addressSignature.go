@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/ed25519"
+)
+
+// AddressClaims are what a domain signs in an address response, so a wallet
+// can check the address it was served came from the domain's key holder and
+// not a compromised host or database
+type AddressClaims struct {
+	Alias         string          `json:"alias"`
+	AddressType   int             `json:"address_type"`
+	Address       string          `json:"address"`
+	Extensions    json.RawMessage `json:"extensions,omitempty"`
+	UserPublicKey string          `json:"user_public_key,omitempty"`
+	UserSignature string          `json:"user_signature,omitempty"`
+	jwt.StandardClaims
+}
+
+// SignAddress returns the claims as a compact JWS signed with the key set's
+// signing key
+func (ks *KeySet) SignAddress(claims AddressClaims) (string, error) {
+	return ks.sign(claims)
+}
+
+// VerifyAddress returns the claims of an address signature if one of the key
+// set's keys signed it
+func (ks *KeySet) VerifyAddress(signature string) (AddressClaims, error) {
+	claims := AddressClaims{}
+	token, err := jwt.ParseWithClaims(signature, &claims, ks.keyFunc)
+	if err != nil || !token.Valid {
+		return AddressClaims{}, errors.New("Invalid address signature")
+	}
+	return claims, nil
+}
+
+// AddressMessage is what a user signs to counter-sign one of their
+// addresses. extensions is the JSON object the address is returned with,
+// with its keys sorted and no whitespace, or empty if there are none.
+func AddressMessage(alias string, addressType int, address, extensions string) []byte {
+	return []byte("opencap-address-v1\n" + alias + "\n" + strconv.Itoa(addressType) + "\n" + address + "\n" + extensions)
+}
+
+// VerifyUserSignature checks a user's Ed25519 signature of a message, the
+// public key and signature are unpadded base64url
+func VerifyUserSignature(publicKey, signature string, message []byte) error {
+	key, err := base64.RawURLEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("user_public_key must be an unpadded base64url Ed25519 public key")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.New("user_signature must be an unpadded base64url Ed25519 signature")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), message, sig) {
+		return errors.New("user_signature doesn't match the address")
+	}
+	return nil
+}
+
+// DNSRecords returns a TXT record value for each of the key set's public
+// keys. Publishing them under _opencap-keys.<domain> pins the keys served at
+// the well-known endpoint, so the web server alone can't replace them.
+func (ks *KeySet) DNSRecords() []string {
+	records := make([]string, 0, len(ks.verification))
+	for _, jwk := range ks.JWKS().Keys {
+		records = append(records, "v=opencap1; kid="+jwk.KeyID)
+	}
+	return records
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestVerifyUserSignature(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	message := AddressMessage("username$example.com", 600, "rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf", `{"destination_tag":12345}`)
+	publicKey := base64.RawURLEncoding.EncodeToString(public)
+	signature := base64.RawURLEncoding.EncodeToString(ed25519.Sign(private, message))
+
+	assert.Nil(t, VerifyUserSignature(publicKey, signature, message))
+
+	tampered := AddressMessage("username$example.com", 600, "rGWrZyQqhTp9Xu7G5Pkayo7bXjH4k4QYpf", `{"destination_tag":54321}`)
+	assert.NotNil(t, VerifyUserSignature(publicKey, signature, tampered))
+	assert.NotNil(t, VerifyUserSignature(publicKey[1:], signature, message))
+	assert.NotNil(t, VerifyUserSignature(publicKey, signature+"=", message))
+}
+
+func TestSignAddress(t *testing.T) {
+	edPrivate, _ := ed25519PEM(t)
+	key, err := ParseKey(edPrivate)
+	assert.Nil(t, err)
+	ks, err := NewKeySet(key)
+	assert.Nil(t, err)
+
+	signature, err := ks.SignAddress(AddressClaims{Alias: "username$example.com", AddressType: 100, Address: "1DxBaADfhTSWsevbzDghrhKSqQwsBpuM5A"})
+	assert.Nil(t, err)
+	claims, err := ks.VerifyAddress(signature)
+	assert.Nil(t, err)
+	assert.Equal(t, "1DxBaADfhTSWsevbzDghrhKSqQwsBpuM5A", claims.Address)
+
+	other, err := ParseKey(ecPEM(t))
+	assert.Nil(t, err)
+	otherKeys, err := NewKeySet(other)
+	assert.Nil(t, err)
+	_, err = otherKeys.VerifyAddress(signature)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, []string{"v=opencap1; kid=" + key.ID}, ks.DNSRecords())
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIKeyPrefix starts every API key, so they can be told apart from JWTs in
+// the authorization header
+const APIKeyPrefix = "ocak_"
+
+// Operations an API key can be scoped to
+const (
+	// ScopeUpdateAddresses allows publishing addresses, extended keys and
+	// address pools
+	ScopeUpdateAddresses = "addresses:update"
+	// ScopeDeleteAddresses allows deleting addresses and address pools
+	ScopeDeleteAddresses = "addresses:delete"
+	// ScopeReadAddresses allows reading the state of address pools
+	ScopeReadAddresses = "addresses:read"
+)
+
+// Scope allows an operation on one address type, or on every address type
+// if AddressType is 0
+type Scope struct {
+	Operation   string
+	AddressType int
+}
+
+// ParseScope parses a scope written as an operation, optionally followed by
+// a colon and an address type, e.g. "addresses:update:100"
+func ParseScope(s string) (Scope, error) {
+	for _, op := range []string{ScopeUpdateAddresses, ScopeDeleteAddresses, ScopeReadAddresses} {
+		if s == op {
+			return Scope{Operation: op}, nil
+		}
+		if strings.HasPrefix(s, op+":") {
+			addressType, err := strconv.Atoi(s[len(op)+1:])
+			if err != nil || addressType <= 0 {
+				return Scope{}, errors.New("Invalid address type in scope " + s)
+			}
+			return Scope{Operation: op, AddressType: addressType}, nil
+		}
+	}
+	return Scope{}, errors.New("Unknown scope " + s)
+}
+
+func (s Scope) String() string {
+	if s.AddressType == 0 {
+		return s.Operation
+	}
+	return s.Operation + ":" + strconv.Itoa(s.AddressType)
+}
+
+// ParseAllowedIP parses an IP address or CIDR range an API key can be used
+// from
+func ParseAllowedIP(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("Invalid IP address " + s)
+		}
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		} else {
+			ip = ip.To4()
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, errors.New("Invalid IP range " + s)
+	}
+	return ipNet, nil
+}
+
+// APIKey is what Authorize needs to know about an API key
+type APIKey struct {
+	ID         uint
+	Domain     string
+	Username   string
+	Scopes     []Scope
+	AllowedIPs []*net.IPNet // any IP address if empty
+	ExpiresAt  *time.Time
+	Revoked    bool
+}
+
+// Allows returns true if one of the key's scopes allows the operation on
+// the address type
+func (k APIKey) Allows(operation string, addressType int) bool {
+	for _, v := range k.Scopes {
+		if v.Operation == operation && (v.AddressType == 0 || v.AddressType == addressType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k APIKey) allowsIP(ip net.IP) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+	for _, v := range k.AllowedIPs {
+		if ip != nil && v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyStore looks up API keys by their hash
+type APIKeyStore interface {
+	GetAPIKey(keyHash string) (APIKey, error)
+}
+
+// HashAPIKey is how API keys are stored, they are random and long enough
+// that a fast hash is fine
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func authorizeAPIKey(key string, remoteAddr string, apiKeys APIKeyStore, nowUTC time.Time) (*APIKey, error) {
+	apiKey, err := apiKeys.GetAPIKey(HashAPIKey(key))
+	if err != nil {
+		return nil, errors.New("Invalid API key, can't authorize")
+	}
+	if apiKey.Revoked || (apiKey.ExpiresAt != nil && apiKey.ExpiresAt.Before(nowUTC)) {
+		return nil, errors.New("Invalid API key, can't authorize")
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if !apiKey.allowsIP(net.ParseIP(host)) {
+		return nil, errors.New("API key can't be used from this IP address")
+	}
+	return &apiKey, nil
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testAPIKeyStore map[string]APIKey
+
+func (s testAPIKeyStore) GetAPIKey(keyHash string) (APIKey, error) {
+	key, ok := s[keyHash]
+	if !ok {
+		return APIKey{}, errors.New("API key not found")
+	}
+	return key, nil
+}
+
+func TestParseScope(t *testing.T) {
+	scope, err := ParseScope("addresses:update")
+	assert.Nil(t, err)
+	assert.Equal(t, Scope{Operation: ScopeUpdateAddresses}, scope)
+
+	scope, err = ParseScope("addresses:delete:100")
+	assert.Nil(t, err)
+	assert.Equal(t, Scope{Operation: ScopeDeleteAddresses, AddressType: 100}, scope)
+	assert.Equal(t, "addresses:delete:100", scope.String())
+
+	for _, v := range []string{"", "addresses", "addresses:update:", "addresses:update:-1", "addresses:updated", "users:delete"} {
+		_, err = ParseScope(v)
+		assert.NotNil(t, err, v)
+	}
+}
+
+func TestParseAllowedIP(t *testing.T) {
+	vectors := []struct {
+		allowed string
+		ip      string
+		ok      bool
+	}{
+		{"10.0.0.1", "10.0.0.1", true},
+		{"10.0.0.1", "10.0.0.2", false},
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "11.0.0.1", false},
+		{"2001:db8::1", "2001:db8::1", true},
+		{"2001:db8::/32", "2001:db8:1::1", true},
+	}
+	for _, v := range vectors {
+		ipNet, err := ParseAllowedIP(v.allowed)
+		assert.Nil(t, err)
+		assert.Equal(t, v.ok, ipNet.Contains(net.ParseIP(v.ip)), v.allowed+" "+v.ip)
+	}
+
+	_, err := ParseAllowedIP("10.0.0")
+	assert.NotNil(t, err)
+	_, err = ParseAllowedIP("10.0.0.0/33")
+	assert.NotNil(t, err)
+}
+
+func TestAuthorizeAPIKey(t *testing.T) {
+	now := time.Now().UTC()
+	expired := now.Add(-time.Hour)
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	store := testAPIKeyStore{
+		HashAPIKey("ocak_valid"):   {Username: "username", Scopes: []Scope{{ScopeUpdateAddresses, 100}}},
+		HashAPIKey("ocak_expired"): {ExpiresAt: &expired},
+		HashAPIKey("ocak_revoked"): {Revoked: true},
+		HashAPIKey("ocak_local"):   {AllowedIPs: []*net.IPNet{local}},
+	}
+
+	key, err := authorizeAPIKey("ocak_valid", "10.0.0.1:1234", store, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "username", key.Username)
+	assert.True(t, key.Allows(ScopeUpdateAddresses, 100))
+	assert.False(t, key.Allows(ScopeUpdateAddresses, 300))
+	assert.False(t, key.Allows(ScopeDeleteAddresses, 100))
+
+	_, err = authorizeAPIKey("ocak_local", "127.0.0.1:1234", store, now)
+	assert.Nil(t, err)
+
+	for _, v := range []string{"ocak_unknown", "ocak_expired", "ocak_revoked", "ocak_local"} {
+		_, err = authorizeAPIKey(v, "10.0.0.1:1234", store, now)
+		assert.NotNil(t, err, v)
+	}
+}
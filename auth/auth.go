@@ -8,12 +8,8 @@ import (
 	"unicode"
 
 	jwt "github.com/dgrijalva/jwt-go"
-	"golang.org/x/crypto/bcrypt"
 )
 
-// GLOBAL, TREAT LIKE CONSTANT
-var globalJWTSigningMethod = jwt.SigningMethodHS256
-
 const (
 	// MinPassLength is the minimum length allowable for passwords
 	MinPassLength = 8
@@ -29,13 +25,20 @@ const (
 	MinPasswordLength = 8
 )
 
-// Claims for JWT
+// Claims for JWT, StandardClaims.Id is the token identifier (jti) of the
+// session the token was issued for
 type Claims struct {
 	Domain   string `json:"domain"`
 	Username string `json:"username"`
 	jwt.StandardClaims
 }
 
+// RevocationList tells whether the session a token was issued for has been
+// revoked
+type RevocationList interface {
+	IsTokenRevoked(tokenID string) (bool, error)
+}
+
 // ValidatePassword returns true if string is a valid password format
 // At least one upper case English letter
 // At least one lower case English letter
@@ -60,78 +63,102 @@ func ValidatePassword(password string) bool {
 		}
 		length++
 	}
-	return (length > MinPasswordLength) && number && upper && special
+	return (length > MinPasswordLength) && length <= MaxPassLength && number && upper && special
 }
 
-// HashPassword hashes a password securely
-func HashPassword(password string) (string, error) {
-	const cost = 10 // min=4, max=31, default=10
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), cost)
-	return string(bytes), err
-}
-
-// CheckPasswordHash checks a password hash
-func CheckPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
-}
-
-// MakeToken makes a new jwt token for a user
-func MakeToken(domain, username, secret string, nowUTC time.Time, expiresIn time.Duration) (string, error) {
-	signingKey := []byte(secret)
-
+// MakeToken makes a new jwt token for a user's session
+func MakeToken(domain, username, tokenID string, keys *KeySet, nowUTC time.Time, expiresIn time.Duration) (string, error) {
 	claims := Claims{
 		Username: username,
 		Domain:   domain,
 		StandardClaims: jwt.StandardClaims{
+			Id:        tokenID,
 			Issuer:    domain,
 			IssuedAt:  nowUTC.Unix(),
 			ExpiresAt: nowUTC.Add(expiresIn).Unix(),
 		},
 	}
 
-	token := jwt.NewWithClaims(globalJWTSigningMethod, claims)
-	return token.SignedString(signingKey)
+	return keys.sign(claims)
 }
 
-// ValidateToken returns the username and domain associate with the token
-// if it is valid
-func ValidateToken(tokenString, secret string, nowUTC time.Time) (string, string, error) {
-	signingKey := []byte(secret)
-
+// ValidateToken returns the username, domain and token identifier associated
+// with the token if it is valid
+func ValidateToken(tokenString string, keys *KeySet, nowUTC time.Time) (string, string, string, error) {
 	claimsStructure := Claims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStructure,
-		func(token *jwt.Token) (interface{}, error) { return signingKey, nil },
+		keys.keyFunc,
 	)
 	if err != nil {
-		return "", "", errors.New("Couldn't parse claims")
+		return "", "", "", errors.New("Couldn't parse claims")
 	}
 	claims, ok := token.Claims.(*Claims)
 	if !ok || !token.Valid {
-		return "", "", errors.New("Couldn't parse claims")
+		return "", "", "", errors.New("Couldn't parse claims")
 	}
 
 	if claims.ExpiresAt < nowUTC.Unix() {
-		return "", "", errors.New("Expired token")
+		return "", "", "", errors.New("Expired token")
 	}
 
-	return claims.Domain, claims.Username, nil
+	return claims.Domain, claims.Username, claims.Id, nil
+}
+
+// Authorization is who a request was authorized as. TokenID is set for JWTs
+// and APIKey for API keys.
+type Authorization struct {
+	Domain   string
+	Username string
+	TokenID  string
+	APIKey   *APIKey
 }
 
-// Authorize takes the headers and returns the username of the user if the token is valid
-func Authorize(headers http.Header, secret string) (string, string, error) {
-	authString := headers.Get("Authorization")
+// Allows returns true if the request may perform the operation on the
+// address type. JWTs allow everything, API keys only what their scopes do.
+func (a Authorization) Allows(operation string, addressType int) bool {
+	if a.APIKey == nil {
+		return true
+	}
+	return a.APIKey.Allows(operation, addressType)
+}
+
+// Authorize takes the request and returns who it is authorized as, if its
+// bearer token is a valid JWT whose session hasn't been revoked or an API
+// key that is valid from the request's IP address
+func Authorize(req *http.Request, keys *KeySet, revocations RevocationList, apiKeys APIKeyStore) (Authorization, error) {
+	authString := req.Header.Get("Authorization")
 	splitAuth := strings.Split(authString, " ")
 	if len(splitAuth) < 2 || splitAuth[0] != "Bearer" {
-		return "", "", errors.New("Malformed authorization header")
+		return Authorization{}, errors.New("Malformed authorization header")
+	}
+
+	if strings.HasPrefix(splitAuth[1], APIKeyPrefix) {
+		apiKey, err := authorizeAPIKey(splitAuth[1], req.RemoteAddr, apiKeys, time.Now().UTC())
+		if err != nil {
+			return Authorization{}, err
+		}
+		return Authorization{Domain: apiKey.Domain, Username: apiKey.Username, APIKey: apiKey}, nil
 	}
 
 	// Verify the token
-	domain, username, err := ValidateToken(splitAuth[1], secret, time.Now().UTC())
+	domain, username, tokenID, err := ValidateToken(splitAuth[1], keys, time.Now().UTC())
 	if err != nil {
-		return "", "", errors.New("Invalid JWT, can't authorize")
+		return Authorization{}, errors.New("Invalid JWT, can't authorize")
+	}
+
+	// Tokens without an identifier were issued before sessions could be
+	// revoked, so they can't be trusted
+	if tokenID == "" {
+		return Authorization{}, errors.New("Revoked JWT, can't authorize")
+	}
+	revoked, err := revocations.IsTokenRevoked(tokenID)
+	if err != nil {
+		return Authorization{}, err
+	}
+	if revoked {
+		return Authorization{}, errors.New("Revoked JWT, can't authorize")
 	}
-	return domain, username, nil
+	return Authorization{Domain: domain, Username: username, TokenID: tokenID}, nil
 }
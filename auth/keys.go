@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"sort"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Key is a key tokens are signed or verified with. Keys loaded from PEM files
+// are identified by the JWK thumbprint of their public key, which is sent as
+// the kid of the tokens they sign. The HMAC key has no ID.
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	private interface{} // nil if the key can only verify
+	public  interface{}
+}
+
+// CanSign returns true if the key has its private half
+func (k Key) CanSign() bool {
+	return k.private != nil
+}
+
+// HMACKey returns an HS256 key for a shared secret
+func HMACKey(secret string) Key {
+	return Key{
+		Method:  jwt.SigningMethodHS256,
+		private: []byte(secret),
+		public:  []byte(secret),
+	}
+}
+
+// LoadKeyFile loads a key from a PEM file, see ParseKey
+func LoadKeyFile(path string) (Key, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Key{}, err
+	}
+	return ParseKey(b)
+}
+
+var oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+type pkcs8 struct {
+	Version    int
+	Algorithm  pkix
+	PrivateKey []byte
+}
+
+type pkix struct {
+	Algorithm asn1.ObjectIdentifier
+}
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix
+	PublicKey asn1.BitString
+}
+
+// ParseKey parses a PEM encoded RSA, ECDSA (P-256, P-384 or P-521) or Ed25519
+// key. Private keys can sign and verify, public keys can only verify.
+func ParseKey(b []byte) (Key, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return Key{}, errors.New("No PEM data found")
+	}
+
+	var private, public interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = parsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		public, err = parsePKIXPublicKey(block.Bytes)
+	default:
+		return Key{}, errors.New("Unsupported PEM block " + block.Type)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		public = &k.PublicKey
+	case *ecdsa.PrivateKey:
+		public = &k.PublicKey
+	case ed25519.PrivateKey:
+		public = k.Public()
+	}
+
+	key := Key{private: private, public: public}
+	switch k := public.(type) {
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			key.Method = jwt.SigningMethodES256
+		case elliptic.P384():
+			key.Method = jwt.SigningMethodES384
+		case elliptic.P521():
+			key.Method = jwt.SigningMethodES512
+		default:
+			return Key{}, errors.New("Unsupported elliptic curve")
+		}
+	case ed25519.PublicKey:
+		key.Method = SigningMethodEdDSA
+	default:
+		return Key{}, errors.New("Unsupported key type")
+	}
+
+	key.ID, err = key.thumbprint()
+	return key, err
+}
+
+// Ed25519 keys are parsed by hand as crypto/x509 doesn't support them
+func parsePKCS8PrivateKey(der []byte) (interface{}, error) {
+	var info pkcs8
+	if _, err := asn1.Unmarshal(der, &info); err == nil && info.Algorithm.Algorithm.Equal(oidEd25519) {
+		var seed []byte
+		if _, err := asn1.Unmarshal(info.PrivateKey, &seed); err != nil || len(seed) != ed25519.SeedSize {
+			return nil, errors.New("Invalid Ed25519 private key")
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	return x509.ParsePKCS8PrivateKey(der)
+}
+
+func parsePKIXPublicKey(der []byte) (interface{}, error) {
+	var info subjectPublicKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err == nil && info.Algorithm.Algorithm.Equal(oidEd25519) {
+		if len(info.PublicKey.Bytes) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid Ed25519 public key")
+		}
+		return ed25519.PublicKey(info.PublicKey.Bytes), nil
+	}
+	return x509.ParsePKIXPublicKey(der)
+}
+
+// JWK is a public key in JSON Web Key format
+// https://tools.ietf.org/html/rfc7517
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func base64URL(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// paddedBytes returns n as a big endian number size bytes long
+func paddedBytes(n *big.Int, size int) []byte {
+	b := make([]byte, size)
+	nb := n.Bytes()
+	copy(b[size-len(nb):], nb)
+	return b
+}
+
+// JWK returns the public half of an asymmetric key
+func (k Key) JWK() (JWK, error) {
+	jwk := JWK{
+		KeyID:     k.ID,
+		Use:       "sig",
+		Algorithm: k.Method.Alg(),
+	}
+	switch public := k.public.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64URL(public.N.Bytes())
+		jwk.E = base64URL(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = public.Curve.Params().Name
+		jwk.X = base64URL(paddedBytes(public.X, size))
+		jwk.Y = base64URL(paddedBytes(public.Y, size))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64URL(public)
+	default:
+		return JWK{}, errors.New("Only asymmetric keys can be published")
+	}
+	return jwk, nil
+}
+
+// thumbprint returns the JWK thumbprint of the key's public half, the members
+// are written by hand as they have to be in lexicographic order
+// https://tools.ietf.org/html/rfc7638
+func (k Key) thumbprint() (string, error) {
+	jwk, err := k.JWK()
+	if err != nil {
+		return "", err
+	}
+	var canonical string
+	switch jwk.KeyType {
+	case "RSA":
+		canonical = `{"e":"` + jwk.E + `","kty":"RSA","n":"` + jwk.N + `"}`
+	case "EC":
+		canonical = `{"crv":"` + jwk.Curve + `","kty":"EC","x":"` + jwk.X + `","y":"` + jwk.Y + `"}`
+	case "OKP":
+		canonical = `{"crv":"` + jwk.Curve + `","kty":"OKP","x":"` + jwk.X + `"}`
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64URL(sum[:]), nil
+}
+
+// KeySet is the key new tokens are signed with and every key tokens are
+// accepted from. Keeping the previous key in the set after a rotation lets
+// the tokens it signed stay valid until they expire.
+type KeySet struct {
+	signing      Key
+	verification map[string]Key
+}
+
+// NewKeySet returns a key set that signs with the signing key and verifies
+// with it and the verification keys
+func NewKeySet(signing Key, verification ...Key) (*KeySet, error) {
+	if !signing.CanSign() {
+		return nil, errors.New("Signing key must be a private key")
+	}
+	ks := &KeySet{
+		signing:      signing,
+		verification: map[string]Key{signing.ID: signing},
+	}
+	for _, k := range verification {
+		if _, ok := ks.verification[k.ID]; ok {
+			continue
+		}
+		ks.verification[k.ID] = k
+	}
+	return ks, nil
+}
+
+// JWKS returns the asymmetric verification keys, which anyone can use to
+// verify tokens
+func (ks *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: make([]JWK, 0, len(ks.verification))}
+	for _, k := range ks.verification {
+		if jwk, err := k.JWK(); err == nil {
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].KeyID < jwks.Keys[j].KeyID })
+	return jwks
+}
+
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signing.Method, claims)
+	if ks.signing.ID != "" {
+		token.Header["kid"] = ks.signing.ID
+	}
+	return token.SignedString(ks.signing.private)
+}
+
+// keyFunc finds the verification key of a token by its kid, tokens signed with
+// a different algorithm than their key's are rejected
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	k, ok := ks.verification[kid]
+	if !ok {
+		return nil, errors.New("Unknown key")
+	}
+	if token.Method.Alg() != k.Method.Alg() {
+		return nil, errors.New("Unexpected signing method")
+	}
+	return k.public, nil
+}
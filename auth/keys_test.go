@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+func rsaPEM(t *testing.T) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func ecPEM(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func ed25519PEM(t *testing.T) ([]byte, []byte) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	seed, err := asn1.Marshal(private.Seed())
+	assert.Nil(t, err)
+	privateDER, err := asn1.Marshal(pkcs8{Algorithm: pkix{Algorithm: oidEd25519}, PrivateKey: seed})
+	assert.Nil(t, err)
+	publicDER, err := asn1.Marshal(subjectPublicKeyInfo{
+		Algorithm: pkix{Algorithm: oidEd25519},
+		PublicKey: asn1.BitString{Bytes: public, BitLength: len(public) * 8},
+	})
+	assert.Nil(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+}
+
+func TestParseKey(t *testing.T) {
+	edPrivate, edPublic := ed25519PEM(t)
+	vectors := []struct {
+		pem     []byte
+		alg     string
+		canSign bool
+	}{
+		{rsaPEM(t), "RS256", true},
+		{ecPEM(t), "ES256", true},
+		{edPrivate, "EdDSA", true},
+		{edPublic, "EdDSA", false},
+	}
+	for _, v := range vectors {
+		key, err := ParseKey(v.pem)
+		assert.Nil(t, err)
+		assert.Equal(t, v.alg, key.Method.Alg())
+		assert.Equal(t, v.canSign, key.CanSign())
+		assert.NotEqual(t, "", key.ID)
+	}
+
+	// The private and public halves have the same ID
+	privateKey, err := ParseKey(edPrivate)
+	assert.Nil(t, err)
+	publicKey, err := ParseKey(edPublic)
+	assert.Nil(t, err)
+	assert.Equal(t, privateKey.ID, publicKey.ID)
+
+	_, err = ParseKey([]byte("not a key"))
+	assert.NotNil(t, err)
+}
+
+func TestKeyThumbprint(t *testing.T) {
+	// RFC 7638 section 3.1
+	const n = "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw"
+	const thumbprint = "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"
+
+	nBytes, err := jwt.DecodeSegment(n)
+	assert.Nil(t, err)
+	key := Key{
+		Method: jwt.SigningMethodRS256,
+		public: &rsa.PublicKey{N: new(big.Int).SetBytes(nBytes), E: 65537},
+	}
+	id, err := key.thumbprint()
+	assert.Nil(t, err)
+	assert.Equal(t, thumbprint, id)
+}
+
+func TestKeySetRotation(t *testing.T) {
+	oldKey, err := ParseKey(ecPEM(t))
+	assert.Nil(t, err)
+	edPrivate, _ := ed25519PEM(t)
+	newKey, err := ParseKey(edPrivate)
+	assert.Nil(t, err)
+	now := time.Now().UTC()
+
+	oldKeys, err := NewKeySet(oldKey)
+	assert.Nil(t, err)
+	oldToken, err := MakeToken("example.com", "username", "id", oldKeys, now, time.Hour)
+	assert.Nil(t, err)
+
+	// Tokens signed with the previous key are valid after a rotation
+	rotated, err := NewKeySet(newKey, oldKey)
+	assert.Nil(t, err)
+	newToken, err := MakeToken("example.com", "username", "id", rotated, now, time.Hour)
+	assert.Nil(t, err)
+	for _, token := range []string{oldToken, newToken} {
+		domain, username, tokenID, err := ValidateToken(token, rotated, now)
+		assert.Nil(t, err)
+		assert.Equal(t, "example.com", domain)
+		assert.Equal(t, "username", username)
+		assert.Equal(t, "id", tokenID)
+	}
+	assert.Equal(t, 2, len(rotated.JWKS().Keys))
+
+	// Until the previous key is removed
+	newKeys, err := NewKeySet(newKey)
+	assert.Nil(t, err)
+	_, _, _, err = ValidateToken(oldToken, newKeys, now)
+	assert.NotNil(t, err)
+	_, _, _, err = ValidateToken(newToken, newKeys, now)
+	assert.Nil(t, err)
+
+	// Verification only keys can't sign
+	_, publicPEM := ed25519PEM(t)
+	publicKey, err := ParseKey(publicPEM)
+	assert.Nil(t, err)
+	_, err = NewKeySet(publicKey)
+	assert.NotNil(t, err)
+}
+
+func TestKeySetRejectsOtherAlgorithms(t *testing.T) {
+	const secret = "DFUIJHSDFAJDLFHBSDFLSDFHJSALFIGHDSFKGHDFLKG"
+	key, err := ParseKey(rsaPEM(t))
+	assert.Nil(t, err)
+	keys, err := NewKeySet(key, HMACKey(secret))
+	assert.Nil(t, err)
+	now := time.Now().UTC()
+
+	// An HS256 token claiming the RSA key's kid isn't accepted
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		Username:       "username",
+		Domain:         "example.com",
+		StandardClaims: jwt.StandardClaims{ExpiresAt: now.Add(time.Hour).Unix()},
+	})
+	token.Header["kid"] = key.ID
+	signed, err := token.SignedString([]byte(secret))
+	assert.Nil(t, err)
+	_, _, _, err = ValidateToken(signed, keys, now)
+	assert.NotNil(t, err)
+
+	// Without a kid it's checked against the HMAC key
+	delete(token.Header, "kid")
+	signed, err = token.SignedString([]byte(secret))
+	assert.Nil(t, err)
+	_, _, _, err = ValidateToken(signed, keys, now)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing schemes
+const (
+	SchemeArgon2id = "argon2id"
+	SchemeBcrypt   = "bcrypt"
+)
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+	// bcrypt ignores everything after the first 72 bytes of a password
+	bcryptMaxPasswordBytes = 72
+)
+
+// PasswordHashing is how new password hashes are made. Hashes made any other
+// way can still be checked, NeedsRehash tells when to replace them.
+type PasswordHashing struct {
+	Scheme        string
+	Argon2Time    uint32
+	Argon2Memory  uint32 // KiB
+	Argon2Threads uint8
+	BcryptCost    int
+}
+
+// DefaultPasswordHashing returns argon2id with the second set of parameters
+// recommended by RFC 9106
+func DefaultPasswordHashing() PasswordHashing {
+	return PasswordHashing{
+		Scheme:        SchemeArgon2id,
+		Argon2Time:    3,
+		Argon2Memory:  64 * 1024,
+		Argon2Threads: 4,
+		BcryptCost:    bcrypt.DefaultCost,
+	}
+}
+
+// Validate checks the parameters of the selected scheme
+func (h PasswordHashing) Validate() error {
+	switch h.Scheme {
+	case SchemeArgon2id:
+		if h.Argon2Time < 1 || h.Argon2Threads < 1 || h.Argon2Memory < 8*uint32(h.Argon2Threads) {
+			return errors.New("Argon2 time and threads must be at least 1 and memory at least 8 KiB per thread")
+		}
+	case SchemeBcrypt:
+		if h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %v and %v", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return errors.New("Unsupported password hashing scheme " + h.Scheme)
+	}
+	return nil
+}
+
+// argon2Hash is a parsed argon2id hash in PHC string format
+// https://github.com/P-H-C/phc-string-format/blob/master/phc-sf-spec.md
+type argon2Hash struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+var phcEncoding = base64.RawStdEncoding
+
+func (a argon2Hash) String() string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.memory, a.time, a.threads,
+		phcEncoding.EncodeToString(a.salt), phcEncoding.EncodeToString(a.key))
+}
+
+func parseArgon2Hash(hash string) (argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != SchemeArgon2id {
+		return argon2Hash{}, errors.New("Not an argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return argon2Hash{}, errors.New("Unsupported argon2 version")
+	}
+
+	a := argon2Hash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &a.memory, &a.time, &a.threads); err != nil {
+		return argon2Hash{}, errors.New("Invalid argon2 parameters")
+	}
+	var err error
+	if a.salt, err = phcEncoding.DecodeString(parts[4]); err != nil {
+		return argon2Hash{}, errors.New("Invalid argon2 salt")
+	}
+	if a.key, err = phcEncoding.DecodeString(parts[5]); err != nil || len(a.key) == 0 {
+		return argon2Hash{}, errors.New("Invalid argon2 hash")
+	}
+	return a, nil
+}
+
+// HashPassword hashes a password securely
+func HashPassword(password string, h PasswordHashing) (string, error) {
+	switch h.Scheme {
+	case SchemeArgon2id:
+		a := argon2Hash{
+			time:    h.Argon2Time,
+			memory:  h.Argon2Memory,
+			threads: h.Argon2Threads,
+			salt:    make([]byte, argon2SaltLength),
+		}
+		if _, err := rand.Read(a.salt); err != nil {
+			return "", err
+		}
+		a.key = argon2.IDKey([]byte(password), a.salt, a.time, a.memory, a.threads, argon2KeyLength)
+		return a.String(), nil
+	case SchemeBcrypt:
+		if len(password) > bcryptMaxPasswordBytes {
+			return "", errors.New("Password is too long")
+		}
+		bytes, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		return string(bytes), err
+	}
+	return "", errors.New("Unsupported password hashing scheme " + h.Scheme)
+}
+
+// CheckPasswordHash checks a password against an argon2id or bcrypt hash
+func CheckPasswordHash(password, hash string) bool {
+	if strings.HasPrefix(hash, "$"+SchemeArgon2id+"$") {
+		a, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false
+		}
+		key := argon2.IDKey([]byte(password), a.salt, a.time, a.memory, a.threads, uint32(len(a.key)))
+		return subtle.ConstantTimeCompare(key, a.key) == 1
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	return err == nil
+}
+
+// NeedsRehash returns true if a hash wasn't made with the scheme and
+// parameters of h, so it should be replaced the next time the password is
+// known
+func NeedsRehash(hash string, h PasswordHashing) bool {
+	switch h.Scheme {
+	case SchemeArgon2id:
+		a, err := parseArgon2Hash(hash)
+		return err != nil || a.time != h.Argon2Time || a.memory != h.Argon2Memory ||
+			a.threads != h.Argon2Threads || len(a.salt) != argon2SaltLength || len(a.key) != argon2KeyLength
+	case SchemeBcrypt:
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != h.BcryptCost
+	}
+	return false
+}
+
+var (
+	dummyHashes      = map[PasswordHashing]string{}
+	dummyHashesMutex sync.Mutex
+)
+
+// SimulatePasswordCheck takes as long as CheckPasswordHash with a hash made
+// by h, it's used for unknown users so they can't be told apart from known
+// ones by timing
+func SimulatePasswordCheck(password string, h PasswordHashing) {
+	dummyHashesMutex.Lock()
+	dummyHash, ok := dummyHashes[h]
+	if !ok {
+		dummyHash, _ = HashPassword("dummy password", h)
+		dummyHashes[h] = dummyHash
+	}
+	dummyHashesMutex.Unlock()
+
+	CheckPasswordHash(password, dummyHash)
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testPassword = "Super@35Secure"
+
+func testArgon2Hashing() PasswordHashing {
+	h := DefaultPasswordHashing()
+	h.Argon2Time = 1
+	h.Argon2Memory = 1024
+	h.Argon2Threads = 1
+	return h
+}
+
+func TestHashPasswordArgon2id(t *testing.T) {
+	h := testArgon2Hashing()
+	hash, err := HashPassword(testPassword, h)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"))
+	assert.True(t, CheckPasswordHash(testPassword, hash))
+	assert.False(t, CheckPasswordHash(testPassword+"!", hash))
+	assert.False(t, NeedsRehash(hash, h))
+
+	// Salts are random
+	other, err := HashPassword(testPassword, h)
+	assert.Nil(t, err)
+	assert.NotEqual(t, hash, other)
+
+	h.Argon2Time = 2
+	assert.True(t, NeedsRehash(hash, h))
+}
+
+func TestHashPasswordBcrypt(t *testing.T) {
+	h := testArgon2Hashing()
+	h.Scheme = SchemeBcrypt
+	h.BcryptCost = bcrypt.MinCost
+	hash, err := HashPassword(testPassword, h)
+	assert.Nil(t, err)
+	assert.True(t, CheckPasswordHash(testPassword, hash))
+	assert.False(t, NeedsRehash(hash, h))
+
+	// bcrypt hashes still work once argon2id is used, but get replaced
+	assert.True(t, NeedsRehash(hash, testArgon2Hashing()))
+	h.BcryptCost++
+	assert.True(t, NeedsRehash(hash, h))
+
+	// bcrypt would ignore the end of the password
+	_, err = HashPassword(strings.Repeat("a", 73), h)
+	assert.NotNil(t, err)
+}
+
+func TestPasswordHashingValidate(t *testing.T) {
+	assert.Nil(t, DefaultPasswordHashing().Validate())
+
+	h := DefaultPasswordHashing()
+	h.Scheme = "md5"
+	assert.NotNil(t, h.Validate())
+
+	h = DefaultPasswordHashing()
+	h.Argon2Threads = 0
+	assert.NotNil(t, h.Validate())
+
+	h = DefaultPasswordHashing()
+	h.Scheme = SchemeBcrypt
+	h.BcryptCost = 50
+	assert.NotNil(t, h.Validate())
+}
+
+func TestValidatePasswordLength(t *testing.T) {
+	assert.True(t, ValidatePassword(testPassword))
+	assert.False(t, ValidatePassword(testPassword+strings.Repeat("a", MaxPassLength)))
+}
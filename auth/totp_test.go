@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHOTP(t *testing.T) {
+	// RFC 6238 appendix B, SHA1
+	key := []byte("12345678901234567890")
+	vectors := []struct {
+		time int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, v := range vectors {
+		assert.Equal(t, v.code, hotp(key, uint64(v.time/totpPeriod), 8))
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111109, 0)
+
+	// 07081804 with 8 digits is 081804 with 6
+	step, ok := ValidateTOTP(secret, "081804", now)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1111111109/totpPeriod), step)
+
+	// The previous and next time steps are accepted too
+	_, ok = ValidateTOTP(secret, "081804", now.Add(totpPeriod*time.Second))
+	assert.True(t, ok)
+	_, ok = ValidateTOTP(secret, "081804", now.Add(2*totpPeriod*time.Second))
+	assert.False(t, ok)
+
+	_, ok = ValidateTOTP(secret, "081805", now)
+	assert.False(t, ok)
+	_, ok = ValidateTOTP(secret, "81804", now)
+	assert.False(t, ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	assert.Nil(t, err)
+	assert.Equal(t, 32, len(secret))
+
+	uri := TOTPURI("example.com", "username$example.com", secret)
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/example.com:username$example.com?"))
+	assert.True(t, strings.Contains(uri, "secret="+secret))
+}
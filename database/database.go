@@ -1,6 +1,9 @@
 package database
 
-import "time"
+import (
+	"errors"
+	"time"
+)
 
 // Model overrides gorm.Model
 type Model struct {
@@ -15,7 +18,14 @@ type User struct {
 	Username  string    `gorm:"type:varchar(30);unique_index:idx_domain_username;not null" json:"username"`
 	Password  string    `gorm:"not null" json:"password"`
 	Domain    string    `gorm:"not null;unique_index:idx_domain_username" json:"domain"`
+	Disabled  bool      `gorm:"not null;default:false" json:"disabled"`
 	Addresses []Address `json:"addresses"`
+
+	// TOTPSecret is set when 2FA enrollment starts, 2FA is only required
+	// once TOTPEnabled is set by confirming a code
+	TOTPSecret      string `json:"-"`
+	TOTPEnabled     bool   `gorm:"not null;default:false" json:"totp_enabled"`
+	TOTPLastCounter int64  `gorm:"not null;default:0" json:"-"` // stops codes being used twice
 }
 
 // Address represents a crypto address and it's address type
@@ -24,16 +34,219 @@ type Address struct {
 	UserID      uint   `gorm:"not null;unique_index:idx_userid_type"`
 	Address     string `gorm:"not null" json:"address"`
 	AddressType int    `gorm:"not null;unique_index:idx_userid_type" json:"address_type"`
+	Extensions  string `gorm:"type:text" json:"extensions"` // JSON object, empty if there are none
+
+	// UserSignature is the user's own Ed25519 signature of the address,
+	// made with a key the server never holds
+	UserPublicKey string `json:"user_public_key"`
+	UserSignature string `json:"user_signature"`
+}
+
+// Address change actions
+const (
+	// AddressChangeUpdate publishes an address or an extended key
+	AddressChangeUpdate = "update"
+	// AddressChangeRestore publishes an address from an earlier change
+	AddressChangeRestore = "restore"
+	// AddressChangeDelete deletes an address
+	AddressChangeDelete = "delete"
+	// AddressChangePool uploads an address pool, Address is its first
+	// address
+	AddressChangePool = "pool"
+	// AddressChangeDeletePool deletes an address pool
+	AddressChangeDeletePool = "delete_pool"
+)
+
+// AddressChange is an entry in the history of a user's addresses. Changes
+// are only ever added, and are kept when the address is deleted. Deleting
+// the user only soft deletes them, so they can still be looked into if the
+// account was taken over. Addresses handed out from extended keys and pools
+// aren't recorded, only publishing them is.
+type AddressChange struct {
+	Model
+	UserID        uint       `gorm:"not null;index" json:"-"`
+	AddressType   int        `gorm:"not null" json:"address_type"`
+	Action        string     `gorm:"not null" json:"action"`
+	Address       string     `json:"address"` // empty for deletes
+	Extensions    string     `gorm:"type:text" json:"extensions"`
+	ExtendedKey   string     `gorm:"type:text" json:"extended_key,omitempty"`
+	RotateEvery   uint       `json:"rotate_every,omitempty"` // set if ExtendedKey is
+	UserPublicKey string     `json:"user_public_key,omitempty"`
+	UserSignature string     `json:"user_signature,omitempty"`
+	Actor         string     `gorm:"not null" json:"actor"` // "user" or "api_key:<id>"
+	RemoteAddr    string     `json:"remote_addr"`
+	DeletedAt     *time.Time `sql:"index" json:"-"`
+}
+
+// ExtendedKey is an extended public key published instead of a single
+// address. Lookups are served receive addresses derived from it, moving to
+// the next derivation index every RotateEvery lookups. Lookups are counted by
+// each server process, only the derivation index is stored.
+//
+// Replaced and deleted keys are soft deleted so publishing one again goes on
+// from the derivation index it had reached.
+type ExtendedKey struct {
+	Model
+	UserID          uint       `gorm:"not null;index:idx_extended_key_user_type"`
+	AddressType     int        `gorm:"not null;index:idx_extended_key_user_type" json:"address_type"`
+	PublicKey       string     `gorm:"type:text;not null" json:"-"`
+	DerivationIndex uint32     `gorm:"not null" json:"derivation_index"`
+	RotateEvery     uint       `gorm:"not null" json:"rotate_every"`
+	DeletedAt       *time.Time `sql:"index" json:"-"`
+}
+
+// Address pool modes
+const (
+	// PoolModeRoundRobin serves the pooled addresses in turn forever
+	PoolModeRoundRobin = "round_robin"
+	// PoolModeUseOnce serves each pooled address to a single lookup
+	PoolModeUseOnce = "use_once"
+)
+
+// ErrPoolEmpty is returned when a use once pool has no addresses left
+var ErrPoolEmpty = errors.New("Address pool is empty")
+
+// AddressPool is a list of addresses uploaded for an address type. Lookups
+// are served from it instead of a single address.
+type AddressPool struct {
+	Model
+	UserID       uint   `gorm:"not null;unique_index:idx_address_pool_userid_type"`
+	AddressType  int    `gorm:"not null;unique_index:idx_address_pool_userid_type" json:"address_type"`
+	Mode         string `gorm:"not null" json:"mode"`
+	LowWatermark int    `gorm:"not null" json:"low_watermark"`
+	NextPosition uint   `gorm:"not null" json:"-"` // used by round robin pools
+}
+
+// PooledAddress is one of the addresses of an AddressPool
+type PooledAddress struct {
+	Model
+	AddressPoolID uint   `gorm:"not null;index"`
+	Position      uint   `gorm:"not null"`
+	Address       string `gorm:"not null" json:"address"`
+	Used          bool   `gorm:"not null" json:"used"`
+}
+
+// AdminAction records something an administrator did through the admin API
+type AdminAction struct {
+	Model
+	Action     string `gorm:"not null" json:"action"`
+	UserID     uint   `json:"user_id"`
+	Alias      string `json:"alias"`
+	RemoteAddr string `json:"remote_addr"`
+}
+
+// ErrInviteCodeInvalid is returned when an invite code doesn't exist, has
+// expired, has been revoked or used up, or doesn't allow the user
+var ErrInviteCodeInvalid = errors.New("Invalid invite code")
+
+// InviteCode lets someone create a user without the create user password.
+// Only a hash of the code is stored. Username and Domain restrict which user
+// can be created with it if they are set.
+type InviteCode struct {
+	Model
+	CodeHash  string     `gorm:"not null;unique_index" json:"-"`
+	Username  string     `json:"username"`
+	Domain    string     `json:"domain"`
+	MaxUses   uint       `gorm:"not null" json:"max_uses"`
+	Uses      uint       `gorm:"not null" json:"uses"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Revoked   bool       `gorm:"not null;default:false" json:"revoked"`
+}
+
+// ErrSessionNotFound is returned when a refresh token doesn't belong to an
+// active session
+var ErrSessionNotFound = errors.New("Session not found")
+
+// Session is created at login. Its access tokens carry TokenID as their jti,
+// and it can be extended with its refresh token, of which only a hash is
+// stored. Revoking a session invalidates all of its tokens.
+type Session struct {
+	Model
+	UserID           uint      `gorm:"not null;index"`
+	TokenID          string    `gorm:"not null;unique_index"`
+	RefreshTokenHash string    `gorm:"not null;unique_index"`
+	ExpiresAt        time.Time `gorm:"not null"`
+	Revoked          bool      `gorm:"not null;default:false"`
+}
+
+// Recovery code purposes
+const (
+	// RecoveryCodeTwoFactor codes can be used once instead of a TOTP code
+	RecoveryCodeTwoFactor = "2fa"
+	// RecoveryCodeAccount codes can be used once to set a new password
+	RecoveryCodeAccount = "account"
+)
+
+// RecoveryCode is a one time code, only a hash of the code is stored
+type RecoveryCode struct {
+	Model
+	UserID   uint   `gorm:"not null;index"`
+	Purpose  string `gorm:"not null;default:'2fa'"`
+	CodeHash string `gorm:"not null"`
+	Used     bool   `gorm:"not null;default:false"`
+}
+
+// LoginThrottle counts recent failed logins for a subject, which is an alias
+// or an IP address
+type LoginThrottle struct {
+	Model
+	Subject     string    `gorm:"not null;unique_index"`
+	Failures    int       `gorm:"not null"`
+	LastFailure time.Time `gorm:"not null"`
+}
+
+// ErrAPIKeyNotFound is returned when a user has no API key with an id
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// APIKey lets automated clients act for a user without their password. Only
+// a hash of the key is stored. Scopes and AllowedIPs are space separated,
+// any IP address can use a key without AllowedIPs.
+type APIKey struct {
+	Model
+	UserID     uint       `gorm:"not null;index" json:"-"`
+	Name       string     `gorm:"not null" json:"name"`
+	KeyHash    string     `gorm:"not null;unique_index" json:"-"`
+	Prefix     string     `gorm:"not null" json:"prefix"` // start of the key so users can tell them apart
+	Scopes     string     `gorm:"type:text;not null" json:"scopes"`
+	AllowedIPs string     `gorm:"type:text" json:"allowed_ips"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	Revoked    bool       `gorm:"not null;default:false" json:"revoked"`
+}
+
+// AuditEvent records a change made through the API. Events are kept when
+// their user is deleted so the deletion stays on record. Values are only
+// stored as hashes.
+type AuditEvent struct {
+	Model
+	Actor        string `gorm:"not null" json:"actor"` // "user", "api_key:<id>", "admin" or "anonymous"
+	Action       string `gorm:"not null" json:"action"`
+	UserID       uint   `gorm:"index" json:"user_id"`
+	Alias        string `json:"alias"`
+	AddressType  int    `json:"address_type,omitempty"`
+	OldValueHash string `json:"old_value_hash,omitempty"`
+	NewValueHash string `json:"new_value_hash,omitempty"`
+	RemoteAddr   string `json:"remote_addr"`
+	UserAgent    string `gorm:"type:text" json:"user_agent"`
+}
+
+// AuditFilter selects audit events to export, zero values match everything
+type AuditFilter struct {
+	UserID uint
+	Since  time.Time
+	Until  time.Time
 }
 
 // Database represents the functionality that any peristance layer for this
 // server must satisfy
 type Database interface {
 	Close() error
+	Ping() error
 	CreateTables(bool) error
 	HasTables() bool
 	CreateUser(*User) error
-	UpdateUser(User) error
+	SetUserPassword(user User, passwordHash string) error
+	SetUserDisabled(user User, disabled bool) error
+	UpdateUserTOTP(user User) error
 	CreateOrUpdateAddress(*User, Address) error
 	DeleteUser(user User) error
 	DeleteAddress(address Address) error
@@ -42,4 +255,43 @@ type Database interface {
 	GetAddress(id uint) (Address, error)
 	GetAddressByAddressType(user User, addressType int) (Address, error)
 	GetAddresses(user User) ([]Address, error)
+	CreateOrUpdateExtendedKey(*User, ExtendedKey) error
+	DeleteExtendedKey(key ExtendedKey) error
+	GetExtendedKey(user User, addressType int) (ExtendedKey, error)
+	UseExtendedKey(key ExtendedKey) (ExtendedKey, error)
+	ReplaceAddressPool(user *User, pool AddressPool, addresses []string) error
+	DeleteAddressPool(pool AddressPool) error
+	GetAddressPool(user User, addressType int) (AddressPool, error)
+	CountAvailablePooledAddresses(pool AddressPool) (int, error)
+	NextPooledAddress(pool AddressPool) (PooledAddress, error)
+	ListUsers(search string, offset, limit int) ([]User, int, error)
+	CreateAdminAction(*AdminAction) error
+	GetAdminActions(offset, limit int) ([]AdminAction, int, error)
+	CreateInviteCode(*InviteCode) error
+	GetInviteCodes(offset, limit int) ([]InviteCode, int, error)
+	RevokeInviteCode(id uint) error
+	CreateUserWithInviteCode(user *User, codeHash string) error
+	CreateSession(*Session) error
+	RotateRefreshToken(oldHash, newHash string, expiresAt time.Time) (Session, error)
+	RevokeSession(tokenID string) error
+	RevokeUserSessions(user User) error
+	IsTokenRevoked(tokenID string) (bool, error)
+	DeleteExpiredSessions() error
+	UseTOTPCounter(user User, counter int64) (bool, error)
+	ReplaceRecoveryCodes(user User, purpose string, codeHashes []string) error
+	UseRecoveryCode(user User, purpose, codeHash string) (bool, error)
+	RecoverUser(user User, codeHash string) (bool, error)
+	CountLoginAttempt(subject string, window time.Duration, delay func(failures int) time.Duration) (LoginThrottle, time.Duration, error)
+	UncountLoginAttempt(subject string) error
+	ResetLoginFailures(subject string) error
+	CreateAPIKey(*APIKey) error
+	GetAPIKeyByHash(keyHash string) (APIKey, error)
+	GetAPIKeys(user User) ([]APIKey, error)
+	RevokeAPIKey(user User, id uint) error
+	ChangeAddresses(change *AddressChange, apply func(Database) error) error
+	GetAddressChanges(user User, addressType, offset, limit int) ([]AddressChange, int, error)
+	GetAddressChange(user User, id uint) (AddressChange, error)
+	CreateAuditEvent(*AuditEvent) error
+	GetUserAuditEvents(user User, offset, limit int) ([]AuditEvent, int, error)
+	ExportAuditEvents(filter AuditFilter, afterID uint, limit int) ([]AuditEvent, error)
 }
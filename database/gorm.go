@@ -1,7 +1,12 @@
 package database
 
 import (
+	"database/sql"
 	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/jinzhu/gorm"
 
@@ -14,6 +19,7 @@ import (
 // Gorm represents a connection to GORM
 type Gorm struct {
 	connection *gorm.DB
+	rotations  *rotations
 }
 
 // GetGormConnection connects to the gorm database
@@ -28,47 +34,108 @@ func GetGormConnection(dbURL, dbType string) (Gorm, error) {
 		return Gorm{}, err
 	}
 
-	return Gorm{connection: db}, nil
+	return Gorm{connection: db, rotations: &rotations{keys: map[uint]*rotation{}}}, nil
+}
+
+// transaction runs fn with a Gorm whose connection is a transaction, which is
+// committed if fn succeeds. If g's connection already is one fn joins it, so
+// methods can use this whether or not they're called from another
+// transaction.
+func (g Gorm) transaction(fn func(tx Gorm) error) error {
+	if _, ok := g.connection.CommonDB().(*sql.Tx); ok {
+		return fn(g)
+	}
+
+	tx := g.connection.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := fn(Gorm{connection: tx, rotations: g.rotations}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
 }
 
 func (g Gorm) Close() error {
 	return g.connection.Close()
 }
 
+// Ping checks the database can still be reached
+func (g Gorm) Ping() error {
+	return g.connection.DB().Ping()
+}
+
+// models are stored in a table each, in the order the tables are created
+func models() []interface{} {
+	return []interface{}{
+		&User{},
+		&Address{},
+		&ExtendedKey{},
+		&AddressPool{},
+		&PooledAddress{},
+		&AdminAction{},
+		&InviteCode{},
+		&Session{},
+		&RecoveryCode{},
+		&LoginThrottle{},
+		&APIKey{},
+		&AddressChange{},
+		&AuditEvent{},
+	}
+}
+
 // HasTables alerts us if the tables haven't been setup yet
 func (g Gorm) HasTables() bool {
-	if !g.connection.HasTable(&User{}) {
-		return false
-	}
-	if !g.connection.HasTable(&Address{}) {
-		return false
+	for _, v := range models() {
+		if !g.connection.HasTable(v) {
+			return false
+		}
 	}
 	return true
 }
 
-// CreateTables creates the necessary tables
+// CreateTables creates the necessary tables. Unless recreate is set existing
+// tables are kept, and are given any columns added since they were created,
+// so it also upgrades a database set up by an older version.
 func (g Gorm) CreateTables(recreate bool) error {
 	if recreate {
-		if dbc := g.connection.DropTableIfExists(&User{}); dbc.Error != nil {
+		for _, v := range models() {
+			if dbc := g.connection.DropTableIfExists(v); dbc.Error != nil {
+				return dbc.Error
+			}
+		}
+	}
+
+	for _, v := range models() {
+		if g.connection.HasTable(v) {
+			continue
+		}
+		if dbc := g.connection.CreateTable(v); dbc.Error != nil {
 			return dbc.Error
 		}
-		if dbc := g.connection.DropTableIfExists(&Address{}); dbc.Error != nil {
+	}
+	for _, v := range models() {
+		if dbc := g.connection.AutoMigrate(v); dbc.Error != nil {
 			return dbc.Error
 		}
 	}
 
-	if dbc := g.connection.CreateTable(&User{}); dbc.Error != nil {
-		return dbc.Error
-	}
-	if dbc := g.connection.CreateTable(&Address{}); dbc.Error != nil {
-		return dbc.Error
+	// Older versions stored the lookups of each extended key, the column
+	// has no default so it has to go before new keys can be inserted
+	table := g.connection.NewScope(&ExtendedKey{}).TableName()
+	if g.connection.Dialect().HasColumn(table, "lookups") {
+		if dbc := g.connection.Model(&ExtendedKey{}).DropColumn("lookups"); dbc.Error != nil {
+			return dbc.Error
+		}
 	}
 
-	if dbc := g.connection.AutoMigrate(&User{}); dbc.Error != nil {
-		return dbc.Error
-	}
-	if dbc := g.connection.AutoMigrate(&Address{}); dbc.Error != nil {
-		return dbc.Error
+	// Extended keys used to be unique per address type, soft deleted keys
+	// now stay in the table
+	if g.connection.Dialect().HasIndex(table, "idx_extended_key_userid_type") {
+		if dbc := g.connection.Model(&ExtendedKey{}).RemoveIndex("idx_extended_key_userid_type"); dbc.Error != nil {
+			return dbc.Error
+		}
 	}
 	return nil
 }
@@ -83,17 +150,35 @@ func (g Gorm) CreateUser(user *User) error {
 	return dbc.Error
 }
 
-// UpdateUser updates user fields
-// Does not update associated addresses
-func (g Gorm) UpdateUser(user User) error {
-	user.Addresses = nil
+// SetUserPassword changes a user's password hash
+func (g Gorm) SetUserPassword(user User, passwordHash string) error {
+	return g.updateUser(user, map[string]interface{}{"password": passwordHash})
+}
+
+// SetUserDisabled disables or enables a user
+func (g Gorm) SetUserDisabled(user User, disabled bool) error {
+	return g.updateUser(user, map[string]interface{}{"disabled": disabled})
+}
 
+// UpdateUserTOTP stores a user's 2FA secret, whether 2FA is enabled and the
+// last time step whose code was used
+func (g Gorm) UpdateUserTOTP(user User) error {
+	return g.updateUser(user, map[string]interface{}{
+		"totp_secret":       user.TOTPSecret,
+		"totp_enabled":      user.TOTPEnabled,
+		"totp_last_counter": user.TOTPLastCounter,
+	})
+}
+
+// updateUser writes only the given columns of a user, so requests changing
+// different fields of the same user at the same time don't undo each other
+func (g Gorm) updateUser(user User, columns map[string]interface{}) error {
 	_, err := g.GetUser(user.ID)
 	if err != nil {
 		return errors.New("User can't be found to update")
 	}
 
-	dbc := g.connection.Save(user)
+	dbc := g.connection.Model(&User{}).Where("id = ?", user.ID).Updates(columns)
 	return dbc.Error
 }
 
@@ -108,7 +193,12 @@ func (g Gorm) CreateOrUpdateAddress(user *User, address Address) error {
 	retrieved, err := getAddressByType(address.AddressType, retrievedAddresses)
 	if err == nil {
 		address.ID = retrieved.ID
-		dbc := g.connection.Model(&address).Update("address", address.Address)
+		dbc := g.connection.Model(&address).Updates(map[string]interface{}{
+			"address":         address.Address,
+			"extensions":      address.Extensions,
+			"user_public_key": address.UserPublicKey,
+			"user_signature":  address.UserSignature,
+		})
 		return dbc.Error
 	}
 
@@ -117,11 +207,18 @@ func (g Gorm) CreateOrUpdateAddress(user *User, address Address) error {
 	return dbc.Error
 }
 
-// DeleteUser deletes a user
+// DeleteUser deletes a user and everything that belongs to them except their
+// address history, which is soft deleted
 func (g Gorm) DeleteUser(user User) error {
+	return g.transaction(func(tx Gorm) error {
+		return tx.deleteUser(user)
+	})
+}
+
+func (g Gorm) deleteUser(user User) error {
 	addresses, err := g.GetAddresses(user)
 	if err != nil {
-		return errors.New("Can't find associated addresses. User can't be deleted. " + string(user.ID) + err.Error())
+		return errors.New("Can't find associated addresses. User can't be deleted. " + strconv.FormatUint(uint64(user.ID), 10) + err.Error())
 	}
 	for _, v := range addresses {
 		err := g.DeleteAddress(v)
@@ -130,7 +227,44 @@ func (g Gorm) DeleteUser(user User) error {
 		}
 	}
 
-	dbc := g.connection.Delete(&user)
+	dbc := g.connection.Unscoped().Where("user_id = ?", user.ID).Delete(ExtendedKey{})
+	if dbc.Error != nil {
+		return dbc.Error
+	}
+
+	pools := make([]AddressPool, 0)
+	dbc = g.connection.Where("user_id = ?", user.ID).Find(&pools)
+	if dbc.Error != nil {
+		return dbc.Error
+	}
+	for _, v := range pools {
+		err := g.DeleteAddressPool(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	dbc = g.connection.Where("user_id = ?", user.ID).Delete(Session{})
+	if dbc.Error != nil {
+		return dbc.Error
+	}
+
+	dbc = g.connection.Where("user_id = ?", user.ID).Delete(RecoveryCode{})
+	if dbc.Error != nil {
+		return dbc.Error
+	}
+
+	dbc = g.connection.Where("user_id = ?", user.ID).Delete(APIKey{})
+	if dbc.Error != nil {
+		return dbc.Error
+	}
+
+	dbc = g.connection.Where("user_id = ?", user.ID).Delete(AddressChange{})
+	if dbc.Error != nil {
+		return dbc.Error
+	}
+
+	dbc = g.connection.Delete(&user)
 	return dbc.Error
 }
 
@@ -138,7 +272,7 @@ func (g Gorm) DeleteUser(user User) error {
 func (g Gorm) DeleteAddress(address Address) error {
 	_, err := g.GetAddress(address.ID)
 	if err != nil {
-		return errors.New("Address " + string(address.ID) + " not found. Can't be deleted")
+		return errors.New("Address " + strconv.FormatUint(uint64(address.ID), 10) + " not found. Can't be deleted")
 	}
 
 	dbc := g.connection.Delete(&address)
@@ -150,7 +284,7 @@ func (g Gorm) GetUser(id uint) (User, error) {
 	user := User{}
 	dbc := g.connection.Where("id = ?", id).First(&user)
 	if user.ID == 0 || dbc.Error != nil {
-		return User{}, errors.New("User with id " + string(id) + " not found in postgres. Can't be retrieved")
+		return User{}, errors.New("User with id " + strconv.FormatUint(uint64(id), 10) + " not found in postgres. Can't be retrieved")
 	}
 	return user, nil
 }
@@ -170,7 +304,7 @@ func (g Gorm) GetAddress(id uint) (Address, error) {
 	address := Address{}
 	dbc := g.connection.Where("id = ?", id).First(&address)
 	if address.ID == 0 || dbc.Error != nil {
-		return Address{}, errors.New("Address with id " + string(id) + " not found. Can't be retrieved")
+		return Address{}, errors.New("Address with id " + strconv.FormatUint(uint64(id), 10) + " not found. Can't be retrieved")
 	}
 	return address, nil
 }
@@ -194,3 +328,691 @@ func (g Gorm) GetAddresses(user User) ([]Address, error) {
 	dbc := g.connection.Raw("SELECT * FROM addresses WHERE user_id = ?", user.ID).Scan(&addresses)
 	return addresses, dbc.Error
 }
+
+// CreateOrUpdateExtendedKey publishes an extended key for an address type,
+// replacing the one published before. A key the user published before is
+// revived with the highest derivation index it reached instead of starting
+// again from 0, so its addresses are never handed out twice.
+func (g Gorm) CreateOrUpdateExtendedKey(user *User, key ExtendedKey) error {
+	dbc := g.connection.Where("user_id = ? and address_type = ? and public_key <> ?", user.ID, key.AddressType, key.PublicKey).Delete(ExtendedKey{})
+	if dbc.Error != nil {
+		return dbc.Error
+	}
+
+	retrieved := ExtendedKey{}
+	dbc = g.connection.Unscoped().
+		Where("user_id = ? and address_type = ? and public_key = ?", user.ID, key.AddressType, key.PublicKey).
+		Order("derivation_index desc").
+		First(&retrieved)
+	if dbc.Error == nil {
+		dbc = g.connection.Unscoped().Model(&retrieved).Updates(map[string]interface{}{
+			"rotate_every": key.RotateEvery,
+			"deleted_at":   nil,
+		})
+		return dbc.Error
+	}
+	if !dbc.RecordNotFound() {
+		return dbc.Error
+	}
+
+	key.UserID = user.ID
+	dbc = g.connection.Create(&key)
+	return dbc.Error
+}
+
+// DeleteExtendedKey soft deletes an extended key, it keeps its derivation
+// index in case it's published again
+func (g Gorm) DeleteExtendedKey(key ExtendedKey) error {
+	dbc := g.connection.Delete(&key)
+	return dbc.Error
+}
+
+// GetExtendedKey returns the extended key published for an address type
+func (g Gorm) GetExtendedKey(user User, addressType int) (ExtendedKey, error) {
+	key := ExtendedKey{}
+	dbc := g.connection.Where("user_id = ? and address_type = ?", user.ID, addressType).First(&key)
+	if key.ID == 0 || dbc.Error != nil {
+		return ExtendedKey{}, errors.New("Extended key for address type " + strconv.Itoa(addressType) + " not found")
+	}
+	return key, nil
+}
+
+// rotation is how far through its current derivation index an extended key
+// is
+type rotation struct {
+	publicKey string
+	index     uint32
+	lookups   uint
+}
+
+// rotations counts the lookups of extended keys in memory so that lookups
+// only write to the database when a key moves to its next derivation index
+type rotations struct {
+	mu   sync.Mutex
+	keys map[uint]*rotation
+}
+
+// UseExtendedKey counts a lookup of an extended key and returns it with the
+// derivation index that lookup should be served. Lookups are counted in
+// memory, the derivation index is stored when it changes with a compare and
+// swap so servers sharing the database never serve the same index twice.
+func (g Gorm) UseExtendedKey(key ExtendedKey) (ExtendedKey, error) {
+	g.rotations.mu.Lock()
+	defer g.rotations.mu.Unlock()
+
+	const attempts = 10
+	for i := 0; i < attempts; i++ {
+		r, ok := g.rotations.keys[key.ID]
+		if !ok || r.publicKey != key.PublicKey || r.index < key.DerivationIndex {
+			r = &rotation{publicKey: key.PublicKey, index: key.DerivationIndex}
+			g.rotations.keys[key.ID] = r
+		}
+		key.DerivationIndex = r.index
+
+		if r.lookups+1 < key.RotateEvery {
+			r.lookups++
+			return key, nil
+		}
+
+		dbc := g.connection.Model(&ExtendedKey{}).
+			Where("id = ? and derivation_index = ?", key.ID, r.index).
+			Update("derivation_index", r.index+1)
+		if dbc.Error != nil {
+			return ExtendedKey{}, dbc.Error
+		}
+		if dbc.RowsAffected == 1 {
+			r.index, r.lookups = r.index+1, 0
+			return key, nil
+		}
+
+		// Another server moved the key on, serve from its new index
+		current := ExtendedKey{}
+		if dbc := g.connection.Where("id = ?", key.ID).First(&current); dbc.Error != nil {
+			return ExtendedKey{}, dbc.Error
+		}
+		delete(g.rotations.keys, key.ID)
+		key = current
+	}
+	return ExtendedKey{}, errors.New("Too many concurrent lookups of extended key")
+}
+
+// ReplaceAddressPool creates the address pool of an address type, replacing
+// the existing pool and its addresses if there is one
+func (g Gorm) ReplaceAddressPool(user *User, pool AddressPool, addresses []string) error {
+	return g.transaction(func(tx Gorm) error {
+		return tx.replaceAddressPool(user, pool, addresses)
+	})
+}
+
+func (g Gorm) replaceAddressPool(user *User, pool AddressPool, addresses []string) error {
+	tx := g.connection
+	existing := AddressPool{}
+	dbc := tx.Where("user_id = ? and address_type = ?", user.ID, pool.AddressType).First(&existing)
+	if dbc.Error == nil && existing.ID != 0 {
+		if dbc := tx.Where("address_pool_id = ?", existing.ID).Delete(PooledAddress{}); dbc.Error != nil {
+			return dbc.Error
+		}
+		if dbc := tx.Delete(&existing); dbc.Error != nil {
+			return dbc.Error
+		}
+	}
+
+	pool.ID = 0
+	pool.UserID = user.ID
+	pool.NextPosition = 0
+	if dbc := tx.Create(&pool); dbc.Error != nil {
+		return dbc.Error
+	}
+	for i, v := range addresses {
+		pooled := PooledAddress{
+			AddressPoolID: pool.ID,
+			Position:      uint(i),
+			Address:       v,
+		}
+		if dbc := tx.Create(&pooled); dbc.Error != nil {
+			return dbc.Error
+		}
+	}
+	return nil
+}
+
+// DeleteAddressPool deletes an address pool, its addresses and the address
+// of its type, which holds the last pooled address that was served
+func (g Gorm) DeleteAddressPool(pool AddressPool) error {
+	return g.transaction(func(tx Gorm) error {
+		return tx.deleteAddressPool(pool)
+	})
+}
+
+func (g Gorm) deleteAddressPool(pool AddressPool) error {
+	tx := g.connection
+	dbc := tx.Where("address_pool_id = ?", pool.ID).Delete(PooledAddress{})
+	if dbc.Error != nil {
+		return dbc.Error
+	}
+	dbc = tx.Where("user_id = ? and address_type = ?", pool.UserID, pool.AddressType).Delete(Address{})
+	if dbc.Error != nil {
+		return dbc.Error
+	}
+	dbc = tx.Delete(&pool)
+	return dbc.Error
+}
+
+// GetAddressPool returns the address pool of an address type
+func (g Gorm) GetAddressPool(user User, addressType int) (AddressPool, error) {
+	pool := AddressPool{}
+	dbc := g.connection.Where("user_id = ? and address_type = ?", user.ID, addressType).First(&pool)
+	if pool.ID == 0 || dbc.Error != nil {
+		return AddressPool{}, errors.New("Address pool for address type " + strconv.Itoa(addressType) + " not found")
+	}
+	return pool, nil
+}
+
+// CountAvailablePooledAddresses returns how many addresses of a pool can
+// still be served
+func (g Gorm) CountAvailablePooledAddresses(pool AddressPool) (int, error) {
+	count := 0
+	query := g.connection.Model(&PooledAddress{}).Where("address_pool_id = ?", pool.ID)
+	if pool.Mode == PoolModeUseOnce {
+		query = query.Where("used = ?", false)
+	}
+	dbc := query.Count(&count)
+	return count, dbc.Error
+}
+
+// NextPooledAddress returns the address of a pool the next lookup should be
+// served and marks it as served. Like UseExtendedKey it uses a compare and
+// swap so concurrent lookups never get the same use once address.
+func (g Gorm) NextPooledAddress(pool AddressPool) (PooledAddress, error) {
+	const attempts = 10
+	for i := 0; i < attempts; i++ {
+		pooled := PooledAddress{}
+
+		if pool.Mode == PoolModeUseOnce {
+			dbc := g.connection.Where("address_pool_id = ? and used = ?", pool.ID, false).Order("position").First(&pooled)
+			if dbc.RecordNotFound() {
+				return PooledAddress{}, ErrPoolEmpty
+			}
+			if dbc.Error != nil {
+				return PooledAddress{}, dbc.Error
+			}
+
+			dbc = g.connection.Model(&PooledAddress{}).
+				Where("id = ? and used = ?", pooled.ID, false).
+				Update("used", true)
+			if dbc.Error != nil {
+				return PooledAddress{}, dbc.Error
+			}
+			if dbc.RowsAffected == 1 {
+				return pooled, nil
+			}
+			continue
+		}
+
+		current := AddressPool{}
+		dbc := g.connection.Where("id = ?", pool.ID).First(&current)
+		if dbc.Error != nil {
+			return PooledAddress{}, dbc.Error
+		}
+		count, err := g.CountAvailablePooledAddresses(current)
+		if err != nil {
+			return PooledAddress{}, err
+		}
+		if count == 0 {
+			return PooledAddress{}, ErrPoolEmpty
+		}
+
+		dbc = g.connection.Model(&AddressPool{}).
+			Where("id = ? and next_position = ?", current.ID, current.NextPosition).
+			Update("next_position", current.NextPosition+1)
+		if dbc.Error != nil {
+			return PooledAddress{}, dbc.Error
+		}
+		if dbc.RowsAffected != 1 {
+			continue
+		}
+
+		position := current.NextPosition % uint(count)
+		dbc = g.connection.Where("address_pool_id = ? and position = ?", current.ID, position).First(&pooled)
+		return pooled, dbc.Error
+	}
+	return PooledAddress{}, errors.New("Too many concurrent lookups of address pool")
+}
+
+// likeEscaper makes text match itself in a LIKE pattern. The escape
+// character isn't a backslash because databases disagree on quoting one.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// ListUsers returns a page of users ordered by id whose username or domain
+// contains search, and the total number of matching users
+func (g Gorm) ListUsers(search string, offset, limit int) ([]User, int, error) {
+	users := make([]User, 0)
+	query := g.connection.Model(&User{})
+	if search != "" {
+		pattern := "%" + likeEscaper.Replace(search) + "%"
+		query = query.Where("username LIKE ? ESCAPE '!' or domain LIKE ? ESCAPE '!'", pattern, pattern)
+	}
+
+	total := 0
+	if dbc := query.Count(&total); dbc.Error != nil {
+		return users, 0, dbc.Error
+	}
+	dbc := query.Order("id").Offset(offset).Limit(limit).Find(&users)
+	return users, total, dbc.Error
+}
+
+// CreateAdminAction records an admin action
+func (g Gorm) CreateAdminAction(action *AdminAction) error {
+	dbc := g.connection.Create(action)
+	return dbc.Error
+}
+
+// GetAdminActions returns a page of admin actions, newest first, and the
+// total number of actions
+func (g Gorm) GetAdminActions(offset, limit int) ([]AdminAction, int, error) {
+	actions := make([]AdminAction, 0)
+	total := 0
+	if dbc := g.connection.Model(&AdminAction{}).Count(&total); dbc.Error != nil {
+		return actions, 0, dbc.Error
+	}
+	dbc := g.connection.Order("id desc").Offset(offset).Limit(limit).Find(&actions)
+	return actions, total, dbc.Error
+}
+
+// CreateInviteCode creates an invite code
+func (g Gorm) CreateInviteCode(invite *InviteCode) error {
+	dbc := g.connection.Create(invite)
+	return dbc.Error
+}
+
+// GetInviteCodes returns a page of invite codes, newest first, and the total
+// number of invite codes
+func (g Gorm) GetInviteCodes(offset, limit int) ([]InviteCode, int, error) {
+	invites := make([]InviteCode, 0)
+	total := 0
+	if dbc := g.connection.Model(&InviteCode{}).Count(&total); dbc.Error != nil {
+		return invites, 0, dbc.Error
+	}
+	dbc := g.connection.Order("id desc").Offset(offset).Limit(limit).Find(&invites)
+	return invites, total, dbc.Error
+}
+
+// RevokeInviteCode stops an invite code from being used again
+func (g Gorm) RevokeInviteCode(id uint) error {
+	dbc := g.connection.Model(&InviteCode{}).Where("id = ?", id).Update("revoked", true)
+	if dbc.Error != nil {
+		return dbc.Error
+	}
+	if dbc.RowsAffected != 1 {
+		return errors.New("Invite code not found")
+	}
+	return nil
+}
+
+// CreateUserWithInviteCode uses up one use of an invite code and creates the
+// user in a single transaction, so a code can't be used more than MaxUses
+// times and isn't used up if the user can't be created
+func (g Gorm) CreateUserWithInviteCode(user *User, codeHash string) error {
+	if len(user.Addresses) > 0 {
+		return errors.New("Created user shouldn't have any addresses")
+	}
+
+	tx := g.connection.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	invite := InviteCode{}
+	dbc := tx.Where("code_hash = ?", codeHash).First(&invite)
+	if dbc.RecordNotFound() {
+		tx.Rollback()
+		return ErrInviteCodeInvalid
+	}
+	if dbc.Error != nil {
+		tx.Rollback()
+		return dbc.Error
+	}
+	if (invite.Username != "" && invite.Username != user.Username) ||
+		(invite.Domain != "" && invite.Domain != user.Domain) ||
+		(invite.ExpiresAt != nil && time.Now().After(*invite.ExpiresAt)) {
+		tx.Rollback()
+		return ErrInviteCodeInvalid
+	}
+
+	dbc = tx.Model(&InviteCode{}).
+		Where("id = ? and revoked = ? and uses < max_uses", invite.ID, false).
+		Update("uses", gorm.Expr("uses + 1"))
+	if dbc.Error != nil {
+		tx.Rollback()
+		return dbc.Error
+	}
+	if dbc.RowsAffected != 1 {
+		tx.Rollback()
+		return ErrInviteCodeInvalid
+	}
+
+	if dbc := tx.Create(user); dbc.Error != nil {
+		tx.Rollback()
+		return dbc.Error
+	}
+	return tx.Commit().Error
+}
+
+// CreateSession creates a session
+func (g Gorm) CreateSession(session *Session) error {
+	dbc := g.connection.Create(session)
+	return dbc.Error
+}
+
+// RotateRefreshToken replaces the refresh token of an active session and
+// extends it. The old token only works once, if it's used concurrently only
+// one request gets the session.
+func (g Gorm) RotateRefreshToken(oldHash, newHash string, expiresAt time.Time) (Session, error) {
+	session := Session{}
+	dbc := g.connection.Where("refresh_token_hash = ? and revoked = ? and expires_at > ?", oldHash, false, time.Now()).First(&session)
+	if dbc.RecordNotFound() {
+		return Session{}, ErrSessionNotFound
+	}
+	if dbc.Error != nil {
+		return Session{}, dbc.Error
+	}
+
+	dbc = g.connection.Model(&Session{}).
+		Where("id = ? and refresh_token_hash = ?", session.ID, oldHash).
+		Updates(map[string]interface{}{"refresh_token_hash": newHash, "expires_at": expiresAt})
+	if dbc.Error != nil {
+		return Session{}, dbc.Error
+	}
+	if dbc.RowsAffected != 1 {
+		return Session{}, ErrSessionNotFound
+	}
+
+	session.RefreshTokenHash = newHash
+	session.ExpiresAt = expiresAt
+	return session, nil
+}
+
+// RevokeSession revokes the session with the token identifier
+func (g Gorm) RevokeSession(tokenID string) error {
+	dbc := g.connection.Model(&Session{}).Where("token_id = ?", tokenID).Update("revoked", true)
+	return dbc.Error
+}
+
+// RevokeUserSessions revokes every session of a user
+func (g Gorm) RevokeUserSessions(user User) error {
+	dbc := g.connection.Model(&Session{}).Where("user_id = ?", user.ID).Update("revoked", true)
+	return dbc.Error
+}
+
+// IsTokenRevoked returns true unless the token identifier belongs to a
+// session that hasn't been revoked
+func (g Gorm) IsTokenRevoked(tokenID string) (bool, error) {
+	session := Session{}
+	dbc := g.connection.Where("token_id = ?", tokenID).First(&session)
+	if dbc.RecordNotFound() {
+		return true, nil
+	}
+	if dbc.Error != nil {
+		return true, dbc.Error
+	}
+	return session.Revoked, nil
+}
+
+// DeleteExpiredSessions deletes sessions that can no longer be refreshed
+func (g Gorm) DeleteExpiredSessions() error {
+	dbc := g.connection.Where("expires_at < ?", time.Now()).Delete(Session{})
+	return dbc.Error
+}
+
+// UseTOTPCounter records that the TOTP code of a time step has been used.
+// It returns false if that or a later time step's code was already used.
+func (g Gorm) UseTOTPCounter(user User, counter int64) (bool, error) {
+	dbc := g.connection.Model(&User{}).
+		Where("id = ? and totp_last_counter < ?", user.ID, counter).
+		UpdateColumn("totp_last_counter", counter)
+	if dbc.Error != nil {
+		return false, dbc.Error
+	}
+	return dbc.RowsAffected == 1, nil
+}
+
+// ReplaceRecoveryCodes replaces every recovery code of a user for a purpose
+func (g Gorm) ReplaceRecoveryCodes(user User, purpose string, codeHashes []string) error {
+	tx := g.connection.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if dbc := tx.Where("user_id = ? and purpose = ?", user.ID, purpose).Delete(RecoveryCode{}); dbc.Error != nil {
+		tx.Rollback()
+		return dbc.Error
+	}
+	for _, v := range codeHashes {
+		code := RecoveryCode{
+			UserID:   user.ID,
+			Purpose:  purpose,
+			CodeHash: v,
+		}
+		if dbc := tx.Create(&code); dbc.Error != nil {
+			tx.Rollback()
+			return dbc.Error
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+// UseRecoveryCode marks a recovery code as used, it returns false if the user
+// has no such unused code for the purpose
+func (g Gorm) UseRecoveryCode(user User, purpose, codeHash string) (bool, error) {
+	dbc := g.connection.Model(&RecoveryCode{}).
+		Where("user_id = ? and purpose = ? and code_hash = ? and used = ?", user.ID, purpose, codeHash, false).
+		Update("used", true)
+	if dbc.Error != nil {
+		return false, dbc.Error
+	}
+	return dbc.RowsAffected == 1, nil
+}
+
+// RecoverUser uses up one of a user's account recovery codes, sets their new
+// password and revokes their sessions, all or nothing. It returns false if
+// the code isn't one of theirs or was already used.
+func (g Gorm) RecoverUser(user User, codeHash string) (bool, error) {
+	tx := g.connection.Begin()
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	dbc := tx.Model(&RecoveryCode{}).
+		Where("user_id = ? and purpose = ? and code_hash = ? and used = ?", user.ID, RecoveryCodeAccount, codeHash, false).
+		Update("used", true)
+	if dbc.Error != nil || dbc.RowsAffected != 1 {
+		tx.Rollback()
+		return false, dbc.Error
+	}
+	if dbc := tx.Model(&User{}).Where("id = ?", user.ID).Update("password", user.Password); dbc.Error != nil {
+		tx.Rollback()
+		return false, dbc.Error
+	}
+	if dbc := tx.Model(&Session{}).Where("user_id = ?", user.ID).Update("revoked", true); dbc.Error != nil {
+		tx.Rollback()
+		return false, dbc.Error
+	}
+	return true, tx.Commit().Error
+}
+
+// CountLoginAttempt counts a login attempt as a failure for a subject before
+// it's made, so concurrent attempts can't all get in before the subject is
+// locked out. delay is how long a number of failures locks the subject out
+// for. If it's locked out the attempt isn't counted and how long is left is
+// returned. Failures older than window are forgotten, so the count starts
+// again from 1.
+func (g Gorm) CountLoginAttempt(subject string, window time.Duration, delay func(failures int) time.Duration) (LoginThrottle, time.Duration, error) {
+	const attempts = 10
+	for i := 0; i < attempts; i++ {
+		now := time.Now().UTC()
+
+		current := LoginThrottle{}
+		dbc := g.connection.Where("subject = ?", subject).First(&current)
+		if dbc.RecordNotFound() {
+			// Concurrent first attempts race to create the row, the loser
+			// goes round again and updates it
+			throttle := LoginThrottle{Subject: subject, Failures: 1, LastFailure: now}
+			if dbc := g.connection.Create(&throttle); dbc.Error != nil {
+				continue
+			}
+			return throttle, 0, nil
+		}
+		if dbc.Error != nil {
+			return LoginThrottle{}, 0, dbc.Error
+		}
+
+		failures := interface{}(gorm.Expr("failures + 1"))
+		if now.Sub(current.LastFailure) > window {
+			failures = 1
+		} else if wait := current.LastFailure.Add(delay(current.Failures)).Sub(now); wait > 0 {
+			return current, wait, nil
+		}
+
+		// The lockout was decided from the row as it was read, so the
+		// update only goes through if no other attempt changed it since
+		dbc = g.connection.Model(&LoginThrottle{}).
+			Where("id = ? and failures = ? and last_failure = ?", current.ID, current.Failures, current.LastFailure).
+			Updates(map[string]interface{}{"failures": failures, "last_failure": now})
+		if dbc.Error != nil {
+			return LoginThrottle{}, 0, dbc.Error
+		}
+		if dbc.RowsAffected == 1 {
+			throttle := LoginThrottle{}
+			dbc = g.connection.Where("id = ?", current.ID).First(&throttle)
+			return throttle, 0, dbc.Error
+		}
+	}
+	return LoginThrottle{}, 0, errors.New("Too many concurrent login attempts")
+}
+
+// UncountLoginAttempt takes back a failure counted by CountLoginAttempt for
+// an attempt that didn't fail
+func (g Gorm) UncountLoginAttempt(subject string) error {
+	dbc := g.connection.Model(&LoginThrottle{}).
+		Where("subject = ? and failures > 0", subject).
+		Update("failures", gorm.Expr("failures - 1"))
+	return dbc.Error
+}
+
+// ResetLoginFailures forgets the failed logins of a subject
+func (g Gorm) ResetLoginFailures(subject string) error {
+	dbc := g.connection.Where("subject = ?", subject).Delete(LoginThrottle{})
+	return dbc.Error
+}
+
+// CreateAPIKey creates an API key
+func (g Gorm) CreateAPIKey(key *APIKey) error {
+	dbc := g.connection.Create(key)
+	return dbc.Error
+}
+
+// GetAPIKeyByHash returns the API key with the hash
+func (g Gorm) GetAPIKeyByHash(keyHash string) (APIKey, error) {
+	key := APIKey{}
+	dbc := g.connection.Where("key_hash = ?", keyHash).First(&key)
+	if dbc.RecordNotFound() {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return key, dbc.Error
+}
+
+// GetAPIKeys returns every API key of a user, including revoked ones
+func (g Gorm) GetAPIKeys(user User) ([]APIKey, error) {
+	keys := make([]APIKey, 0)
+	dbc := g.connection.Where("user_id = ?", user.ID).Order("id").Find(&keys)
+	return keys, dbc.Error
+}
+
+// RevokeAPIKey stops one of a user's API keys from being used again
+func (g Gorm) RevokeAPIKey(user User, id uint) error {
+	dbc := g.connection.Model(&APIKey{}).Where("id = ? and user_id = ?", id, user.ID).Update("revoked", true)
+	if dbc.Error != nil {
+		return dbc.Error
+	}
+	if dbc.RowsAffected != 1 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// ChangeAddresses makes a change to a user's addresses with apply and adds it
+// to their address history in one transaction, so the history has every
+// change that was made and none that failed
+func (g Gorm) ChangeAddresses(change *AddressChange, apply func(Database) error) error {
+	return g.transaction(func(tx Gorm) error {
+		if err := apply(tx); err != nil {
+			return err
+		}
+		return tx.connection.Create(change).Error
+	})
+}
+
+// GetAddressChanges returns a page of a user's address history for an
+// address type, or for every type if addressType is negative, newest first,
+// and the total number of changes
+func (g Gorm) GetAddressChanges(user User, addressType, offset, limit int) ([]AddressChange, int, error) {
+	changes := make([]AddressChange, 0)
+	query := g.connection.Model(&AddressChange{}).Where("user_id = ?", user.ID)
+	if addressType >= 0 {
+		query = query.Where("address_type = ?", addressType)
+	}
+	total := 0
+	if dbc := query.Count(&total); dbc.Error != nil {
+		return changes, 0, dbc.Error
+	}
+	dbc := query.Order("id desc").Offset(offset).Limit(limit).Find(&changes)
+	return changes, total, dbc.Error
+}
+
+// GetAddressChange returns one of a user's address changes
+func (g Gorm) GetAddressChange(user User, id uint) (AddressChange, error) {
+	change := AddressChange{}
+	dbc := g.connection.Where("id = ? and user_id = ?", id, user.ID).First(&change)
+	if dbc.RecordNotFound() {
+		return AddressChange{}, errors.New("Address change not found")
+	}
+	return change, dbc.Error
+}
+
+// CreateAuditEvent adds an event to the audit log
+func (g Gorm) CreateAuditEvent(event *AuditEvent) error {
+	dbc := g.connection.Create(event)
+	return dbc.Error
+}
+
+// GetUserAuditEvents returns a page of a user's audit events, newest first,
+// and the total number of them. Events of an earlier user with the same id
+// are left out.
+func (g Gorm) GetUserAuditEvents(user User, offset, limit int) ([]AuditEvent, int, error) {
+	events := make([]AuditEvent, 0)
+	query := g.connection.Model(&AuditEvent{}).Where("user_id = ? and created_at >= ?", user.ID, user.CreatedAt)
+	total := 0
+	if dbc := query.Count(&total); dbc.Error != nil {
+		return events, 0, dbc.Error
+	}
+	dbc := query.Order("id desc").Offset(offset).Limit(limit).Find(&events)
+	return events, total, dbc.Error
+}
+
+// ExportAuditEvents returns up to limit audit events matching the filter
+// with ids greater than afterID, oldest first
+func (g Gorm) ExportAuditEvents(filter AuditFilter, afterID uint, limit int) ([]AuditEvent, error) {
+	events := make([]AuditEvent, 0)
+	query := g.connection.Where("id > ?", afterID)
+	if filter.UserID != 0 {
+		query = query.Where("user_id = ?", filter.UserID)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("created_at < ?", filter.Until)
+	}
+	dbc := query.Order("id").Limit(limit).Find(&events)
+	return events, dbc.Error
+}
@@ -0,0 +1,292 @@
+package database
+
+import "time"
+
+// instrumented times each call to a database
+type instrumented struct {
+	db      Database
+	observe func(method string, start time.Time)
+}
+
+// Instrument returns db with observe called after each of its methods with
+// the method's name and when it was called
+func Instrument(db Database, observe func(method string, start time.Time)) Database {
+	return instrumented{db: db, observe: observe}
+}
+
+func (db instrumented) Close() error {
+	defer db.observe("Close", time.Now())
+	return db.db.Close()
+}
+
+func (db instrumented) Ping() error {
+	defer db.observe("Ping", time.Now())
+	return db.db.Ping()
+}
+
+func (db instrumented) CreateTables(recreate bool) error {
+	defer db.observe("CreateTables", time.Now())
+	return db.db.CreateTables(recreate)
+}
+
+func (db instrumented) HasTables() bool {
+	defer db.observe("HasTables", time.Now())
+	return db.db.HasTables()
+}
+
+func (db instrumented) CreateUser(user *User) error {
+	defer db.observe("CreateUser", time.Now())
+	return db.db.CreateUser(user)
+}
+
+func (db instrumented) SetUserPassword(user User, passwordHash string) error {
+	defer db.observe("SetUserPassword", time.Now())
+	return db.db.SetUserPassword(user, passwordHash)
+}
+
+func (db instrumented) SetUserDisabled(user User, disabled bool) error {
+	defer db.observe("SetUserDisabled", time.Now())
+	return db.db.SetUserDisabled(user, disabled)
+}
+
+func (db instrumented) UpdateUserTOTP(user User) error {
+	defer db.observe("UpdateUserTOTP", time.Now())
+	return db.db.UpdateUserTOTP(user)
+}
+
+func (db instrumented) CreateOrUpdateAddress(user *User, address Address) error {
+	defer db.observe("CreateOrUpdateAddress", time.Now())
+	return db.db.CreateOrUpdateAddress(user, address)
+}
+
+func (db instrumented) DeleteUser(user User) error {
+	defer db.observe("DeleteUser", time.Now())
+	return db.db.DeleteUser(user)
+}
+
+func (db instrumented) DeleteAddress(address Address) error {
+	defer db.observe("DeleteAddress", time.Now())
+	return db.db.DeleteAddress(address)
+}
+
+func (db instrumented) GetUser(id uint) (User, error) {
+	defer db.observe("GetUser", time.Now())
+	return db.db.GetUser(id)
+}
+
+func (db instrumented) GetUserByDomainUsername(domain, username string) (User, error) {
+	defer db.observe("GetUserByDomainUsername", time.Now())
+	return db.db.GetUserByDomainUsername(domain, username)
+}
+
+func (db instrumented) GetAddress(id uint) (Address, error) {
+	defer db.observe("GetAddress", time.Now())
+	return db.db.GetAddress(id)
+}
+
+func (db instrumented) GetAddressByAddressType(user User, addressType int) (Address, error) {
+	defer db.observe("GetAddressByAddressType", time.Now())
+	return db.db.GetAddressByAddressType(user, addressType)
+}
+
+func (db instrumented) GetAddresses(user User) ([]Address, error) {
+	defer db.observe("GetAddresses", time.Now())
+	return db.db.GetAddresses(user)
+}
+
+func (db instrumented) CreateOrUpdateExtendedKey(user *User, key ExtendedKey) error {
+	defer db.observe("CreateOrUpdateExtendedKey", time.Now())
+	return db.db.CreateOrUpdateExtendedKey(user, key)
+}
+
+func (db instrumented) DeleteExtendedKey(key ExtendedKey) error {
+	defer db.observe("DeleteExtendedKey", time.Now())
+	return db.db.DeleteExtendedKey(key)
+}
+
+func (db instrumented) GetExtendedKey(user User, addressType int) (ExtendedKey, error) {
+	defer db.observe("GetExtendedKey", time.Now())
+	return db.db.GetExtendedKey(user, addressType)
+}
+
+func (db instrumented) UseExtendedKey(key ExtendedKey) (ExtendedKey, error) {
+	defer db.observe("UseExtendedKey", time.Now())
+	return db.db.UseExtendedKey(key)
+}
+
+func (db instrumented) ReplaceAddressPool(user *User, pool AddressPool, addresses []string) error {
+	defer db.observe("ReplaceAddressPool", time.Now())
+	return db.db.ReplaceAddressPool(user, pool, addresses)
+}
+
+func (db instrumented) DeleteAddressPool(pool AddressPool) error {
+	defer db.observe("DeleteAddressPool", time.Now())
+	return db.db.DeleteAddressPool(pool)
+}
+
+func (db instrumented) GetAddressPool(user User, addressType int) (AddressPool, error) {
+	defer db.observe("GetAddressPool", time.Now())
+	return db.db.GetAddressPool(user, addressType)
+}
+
+func (db instrumented) CountAvailablePooledAddresses(pool AddressPool) (int, error) {
+	defer db.observe("CountAvailablePooledAddresses", time.Now())
+	return db.db.CountAvailablePooledAddresses(pool)
+}
+
+func (db instrumented) NextPooledAddress(pool AddressPool) (PooledAddress, error) {
+	defer db.observe("NextPooledAddress", time.Now())
+	return db.db.NextPooledAddress(pool)
+}
+
+func (db instrumented) ListUsers(search string, offset, limit int) ([]User, int, error) {
+	defer db.observe("ListUsers", time.Now())
+	return db.db.ListUsers(search, offset, limit)
+}
+
+func (db instrumented) CreateAdminAction(action *AdminAction) error {
+	defer db.observe("CreateAdminAction", time.Now())
+	return db.db.CreateAdminAction(action)
+}
+
+func (db instrumented) GetAdminActions(offset, limit int) ([]AdminAction, int, error) {
+	defer db.observe("GetAdminActions", time.Now())
+	return db.db.GetAdminActions(offset, limit)
+}
+
+func (db instrumented) CreateInviteCode(invite *InviteCode) error {
+	defer db.observe("CreateInviteCode", time.Now())
+	return db.db.CreateInviteCode(invite)
+}
+
+func (db instrumented) GetInviteCodes(offset, limit int) ([]InviteCode, int, error) {
+	defer db.observe("GetInviteCodes", time.Now())
+	return db.db.GetInviteCodes(offset, limit)
+}
+
+func (db instrumented) RevokeInviteCode(id uint) error {
+	defer db.observe("RevokeInviteCode", time.Now())
+	return db.db.RevokeInviteCode(id)
+}
+
+func (db instrumented) CreateUserWithInviteCode(user *User, codeHash string) error {
+	defer db.observe("CreateUserWithInviteCode", time.Now())
+	return db.db.CreateUserWithInviteCode(user, codeHash)
+}
+
+func (db instrumented) CreateSession(session *Session) error {
+	defer db.observe("CreateSession", time.Now())
+	return db.db.CreateSession(session)
+}
+
+func (db instrumented) RotateRefreshToken(oldHash, newHash string, expiresAt time.Time) (Session, error) {
+	defer db.observe("RotateRefreshToken", time.Now())
+	return db.db.RotateRefreshToken(oldHash, newHash, expiresAt)
+}
+
+func (db instrumented) RevokeSession(tokenID string) error {
+	defer db.observe("RevokeSession", time.Now())
+	return db.db.RevokeSession(tokenID)
+}
+
+func (db instrumented) RevokeUserSessions(user User) error {
+	defer db.observe("RevokeUserSessions", time.Now())
+	return db.db.RevokeUserSessions(user)
+}
+
+func (db instrumented) IsTokenRevoked(tokenID string) (bool, error) {
+	defer db.observe("IsTokenRevoked", time.Now())
+	return db.db.IsTokenRevoked(tokenID)
+}
+
+func (db instrumented) DeleteExpiredSessions() error {
+	defer db.observe("DeleteExpiredSessions", time.Now())
+	return db.db.DeleteExpiredSessions()
+}
+
+func (db instrumented) UseTOTPCounter(user User, counter int64) (bool, error) {
+	defer db.observe("UseTOTPCounter", time.Now())
+	return db.db.UseTOTPCounter(user, counter)
+}
+
+func (db instrumented) ReplaceRecoveryCodes(user User, purpose string, codeHashes []string) error {
+	defer db.observe("ReplaceRecoveryCodes", time.Now())
+	return db.db.ReplaceRecoveryCodes(user, purpose, codeHashes)
+}
+
+func (db instrumented) UseRecoveryCode(user User, purpose, codeHash string) (bool, error) {
+	defer db.observe("UseRecoveryCode", time.Now())
+	return db.db.UseRecoveryCode(user, purpose, codeHash)
+}
+
+func (db instrumented) RecoverUser(user User, codeHash string) (bool, error) {
+	defer db.observe("RecoverUser", time.Now())
+	return db.db.RecoverUser(user, codeHash)
+}
+
+func (db instrumented) CountLoginAttempt(subject string, window time.Duration, delay func(failures int) time.Duration) (LoginThrottle, time.Duration, error) {
+	defer db.observe("CountLoginAttempt", time.Now())
+	return db.db.CountLoginAttempt(subject, window, delay)
+}
+
+func (db instrumented) UncountLoginAttempt(subject string) error {
+	defer db.observe("UncountLoginAttempt", time.Now())
+	return db.db.UncountLoginAttempt(subject)
+}
+
+func (db instrumented) ResetLoginFailures(subject string) error {
+	defer db.observe("ResetLoginFailures", time.Now())
+	return db.db.ResetLoginFailures(subject)
+}
+
+func (db instrumented) CreateAPIKey(key *APIKey) error {
+	defer db.observe("CreateAPIKey", time.Now())
+	return db.db.CreateAPIKey(key)
+}
+
+func (db instrumented) GetAPIKeyByHash(keyHash string) (APIKey, error) {
+	defer db.observe("GetAPIKeyByHash", time.Now())
+	return db.db.GetAPIKeyByHash(keyHash)
+}
+
+func (db instrumented) GetAPIKeys(user User) ([]APIKey, error) {
+	defer db.observe("GetAPIKeys", time.Now())
+	return db.db.GetAPIKeys(user)
+}
+
+func (db instrumented) RevokeAPIKey(user User, id uint) error {
+	defer db.observe("RevokeAPIKey", time.Now())
+	return db.db.RevokeAPIKey(user, id)
+}
+
+func (db instrumented) ChangeAddresses(change *AddressChange, apply func(Database) error) error {
+	defer db.observe("ChangeAddresses", time.Now())
+	return db.db.ChangeAddresses(change, func(tx Database) error {
+		return apply(instrumented{db: tx, observe: db.observe})
+	})
+}
+
+func (db instrumented) GetAddressChanges(user User, addressType, offset, limit int) ([]AddressChange, int, error) {
+	defer db.observe("GetAddressChanges", time.Now())
+	return db.db.GetAddressChanges(user, addressType, offset, limit)
+}
+
+func (db instrumented) GetAddressChange(user User, id uint) (AddressChange, error) {
+	defer db.observe("GetAddressChange", time.Now())
+	return db.db.GetAddressChange(user, id)
+}
+
+func (db instrumented) CreateAuditEvent(event *AuditEvent) error {
+	defer db.observe("CreateAuditEvent", time.Now())
+	return db.db.CreateAuditEvent(event)
+}
+
+func (db instrumented) GetUserAuditEvents(user User, offset, limit int) ([]AuditEvent, int, error) {
+	defer db.observe("GetUserAuditEvents", time.Now())
+	return db.db.GetUserAuditEvents(user, offset, limit)
+}
+
+func (db instrumented) ExportAuditEvents(filter AuditFilter, afterID uint, limit int) ([]AuditEvent, error) {
+	defer db.observe("ExportAuditEvents", time.Now())
+	return db.db.ExportAuditEvents(filter, afterID, limit)
+}
@@ -0,0 +1,286 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is how important a log line is, lines below a logger's level are
+// dropped
+type Level int
+
+// The levels from least to most important
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with the given name
+func ParseLevel(name string) (Level, error) {
+	for i, v := range levelNames {
+		if strings.EqualFold(name, v) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, errors.New("Log level must be one of " + strings.Join(levelNames, ", "))
+}
+
+// Formats lines can be written in
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// Redacted replaces secrets in log lines
+const Redacted = "[REDACTED]"
+
+// secretKeys are fields whose values are always redacted
+var secretKeys = map[string]bool{
+	"password":             true,
+	"old_password":         true,
+	"new_password":         true,
+	"create_user_password": true,
+	"jwt":                  true,
+	"token":                true,
+	"refresh_token":        true,
+	"authorization":        true,
+	"otp":                  true,
+	"recovery_code":        true,
+}
+
+// secretPatterns find secrets in free text: JWTs, bearer credentials and
+// API keys
+var secretPatterns = []struct {
+	re          *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*`), Redacted},
+	{regexp.MustCompile(`(?i)(bearer\s+)\S+`), "${1}" + Redacted},
+	{regexp.MustCompile(`ocak_[a-z2-7]+`), Redacted},
+}
+
+// output is shared by a logger and the loggers derived from it
+type output struct {
+	mu      sync.Mutex
+	w       io.Writer
+	level   Level
+	format  string
+	secrets []string
+}
+
+// Logger writes leveled, structured log lines. Fields are key value pairs,
+// the keys are strings.
+type Logger struct {
+	out    *output
+	fields []interface{}
+}
+
+// New returns a logger that writes lines at level and above to w in format
+func New(w io.Writer, level Level, format string) (*Logger, error) {
+	if format != FormatJSON && format != FormatLogfmt {
+		return nil, errors.New("Log format must be " + FormatJSON + " or " + FormatLogfmt)
+	}
+	return &Logger{out: &output{w: w, level: level, format: format}}, nil
+}
+
+// Default is used until the server's logger is set up and by requests that
+// don't have one
+var Default = &Logger{out: &output{w: os.Stderr, level: LevelInfo, format: FormatLogfmt}}
+
+// RedactValues has the logger, and every logger derived from it, redact
+// the given secrets wherever they appear. Empty values are ignored.
+func (l *Logger) RedactValues(secrets ...string) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	for _, v := range secrets {
+		if v != "" {
+			l.out.secrets = append(l.out.secrets, v)
+		}
+	}
+}
+
+// With returns a logger that adds fields to every line
+func (l *Logger) With(fields ...interface{}) *Logger {
+	return &Logger{out: l.out, fields: append(append([]interface{}(nil), l.fields...), fields...)}
+}
+
+// Enabled is whether lines at level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.out.level
+}
+
+// Debug logs a message that's only useful when looking into a problem
+func (l *Logger) Debug(msg string, fields ...interface{}) {
+	l.log(LevelDebug, msg, fields)
+}
+
+// Info logs a message about normal operation
+func (l *Logger) Info(msg string, fields ...interface{}) {
+	l.log(LevelInfo, msg, fields)
+}
+
+// Warn logs a message about something that may need attention
+func (l *Logger) Warn(msg string, fields ...interface{}) {
+	l.log(LevelWarn, msg, fields)
+}
+
+// Error logs a message about something that failed
+func (l *Logger) Error(msg string, fields ...interface{}) {
+	l.log(LevelError, msg, fields)
+}
+
+// Fatal logs an error and exits
+func (l *Logger) Fatal(msg string, fields ...interface{}) {
+	l.log(LevelError, msg, fields)
+	os.Exit(1)
+}
+
+// Writer returns a writer that logs each write as a message at level, so
+// packages using the standard log package can log through l
+func (l *Logger) Writer(level Level) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		l.log(level, strings.TrimRight(string(p), "\n"), nil)
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func (l *Logger) log(level Level, msg string, fields []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	all := make([]interface{}, 0, 6+len(l.fields)+len(fields))
+	all = append(all, "time", time.Now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg)
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+	if len(all)%2 != 0 {
+		all = append(all, "")
+	}
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	b := bytes.Buffer{}
+	if l.out.format == FormatJSON {
+		l.out.writeJSON(&b, all)
+	} else {
+		l.out.writeLogfmt(&b, all)
+	}
+	b.WriteByte('\n')
+	l.out.w.Write(b.Bytes())
+}
+
+// value returns a field's value as a string with any secrets redacted. The
+// caller holds o.mu.
+func (o *output) value(key string, v interface{}) string {
+	if secretKeys[strings.ToLower(key)] {
+		return Redacted
+	}
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	case time.Duration:
+		s = v.String()
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+	return o.redact(s)
+}
+
+func (o *output) redact(s string) string {
+	for _, v := range o.secrets {
+		s = strings.Replace(s, v, Redacted, -1)
+	}
+	for _, v := range secretPatterns {
+		s = v.re.ReplaceAllString(s, v.replacement)
+	}
+	return s
+}
+
+func (o *output) writeJSON(b *bytes.Buffer, fields []interface{}) {
+	b.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key := fmt.Sprint(fields[i])
+		k, _ := json.Marshal(key)
+		b.Write(k)
+		b.WriteByte(':')
+		var j []byte
+		switch v := fields[i+1].(type) {
+		case int, int64, uint, uint64, float64, bool:
+			j, _ = json.Marshal(v)
+		default:
+			j, _ = json.Marshal(o.value(key, v))
+		}
+		if secretKeys[strings.ToLower(key)] {
+			j, _ = json.Marshal(Redacted)
+		}
+		b.Write(j)
+	}
+	b.WriteByte('}')
+}
+
+func (o *output) writeLogfmt(b *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		key := fmt.Sprint(fields[i])
+		b.WriteString(key)
+		b.WriteByte('=')
+		v := o.value(key, fields[i+1])
+		if v == "" || strings.ContainsAny(v, " =\"\\\n\t") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(v)
+	}
+}
+
+type contextKey int
+
+const loggerKey contextKey = 0
+
+// NewContext returns a context carrying a logger
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
+
+// FromRequest returns the logger of a request, or Default if it hasn't got
+// one
+func FromRequest(req *http.Request) *Logger {
+	if l, ok := req.Context().Value(loggerKey).(*Logger); ok {
+		return l
+	}
+	return Default
+}
@@ -1,16 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/opencap/go-server/configure"
 
 	"github.com/joho/godotenv"
 	"github.com/opencap/go-server/api"
+	"github.com/opencap/go-server/logging"
 )
 
 func main() {
@@ -20,6 +23,14 @@ func main() {
 	closePort := flag.String("closeport", "", "Close the PORT from your router to this device")
 	getIP := flag.Bool("getip", false, "Print out the public IP address of this machine")
 	setupDatabase := flag.Bool("setupdatabase", false, "Setup the database for the first time")
+	listAddressTypes := flag.Bool("addresstypes", false, "Print out the address types and whether they are enabled")
+	createInvite := flag.Bool("createinvite", false, "Create an invite code and print it out")
+	inviteUses := flag.Uint("inviteuses", 1, "How many users the invite code can create")
+	inviteUsername := flag.String("inviteusername", "", "Only allow the invite code to create this username")
+	inviteDomain := flag.String("invitedomain", "", "Only allow the invite code to create users on this domain")
+	inviteExpires := flag.Duration("inviteexpires", 0, "How long until the invite code expires (e.g. 72h), it never expires by default")
+	revokeInvite := flag.Uint("revokeinvite", 0, "Revoke the invite code with this id")
+	addressKeyRecords := flag.Bool("addresskeyrecords", false, "Print out the DNS TXT records that publish the address signing keys")
 	flag.Parse()
 
 	if *openPort != "" {
@@ -49,6 +60,61 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *listAddressTypes {
+		cfg := api.Config{}
+		if err := cfg.InitAddressTypes(); err != nil {
+			log.Fatal(err.Error())
+		}
+		for _, t := range cfg.AddressTypes().Types() {
+			status := "disabled"
+			if cfg.AddressTypes().IsEnabled(t.ID) {
+				status = "enabled"
+			}
+			fmt.Printf("%v\t%v\t%v\n", t.ID, t.Name, status)
+		}
+		os.Exit(0)
+	}
+
+	if *addressKeyRecords {
+		cfg := api.Config{}
+		if err := cfg.InitAddressSigning(); err != nil {
+			log.Fatal(err.Error())
+		}
+		records := cfg.AddressKeyDNSRecords()
+		if len(records) == 0 {
+			log.Fatal("ADDRESS_SIGNING_KEY isn't set")
+		}
+		for _, record := range records {
+			fmt.Printf("_opencap-keys\tTXT\t\"%v\"\n", record)
+		}
+		os.Exit(0)
+	}
+
+	if *createInvite {
+		cfg := api.Config{}
+		if err := cfg.InitDB(); err != nil {
+			log.Fatal(err.Error())
+		}
+		code, invite, err := cfg.CreateInviteCode(*inviteUsername, *inviteDomain, *inviteUses, *inviteExpires)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		fmt.Printf("Invite code (id %v): %v\n", invite.ID, code)
+		os.Exit(0)
+	}
+
+	if *revokeInvite != 0 {
+		cfg := api.Config{}
+		if err := cfg.InitDB(); err != nil {
+			log.Fatal(err.Error())
+		}
+		if err := cfg.RevokeInviteCode(*revokeInvite); err != nil {
+			log.Fatal(err.Error())
+		}
+		fmt.Printf("Invite code %v revoked\n", *revokeInvite)
+		os.Exit(0)
+	}
+
 	if *setupDatabase {
 		cfg := api.Config{}
 		if err := cfg.InitDB(); err != nil {
@@ -62,9 +128,24 @@ func main() {
 	}
 
 	server := api.Start()
-	defer server.Shutdown(nil)
 
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt)
-	<-ch
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	exitCode := 0
+	select {
+	case sig := <-ch:
+		logging.Default.Info("Shutting down", "signal", sig.String())
+	case err := <-server.Errors():
+		logging.Default.Error("Shutting down", "error", err)
+		exitCode = 1
+	}
+
+	// In-flight requests get until the deadline to finish
+	ctx, cancel := context.WithTimeout(context.Background(), api.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logging.Default.Error("Couldn't shut down gracefully", "error", err)
+		exitCode = 1
+	}
+	os.Exit(exitCode)
 }
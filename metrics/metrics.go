@@ -0,0 +1,279 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds of histogram buckets in seconds, they
+// suit the latency of HTTP requests and database calls
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	write(b *bytes.Buffer)
+}
+
+// Registry holds a set of metrics and writes them in the Prometheus text
+// exposition format, along with the Go runtime's stats
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry returns a registry that only has the Go runtime's stats
+func NewRegistry() *Registry {
+	return &Registry{collectors: []collector{goCollector{}}}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Write returns every metric in the text exposition format
+func (r *Registry) Write() []byte {
+	r.mu.Lock()
+	collectors := r.collectors
+	r.mu.Unlock()
+
+	b := bytes.Buffer{}
+	for _, c := range collectors {
+		c.write(&b)
+	}
+	return b.Bytes()
+}
+
+// Handler serves the registry's metrics to Prometheus
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(r.Write())
+	})
+}
+
+// vec holds the values of a metric for each combination of its labels
+type vec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+func newVec(name, help, kind string, labels []string) vec {
+	return vec{name: name, help: help, kind: kind, labels: labels, values: map[string]interface{}{}}
+}
+
+// value returns the value for a combination of labels, creating it with
+// create if it's the first time it's been seen. The caller holds v.mu.
+func (v *vec) value(labelValues []string, create func() interface{}) interface{} {
+	if len(labelValues) != len(v.labels) {
+		panic("metrics: " + v.name + " takes " + strconv.Itoa(len(v.labels)) + " label values")
+	}
+	key := strings.Join(labelValues, "\xff")
+	value, ok := v.values[key]
+	if !ok {
+		value = create()
+		v.values[key] = value
+	}
+	return value
+}
+
+// sortedKeys returns the keys of the values in a stable order. The caller
+// holds v.mu.
+func (v *vec) sortedKeys() []string {
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *vec) writeHeader(b *bytes.Buffer) {
+	b.WriteString("# HELP " + v.name + " " + escape(v.help, false) + "\n")
+	b.WriteString("# TYPE " + v.name + " " + v.kind + "\n")
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	vec
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+// NewCounterVec adds a counter with the given label names to the registry
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labels)}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the counter with the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds delta, which can't be negative, to the counter with the given
+// label values
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: " + c.name + " can't decrease")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value := c.value(labelValues, func() interface{} {
+		return &counterValue{labels: append([]string(nil), labelValues...)}
+	}).(*counterValue)
+	value.value += delta
+}
+
+func (c *CounterVec) write(b *bytes.Buffer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(b)
+	for _, k := range c.sortedKeys() {
+		value := c.values[k].(*counterValue)
+		writeSample(b, c.name, c.labels, value.labels, "", "", value.value)
+	}
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec adds a histogram with the given bucket upper bounds, in
+// increasing order, and label names to the registry
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{newVec(name, help, "histogram", labels), buckets}
+	r.register(h)
+	return h
+}
+
+// Observe adds a value to the histogram with the given label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	value := h.value(labelValues, func() interface{} {
+		return &histogramValue{labels: append([]string(nil), labelValues...), counts: make([]uint64, len(h.buckets))}
+	}).(*histogramValue)
+	for i, upper := range h.buckets {
+		if v <= upper {
+			value.counts[i]++
+		}
+	}
+	value.sum += v
+	value.count++
+}
+
+// ObserveSince adds the time since start in seconds to the histogram
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *HistogramVec) write(b *bytes.Buffer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(b)
+	for _, k := range h.sortedKeys() {
+		value := h.values[k].(*histogramValue)
+		for i, upper := range h.buckets {
+			writeSample(b, h.name+"_bucket", h.labels, value.labels, "le", formatFloat(upper), float64(value.counts[i]))
+		}
+		writeSample(b, h.name+"_bucket", h.labels, value.labels, "le", "+Inf", float64(value.count))
+		writeSample(b, h.name+"_sum", h.labels, value.labels, "", "", value.sum)
+		writeSample(b, h.name+"_count", h.labels, value.labels, "", "", float64(value.count))
+	}
+}
+
+// goCollector writes the stats of the Go runtime under the names the
+// official Prometheus client uses, so existing dashboards work
+type goCollector struct{}
+
+func (goCollector) write(b *bytes.Buffer) {
+	stats := runtime.MemStats{}
+	runtime.ReadMemStats(&stats)
+
+	gauge := func(name, help string, value float64) {
+		b.WriteString("# HELP " + name + " " + help + "\n# TYPE " + name + " gauge\n")
+		writeSample(b, name, nil, nil, "", "", value)
+	}
+	counter := func(name, help string, value float64) {
+		b.WriteString("# HELP " + name + " " + help + "\n# TYPE " + name + " counter\n")
+		writeSample(b, name, nil, nil, "", "", value)
+	}
+
+	gauge("go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	gauge("go_threads", "Number of OS threads created.", float64(pprof.Lookup("threadcreate").Count()))
+	b.WriteString("# HELP go_info Information about the Go environment.\n# TYPE go_info gauge\n")
+	writeSample(b, "go_info", []string{"version"}, []string{runtime.Version()}, "", "", 1)
+	gauge("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(stats.Alloc))
+	counter("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", float64(stats.TotalAlloc))
+	gauge("go_memstats_sys_bytes", "Number of bytes obtained from system.", float64(stats.Sys))
+	counter("go_memstats_mallocs_total", "Total number of mallocs.", float64(stats.Mallocs))
+	counter("go_memstats_frees_total", "Total number of frees.", float64(stats.Frees))
+	gauge("go_memstats_heap_alloc_bytes", "Number of heap bytes allocated and still in use.", float64(stats.HeapAlloc))
+	gauge("go_memstats_heap_sys_bytes", "Number of heap bytes obtained from system.", float64(stats.HeapSys))
+	gauge("go_memstats_heap_idle_bytes", "Number of heap bytes waiting to be used.", float64(stats.HeapIdle))
+	gauge("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(stats.HeapInuse))
+	gauge("go_memstats_heap_released_bytes", "Number of heap bytes released to OS.", float64(stats.HeapReleased))
+	gauge("go_memstats_heap_objects", "Number of allocated objects.", float64(stats.HeapObjects))
+	gauge("go_memstats_stack_inuse_bytes", "Number of bytes in use by the stack allocator.", float64(stats.StackInuse))
+	gauge("go_memstats_next_gc_bytes", "Number of heap bytes when next garbage collection will take place.", float64(stats.NextGC))
+	gauge("go_memstats_last_gc_time_seconds", "Number of seconds since 1970 of last garbage collection.", float64(stats.LastGC)/1e9)
+	gauge("go_memstats_gc_cpu_fraction", "The fraction of this program's available CPU time used by the GC since the program started.", stats.GCCPUFraction)
+	counter("go_gc_cycles_total", "Number of completed garbage collection cycles.", float64(stats.NumGC))
+	counter("go_gc_pause_seconds_total", "Total time the world was stopped for garbage collection.", float64(stats.PauseTotalNs)/1e9)
+}
+
+// writeSample writes one line of a metric, extraName and extraValue are a
+// label only this line has, like a histogram bucket's upper bound
+func writeSample(b *bytes.Buffer, name string, labels, labelValues []string, extraName, extraValue string, value float64) {
+	b.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		pairs := make([]string, 0, len(labels)+1)
+		for i, label := range labels {
+			pairs = append(pairs, label+`="`+escape(labelValues[i], true)+`"`)
+		}
+		if extraName != "" {
+			pairs = append(pairs, extraName+`="`+extraValue+`"`)
+		}
+		b.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	b.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escape escapes help text, or label values which also escape quotes
+func escape(s string, quotes bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quotes {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
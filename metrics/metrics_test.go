@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterVec(t *testing.T) {
+	r := &Registry{}
+	c := r.NewCounterVec("logins_total", "Logins.", "result")
+	c.Inc("success")
+	c.Inc("success")
+	c.Inc(`fail"ure`)
+
+	assert.Equal(t, `# HELP logins_total Logins.
+# TYPE logins_total counter
+logins_total{result="fail\"ure"} 1
+logins_total{result="success"} 2
+`, string(r.Write()))
+
+	assert.Panics(t, func() { c.Inc() })
+	assert.Panics(t, func() { c.Add(-1, "success") })
+}
+
+func TestHistogramVec(t *testing.T) {
+	r := &Registry{}
+	h := r.NewHistogramVec("call_seconds", "Calls.", []float64{0.1, 1}, "method")
+	h.Observe(0.05, "GetUser")
+	h.Observe(0.5, "GetUser")
+	h.Observe(2, "GetUser")
+
+	assert.Equal(t, `# HELP call_seconds Calls.
+# TYPE call_seconds histogram
+call_seconds_bucket{method="GetUser",le="0.1"} 1
+call_seconds_bucket{method="GetUser",le="1"} 2
+call_seconds_bucket{method="GetUser",le="+Inf"} 3
+call_seconds_sum{method="GetUser"} 2.55
+call_seconds_count{method="GetUser"} 3
+`, string(r.Write()))
+}
+
+func TestRuntimeStats(t *testing.T) {
+	out := string(NewRegistry().Write())
+	assert.True(t, strings.Contains(out, "\ngo_goroutines "))
+	assert.True(t, strings.Contains(out, "\ngo_memstats_heap_alloc_bytes "))
+	assert.True(t, strings.Contains(out, "\ngo_info{version="))
+}